@@ -2,4 +2,10 @@ module github.com/straubt1/terraform-run-task
 
 go 1.24.0
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.9.0 // indirect
@@ -2,36 +2,207 @@ package helper
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
 )
 
+// Default timeouts for the connections made by the Client
+const (
+	DefaultConnectTimeout      = 10 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultResponseTimeout     = 60 * time.Second
+)
+
+// HTTPConfig configures the connections made by the Client
+type HTTPConfig struct {
+	// ConnectTimeout bounds establishing the TCP connection
+	ConnectTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake
+	TLSHandshakeTimeout time.Duration
+	// ResponseTimeout bounds waiting for the response headers once the request is sent
+	ResponseTimeout time.Duration
+	// RootCAs verifies server certificates, nil uses the system roots (see LoadCABundle for private PKI)
+	RootCAs *x509.CertPool
+	// ProxyURL sends every request through the proxy, nil uses HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment
+	ProxyURL *url.URL
+}
+
+// DefaultHTTPConfig returns the HTTPConfig used until WithHTTPConfig is called
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		ConnectTimeout:      DefaultConnectTimeout,
+		TLSHandshakeTimeout: DefaultTLSHandshakeTimeout,
+		ResponseTimeout:     DefaultResponseTimeout,
+	}
+}
+
+// LoadCABundle returns the system roots plus the PEM certificates in the file
+// Use it for TFE installs with certificates issued by a private CA
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", path, err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
 // Client handles Terraform Cloud API interactions
+// Every operation takes a context, so requests are cancelled when the stage deadline is reached
+// Requests are paced by a RateLimiter shared by every run, and API requests are retried on 429 and 5xx
 type Client struct {
-	httpClient *http.Client
+	httpClient  *http.Client
+	secrets     handler.SecretProvider
+	urlPolicy   *URLPolicy
+	retryPolicy RetryPolicy
+	limiter     *RateLimiter
+	pageSize    int
+	maxPages    int
+	tokens      *TokenResolver
+	planJSON    PlanJSONOptions
 }
 
 // NewClient creates a new TFC API client
+// API tokens are read from the environment until WithSecrets is used
+// URLs from the task request are only called if they pass the URLPolicy, HCP Terraform by default
 func NewClient() *Client {
-	return &Client{
-		httpClient: http.DefaultClient,
+	c := &Client{
+		secrets:     handler.NewEnvProvider(),
+		urlPolicy:   NewURLPolicy(),
+		retryPolicy: DefaultRetryPolicy(),
+		limiter:     NewRateLimiter(DefaultRateLimit),
+		pageSize:    DefaultPageSize,
+		maxPages:    DefaultMaxPages,
+		planJSON:    DefaultPlanJSONOptions(),
+	}
+	c.tokens = NewTokenResolver(c.secrets, handler.TokenMap{})
+	c.httpClient = &http.Client{
+		// Redirects (e.g. configuration version downloads to archivist) must stay on allowed hosts
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return c.urlPolicy.Check(req.URL.String())
+		},
+	}
+	return c.WithHTTPConfig(DefaultHTTPConfig())
+}
+
+// WithHTTPConfig sets the timeouts, CA bundle and proxy used for every request
+// Zero timeouts fall back to the defaults
+func (c *Client) WithHTTPConfig(config HTTPConfig) *Client {
+	defaults := DefaultHTTPConfig()
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = defaults.TLSHandshakeTimeout
+	}
+	if config.ResponseTimeout <= 0 {
+		config.ResponseTimeout = defaults.ResponseTimeout
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != nil {
+		proxy = http.ProxyURL(config.ProxyURL)
+	}
+
+	c.httpClient.Transport = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			RootCAs:    config.RootCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return c
+}
+
+// WithRetryPolicy sets how often rate limited and failed API requests are retried
+func (c *Client) WithRetryPolicy(policy RetryPolicy) *Client {
+	c.retryPolicy = policy
+	return c
+}
+
+// WithRateLimiter sets the limiter that paces every request
+func (c *Client) WithRateLimiter(limiter *RateLimiter) *Client {
+	if limiter != nil {
+		c.limiter = limiter
+	}
+	return c
+}
+
+// WithURLPolicy sets the policy URLs from the task request must pass
+func (c *Client) WithURLPolicy(policy *URLPolicy) *Client {
+	if policy != nil {
+		c.urlPolicy = policy
+	}
+	return c
+}
+
+// CheckURL returns an error if the URL does not pass the URLPolicy
+func (c *Client) CheckURL(url string) error {
+	return c.urlPolicy.Check(url)
+}
+
+// WithSecrets sets the provider the permissive token and the mapped tokens are read from
+func (c *Client) WithSecrets(secrets handler.SecretProvider) *Client {
+	if secrets != nil {
+		c.secrets = secrets
+		c.tokens.secrets = secrets
 	}
+	return c
+}
+
+// WithTokens sets the per-hostname and per-organization tokens tried before the permissive token
+func (c *Client) WithTokens(tokens handler.TokenMap) *Client {
+	c.tokens.tokens = tokens
+	return c
 }
 
 // DownloadConfigurationVersion downloads and extracts a configuration version
-func (c *Client) DownloadConfigurationVersion(outputDirectory string, request api.TaskRequest, extractor ArchiveExtractor) error {
+func (c *Client) DownloadConfigurationVersion(ctx context.Context, outputDirectory string, request api.TaskRequest, extractor ArchiveExtractor) error {
 	cvFolder := filepath.Join(outputDirectory, request.ConfigurationVersionID)
 	cvFile := filepath.Join(outputDirectory, request.ConfigurationVersionID+".tar.gz")
 
+	if err := c.CheckURL(request.ConfigurationVersionDownloadURL); err != nil {
+		return fmt.Errorf("failed to download configuration version: %w", err)
+	}
+
 	// Download the configuration version
-	if err := c.downloadFile(request.ConfigurationVersionDownloadURL, cvFile, request.AccessToken); err != nil {
+	if err := c.downloadFile(ctx, request.ConfigurationVersionDownloadURL, cvFile, request.AccessToken); err != nil {
 		return fmt.Errorf("failed to download configuration version: %w", err)
 	}
 
@@ -43,59 +214,101 @@ func (c *Client) DownloadConfigurationVersion(outputDirectory string, request ap
 	return nil
 }
 
-// DownloadPlanJson downloads the plan as a JSON file
-func (c *Client) DownloadPlanJson(outputDirectory string, request api.TaskRequest) error {
-	filePath := filepath.Join(outputDirectory, "plan_json.json")
+// GetDataFromAPI retrieves data from the TFC API and saves it to a file
+// Every page of a list endpoint is merged into the file, if there are more pages than
+// the client follows the pages it has are saved and an error wrapping ErrPartialResult is returned
+func (c *Client) GetDataFromAPI(ctx context.Context, outputDirectory string, dataType string, request api.TaskRequest) error {
+	body, fetchErr := c.fetchRunData(ctx, request, dataType)
+	if body == nil {
+		return fetchErr
+	}
 
-	body, err := c.makeAPIRequest("GET", request.PlanJSONAPIURL, request.AccessToken, nil)
-	if err != nil {
-		return fmt.Errorf("failed to download plan JSON: %w", err)
+	filePath := filepath.Join(outputDirectory, fmt.Sprintf("%s_api.json", dataType))
+	if err := c.savePrettyJSON(body, filePath); err != nil {
+		return err
 	}
+	return fetchErr
+}
 
-	return c.savePrettyJSON(body, filePath)
+// GetRun retrieves the run, with the related resources in include (e.g. "plan", "apply") in the document's included resources
+func (c *Client) GetRun(ctx context.Context, request api.TaskRequest, include ...string) (*api.Document[api.RunAttributes], error) {
+	return getDocument[api.Document[api.RunAttributes]](ctx, c, request, "run", include...)
 }
 
-// GetDataFromAPI retrieves data from the TFC API and saves it to a file
-func (c *Client) GetDataFromAPI(outputDirectory string, dataType string, request api.TaskRequest) error {
-	token := c.GetPermissiveToken()
-	if token == "" {
-		return fmt.Errorf("permissive token not set in environment variable TERRAFORM_API_TOKEN")
-	}
+// GetPlan retrieves the plan of the run
+func (c *Client) GetPlan(ctx context.Context, request api.TaskRequest) (*api.Document[api.PlanAttributes], error) {
+	return getDocument[api.Document[api.PlanAttributes]](ctx, c, request, "plan")
+}
 
-	hostname := c.GetHostname(request)
-	apiPath := dataType
-	if dataType == "run" { // no sub-path for run
-		apiPath = ""
-	}
+// GetApply retrieves the apply of the run
+func (c *Client) GetApply(ctx context.Context, request api.TaskRequest) (*api.Document[api.ApplyAttributes], error) {
+	return getDocument[api.Document[api.ApplyAttributes]](ctx, c, request, "apply")
+}
 
-	filePath := filepath.Join(outputDirectory, fmt.Sprintf("%s_api.json", dataType))
-	url := fmt.Sprintf("%s/api/v2/runs/%s/%s", hostname, request.RunID, apiPath)
+// The List methods follow every page of the list, if there are more pages than the client follows
+// the document holds the pages fetched so far and the error wraps ErrPartialResult
 
-	body, err := c.makeAPIRequest("GET", url, token, nil)
-	if err != nil {
-		return fmt.Errorf("failed to get %s data: %w", dataType, err)
-	}
+// ListPolicyChecks retrieves the Sentinel policy checks of the run
+func (c *Client) ListPolicyChecks(ctx context.Context, request api.TaskRequest) (*api.ListDocument[api.PolicyCheckAttributes], error) {
+	return getDocument[api.ListDocument[api.PolicyCheckAttributes]](ctx, c, request, "policy-checks")
+}
 
-	return c.savePrettyJSON(body, filePath)
+// ListComments retrieves the comments on the run
+func (c *Client) ListComments(ctx context.Context, request api.TaskRequest) (*api.ListDocument[api.CommentAttributes], error) {
+	return getDocument[api.ListDocument[api.CommentAttributes]](ctx, c, request, "comments")
 }
 
-// GetLogs retrieves logs from the API based on the API response file
-func (c *Client) GetLogs(outputDirectory, logType string, request api.TaskRequest) error {
-	apiFileName := fmt.Sprintf("%s_api.json", logType)
-	logFileName := fmt.Sprintf("%s_logs.txt", logType)
+// ListTaskStages retrieves the task stages of the run
+func (c *Client) ListTaskStages(ctx context.Context, request api.TaskRequest) (*api.ListDocument[api.TaskStageAttributes], error) {
+	return getDocument[api.ListDocument[api.TaskStageAttributes]](ctx, c, request, "task-stages")
+}
 
-	logURL, err := c.extractLogURL(filepath.Join(outputDirectory, apiFileName))
-	if err != nil {
-		return err // This will return nil if file not found, which is expected behavior
+// ListRunEvents retrieves the events of the run
+func (c *Client) ListRunEvents(ctx context.Context, request api.TaskRequest) (*api.ListDocument[api.RunEventAttributes], error) {
+	return getDocument[api.ListDocument[api.RunEventAttributes]](ctx, c, request, "run-events")
+}
+
+// GetLogs downloads the logs of the plan or apply of the run
+// The log URL is read from the plan or apply GetDataFromAPI already saved in outputDirectory, the
+// plan or apply is only fetched when it was not saved
+func (c *Client) GetLogs(ctx context.Context, outputDirectory, logType string, request api.TaskRequest) error {
+	var logURL string
+	switch logType {
+	case "plan":
+		plan, err := savedDocument[api.Document[api.PlanAttributes]](ctx, c, outputDirectory, request, "plan")
+		if err != nil {
+			return err
+		}
+		logURL = plan.Data.Attributes.LogReadURL
+	case "apply":
+		apply, err := savedDocument[api.Document[api.ApplyAttributes]](ctx, c, outputDirectory, request, "apply")
+		if err != nil {
+			return err
+		}
+		logURL = apply.Data.Attributes.LogReadURL
+	default:
+		return fmt.Errorf("unknown log type %s, expected plan or apply", logType)
 	}
 
-	logFilePath := filepath.Join(outputDirectory, logFileName)
-	return c.downloadFile(logURL, logFilePath, "")
+	if logURL == "" {
+		return fmt.Errorf("log-read-url not found in %s", logType)
+	}
+	if err := c.CheckURL(logURL); err != nil {
+		return fmt.Errorf("failed to download %s logs: %w", logType, err)
+	}
+
+	logFilePath := filepath.Join(outputDirectory, fmt.Sprintf("%s_logs.txt", logType))
+	return c.downloadFile(ctx, logURL, logFilePath, "")
 }
 
-// GetPermissiveToken gets a permissive token from the environment variable
+// GetPermissiveToken gets a permissive token from the secret provider
+// It is read on every call so a rotated token is picked up without a restart
 func (c *Client) GetPermissiveToken() string {
-	return os.Getenv("TERRAFORM_API_TOKEN")
+	token, err := c.secrets.Secret(handler.SecretAPIToken)
+	if err != nil {
+		return ""
+	}
+	return token
 }
 
 // GetHostname extracts the hostname from the task request callback URL
@@ -109,8 +322,17 @@ func (c *Client) GetHostname(request api.TaskRequest) string {
 }
 
 // SendGenericHttpRequest sends a generic HTTP request with the required headers
-func (c *Client) SendGenericHttpRequest(url string, method string, accessToken string, body []byte) (*http.Response, error) {
-	return c.makeHTTPRequest(method, url, accessToken, body)
+func (c *Client) SendGenericHttpRequest(ctx context.Context, url string, method string, accessToken string, body []byte) (*http.Response, error) {
+	return c.makeHTTPRequest(ctx, method, url, accessToken, body)
+}
+
+// StatusError is returned when the API answers with an unexpected status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
 }
 
 // ArchiveExtractor interface for extracting archives (allows for easier testing)
@@ -120,25 +342,25 @@ type ArchiveExtractor interface {
 
 // Private helper methods
 
-func (c *Client) downloadFile(url, filePath, accessToken string) error {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	if accessToken != "" {
-		req.Header.Set("Authorization", "Bearer "+accessToken)
-		req.Header.Set("Content-Type", api.JsonApiMediaTypeHeader)
-	}
-
-	resp, err := c.httpClient.Do(req)
+func (c *Client) downloadFile(ctx context.Context, url, filePath, accessToken string) error {
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+			req.Header.Set("Content-Type", api.JsonApiMediaTypeHeader)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	outFile, err := os.Create(filePath)
@@ -155,37 +377,85 @@ func (c *Client) downloadFile(url, filePath, accessToken string) error {
 	return nil
 }
 
-func (c *Client) makeAPIRequest(method, url, accessToken string, body []byte) ([]byte, error) {
-	resp, err := c.makeHTTPRequest(method, url, accessToken, body)
+// makeAPIRequest sends an API request, retrying rate limited and failed requests
+func (c *Client) makeAPIRequest(ctx context.Context, method, url, accessToken string, body []byte) ([]byte, error) {
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		return c.newRequest(ctx, method, url, accessToken, body)
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	return io.ReadAll(resp.Body)
 }
 
-func (c *Client) makeHTTPRequest(method, url, accessToken string, body []byte) (*http.Response, error) {
+// makeHTTPRequest sends a single request without retries, the caller decides what to do with the response
+func (c *Client) makeHTTPRequest(ctx context.Context, method, url, accessToken string, body []byte) (*http.Response, error) {
+	return c.do(ctx, false, func() (*http.Request, error) {
+		return c.newRequest(ctx, method, url, accessToken, body)
+	})
+}
+
+func (c *Client) newRequest(ctx context.Context, method, url, accessToken string, body []byte) (*http.Request, error) {
 	var reqBody io.Reader
 	if body != nil {
 		reqBody = bytes.NewReader(body)
 	}
 
-	req, err := http.NewRequest(method, url, reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", api.JsonApiMediaTypeHeader)
 	if accessToken != "" {
 		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
+	return req, nil
+}
 
-	return c.httpClient.Do(req)
+// do sends the request built by newRequest once the rate limiter allows it
+// With retry set, 429 and 5xx responses are retried following the RetryPolicy and counted in the RequestStats of the context
+// The request is built again for each attempt so the body can be resent
+func (c *Client) do(ctx context.Context, retry bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if err := c.limiter.Wait(ctx, req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		c.limiter.Observe(req.URL.Host, resp)
+
+		if !retry || attempt >= c.retryPolicy.MaxRetries || !c.retryPolicy.shouldRetry(resp.StatusCode) {
+			return resp, nil
+		}
+
+		delay := c.retryPolicy.delay(attempt+1, resp.Header)
+		// Drain the body so the connection can be reused for the retry
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		_ = resp.Body.Close()
+		recordRetry(ctx)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
 }
 
 func (c *Client) savePrettyJSON(data []byte, filePath string) error {
@@ -208,29 +478,87 @@ func (c *Client) savePrettyJSON(data []byte, filePath string) error {
 	return nil
 }
 
-func (c *Client) extractLogURL(apiFilePath string) (string, error) {
-	apiData, err := os.ReadFile(apiFilePath)
+// fetchRunData gets /api/v2/runs/:id/<dataType> ("run" for the run itself)
+// The least privileged token is tried first, see TokenResolver. The class of the token that
+// worked is recorded in the RequestStats of the context.
+func (c *Client) fetchRunData(ctx context.Context, request api.TaskRequest, dataType string, include ...string) ([]byte, error) {
+	hostname := c.GetHostname(request)
+	apiPath := dataType
+	if dataType == "run" { // no sub-path for run
+		apiPath = ""
+	}
+
+	url := fmt.Sprintf("%s/api/v2/runs/%s/%s", hostname, request.RunID, apiPath)
+	if len(include) > 0 {
+		url += "?include=" + strings.Join(include, ",")
+	}
+
+	// The hostname comes from the request body, never send a token to a host that is not allowed
+	if err := c.CheckURL(url); err != nil {
+		return nil, fmt.Errorf("refusing to send API token: %w", err)
+	}
+
+	host := strings.TrimPrefix(strings.TrimPrefix(hostname, "https://"), "http://")
+	candidates := c.tokens.Candidates(request, host, dataType)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no API token for %s: the request has no access token and %s was not found in any secret provider", dataType, handler.SecretAPIToken)
+	}
+
+	var body []byte
+	var err error
+	for i, token := range candidates {
+		if listEndpoints[dataType] {
+			body, err = c.fetchAllPages(ctx, url, token.Value)
+		} else {
+			body, err = c.makeAPIRequest(ctx, "GET", url, token.Value, nil)
+		}
+
+		// Escalate to the next token only if this one was not allowed to read the endpoint
+		if isAccessDenied(err) && i < len(candidates)-1 {
+			continue
+		}
+		if body != nil {
+			if i > 0 {
+				c.tokens.Remember(request, host, dataType, token.Class)
+			}
+			recordTokenClass(ctx, token.Class)
+		}
+		break
+	}
 	if err != nil {
-		// If file is not found, skip this step (expected behavior)
-		return "", nil
+		err = fmt.Errorf("failed to get %s data: %w", dataType, err)
 	}
+	return body, err
+}
 
-	var apiResponse struct {
-		Data struct {
-			Attributes struct {
-				LogReadURL string `json:"log-read-url"`
-			} `json:"attributes"`
-		} `json:"data"`
+// getDocument fetches run data and decodes it into the JSON:API document type D
+func getDocument[D any](ctx context.Context, c *Client, request api.TaskRequest, dataType string, include ...string) (*D, error) {
+	body, fetchErr := c.fetchRunData(ctx, request, dataType, include...)
+	if body == nil {
+		return nil, fetchErr
 	}
 
-	if err := json.Unmarshal(apiData, &apiResponse); err != nil {
-		return "", fmt.Errorf("failed to parse API JSON: %w", err)
+	var document D
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode %s data: %w", dataType, err)
 	}
+	return &document, fetchErr
+}
 
-	logURL := apiResponse.Data.Attributes.LogReadURL
-	if logURL == "" {
-		return "", fmt.Errorf("log-read-url not found in API response")
+// savedDocument decodes the <dataType>_api.json saved by GetDataFromAPI into the JSON:API document type D,
+// and only fetches the document when it was not saved
+func savedDocument[D any](ctx context.Context, c *Client, outputDirectory string, request api.TaskRequest, dataType string) (*D, error) {
+	data, err := os.ReadFile(filepath.Join(outputDirectory, fmt.Sprintf("%s_api.json", dataType)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return getDocument[D](ctx, c, request, dataType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saved %s data: %w", dataType, err)
 	}
 
-	return logURL, nil
+	var document D
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode saved %s data: %w", dataType, err)
+	}
+	return &document, nil
 }
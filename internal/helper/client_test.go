@@ -0,0 +1,145 @@
+package helper
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// Requests are cancelled with their context instead of waiting for a slow server
+func TestClientRequestHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewClient().SendGenericHttpRequest(ctx, srv.URL, http.MethodGet, "", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// The response timeout applies even without a context deadline
+func TestClientResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := NewClient().WithHTTPConfig(HTTPConfig{ResponseTimeout: 50 * time.Millisecond})
+	if _, err := client.SendGenericHttpRequest(context.Background(), srv.URL, http.MethodGet, "", nil); err == nil {
+		t.Fatalf("expected a timeout error")
+	}
+}
+
+// A CA bundle lets the client trust servers with certificates from a private CA
+func TestClientCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient().SendGenericHttpRequest(context.Background(), srv.URL, http.MethodGet, "", nil); err == nil {
+		t.Fatalf("expected the self-signed certificate to be rejected without a CA bundle")
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA bundle: %v", err)
+	}
+	pool, err := LoadCABundle(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := NewClient().WithHTTPConfig(HTTPConfig{RootCAs: pool})
+	resp, err := client.SendGenericHttpRequest(context.Background(), srv.URL, http.MethodGet, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestLoadCABundleRejectsEmptyFile(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write CA bundle: %v", err)
+	}
+	if _, err := LoadCABundle(bundle); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+// GetLogs finds the log URL through the saved plan, or the typed plan when it was not saved
+func TestClientGetLogsUsesTypedPlan(t *testing.T) {
+	var srvURL string
+	var planRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/runs/run-123/plan":
+			planRequests++
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expected the permissive token, got %q", r.Header.Get("Authorization"))
+			}
+			_, _ = w.Write([]byte(`{"data": {"id": "plan-1", "type": "plans", "attributes": {"status": "finished", "log-read-url": "` + srvURL + `/logs/plan-1"}}}`))
+		case "/logs/plan-1":
+			_, _ = w.Write([]byte("Terraform plan output"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+	t.Setenv("TERRAFORM_API_TOKEN", "token")
+
+	serverURL, _ := url.Parse(srv.URL)
+	client := NewClient().WithURLPolicy(NewURLPolicy(serverURL.Host).AllowScheme("http"))
+	request := api.TaskRequest{RunID: "run-123", TaskResultCallbackURL: srv.URL + "/api/v2/task-results/tr-1/callback"}
+
+	plan, err := client.GetPlan(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.Data.ID != "plan-1" || plan.Data.Attributes.Status != "finished" {
+		t.Fatalf("unexpected plan: %+v", plan.Data)
+	}
+
+	dir := t.TempDir()
+	if err := client.GetLogs(context.Background(), dir, "plan", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logs, err := os.ReadFile(filepath.Join(dir, "plan_logs.txt"))
+	if err != nil || string(logs) != "Terraform plan output" {
+		t.Fatalf("unexpected logs %q (%v)", logs, err)
+	}
+
+	// The plan saved by the plan collector is reused instead of being requested again
+	planRequests = 0
+	dir = t.TempDir()
+	if err := client.GetDataFromAPI(context.Background(), dir, "plan", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.GetLogs(context.Background(), dir, "plan", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if planRequests != 1 {
+		t.Fatalf("expected the plan to be requested once, got %d", planRequests)
+	}
+}
@@ -0,0 +1,661 @@
+package helper
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a compiled boolean expression over JSON-like values, used by declarative rules
+// Values are what encoding/json decodes into any: nil, bool, float64, string, []any and map[string]any
+//
+//	change.after.acl == "public-read" && !(change.after.tags.Owner in ["platform", "security"])
+//
+// Operators, from lowest to highest precedence: ||, &&, ! , == != < <= > >= in, then paths, literals,
+// lists [a, b], parentheses and function calls. Paths start at a variable of the environment and
+// read map keys with .key or ["key"] and list items with [0]; a missing key or index is null rather than an error.
+// Functions: len, contains, startswith, endswith, matches (regular expression), lower, upper, exists.
+// The pattern of matches must be a string literal, it is compiled with the expression.
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpression parses an expression, syntax errors include the position in the source
+func CompileExpression(source string) (*Expression, error) {
+	p := &exprParser{lexer: exprLexer{src: source}}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil && p.err != nil {
+		err = p.err // lexer errors end the token stream early
+	}
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %q", p.tok.text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression with the variables in env
+func (e *Expression) Eval(env map[string]any) (any, error) {
+	return e.root.eval(env)
+}
+
+// EvalBool evaluates the expression and requires a boolean result, null counts as false
+func (e *Expression) EvalBool(env map[string]any) (bool, error) {
+	value, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value)
+}
+
+type exprNode interface {
+	eval(env map[string]any) (any, error)
+}
+
+type literalNode struct{ value any }
+
+func (n literalNode) eval(map[string]any) (any, error) { return n.value, nil }
+
+type listNode struct{ items []exprNode }
+
+func (n listNode) eval(env map[string]any) (any, error) {
+	values := make([]any, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+type variableNode struct{ name string }
+
+func (n variableNode) eval(env map[string]any) (any, error) {
+	value, ok := env[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", n.name)
+	}
+	return value, nil
+}
+
+// indexNode reads a map key or list item, missing keys and out of range indexes are null
+type indexNode struct {
+	target exprNode
+	index  exprNode
+}
+
+func (n indexNode) eval(env map[string]any) (any, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %s", typeName(index))
+		}
+		return t[key], nil
+	case []any:
+		f, ok := index.(float64)
+		if !ok || f != float64(int(f)) {
+			return nil, fmt.Errorf("list index must be an integer, got %s", typeName(index))
+		}
+		if i := int(f); i >= 0 && i < len(t) {
+			return t[i], nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(target))
+}
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+func (n unaryNode) eval(env map[string]any) (any, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, err := truthy(v)
+		return !b, err
+	case "-":
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s", typeName(v))
+		}
+		return -f, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(env map[string]any) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || only evaluate the right side when needed, so guards like exists(x) && x > 1 work
+	if n.op == "&&" || n.op == "||" {
+		l, err := truthy(left)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", n.op, err)
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := truthy(right)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", n.op, err)
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	case "in":
+		return contains(right, left)
+	}
+
+	// Ordering is only defined between two numbers or two strings
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s %s %s", typeName(left), n.op, typeName(right))
+		}
+		cmp = compareOrdered(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s %s %s", typeName(left), n.op, typeName(right))
+		}
+		cmp = compareOrdered(l, r)
+	default:
+		return nil, fmt.Errorf("cannot compare %s %s %s", typeName(left), n.op, typeName(right))
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+	re   *regexp.Regexp // the compiled pattern of matches
+}
+
+// exprFunctions are the functions an expression can call, with their number of arguments
+var exprFunctions = map[string]int{
+	"len": 1, "contains": 2, "startswith": 2, "endswith": 2, "matches": 2, "lower": 1, "upper": 1, "exists": 1,
+}
+
+func (n callNode) eval(env map[string]any) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch n.name {
+	case "exists":
+		return args[0] != nil, nil
+	case "len":
+		switch v := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(len(v)), nil
+		case []any:
+			return float64(len(v)), nil
+		case map[string]any:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("len: unsupported %s", typeName(args[0]))
+	case "contains":
+		return contains(args[0], args[1])
+	case "lower", "upper":
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a string, got %s", n.name, typeName(args[0]))
+		}
+		if n.name == "lower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+	}
+
+	// The remaining functions take two strings, null never matches
+	if args[0] == nil {
+		return false, nil
+	}
+	s, ok1 := args[0].(string)
+	arg, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s: expected strings, got %s and %s", n.name, typeName(args[0]), typeName(args[1]))
+	}
+	switch n.name {
+	case "startswith":
+		return strings.HasPrefix(s, arg), nil
+	case "endswith":
+		return strings.HasSuffix(s, arg), nil
+	case "matches":
+		return n.re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", n.name)
+}
+
+// contains reports whether the list has the item, the map has the key, or the string has the substring
+func contains(collection, item any) (any, error) {
+	switch c := collection.(type) {
+	case nil:
+		return false, nil
+	case []any:
+		for _, v := range c {
+			if reflect.DeepEqual(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		key, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %s", typeName(item))
+		}
+		_, found := c[key]
+		return found, nil
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot look for %s in a string", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	}
+	return nil, fmt.Errorf("cannot look into %s", typeName(collection))
+}
+
+func truthy(v any) (bool, error) {
+	switch b := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return b, nil
+	}
+	return false, fmt.Errorf("expected a boolean, got %s", typeName(v))
+}
+
+func compareOrdered[T float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind  tokenKind
+	text  string
+	value any
+	pos   int
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+var comparisonOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// twoCharOps are matched before the single character operators
+var twoCharOps = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+func (l *exprLexer) next() (exprToken, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return exprToken{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		// Both quote styles are accepted so expressions can be written inside YAML strings
+		end := l.pos + 1
+		for end < len(l.src) && l.src[end] != c {
+			if l.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(l.src) {
+			return exprToken{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		raw := l.src[l.pos+1 : end]
+		l.pos = end + 1
+		if c == '\'' {
+			raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+		}
+		value, err := strconv.Unquote(`"` + raw + `"`)
+		if err != nil {
+			return exprToken{}, fmt.Errorf("invalid string at %d: %w", start, err)
+		}
+		return exprToken{kind: tokString, text: l.src[start:l.pos], value: value, pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		text := l.src[start:l.pos]
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return exprToken{}, fmt.Errorf("invalid number %q at %d", text, start)
+		}
+		return exprToken{kind: tokNumber, text: text, value: f, pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return exprToken{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range twoCharOps {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += 2
+			return exprToken{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	if strings.ContainsRune("!<>()[].,-", rune(c)) {
+		l.pos++
+		return exprToken{kind: tokOp, text: string(c), pos: start}, nil
+	}
+	return exprToken{}, fmt.Errorf("unexpected character %q at %d", c, start)
+}
+
+type exprParser struct {
+	lexer exprLexer
+	tok   exprToken
+	err   error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+	if p.err != nil {
+		p.tok = exprToken{kind: tokEOF, pos: p.lexer.pos}
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf(format+" at %d", append(args, p.tok.pos)...)
+}
+
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q", op)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left = binaryNode{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var right exprNode
+		if right, err = p.parseNot(); err == nil {
+			left = binaryNode{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseNot()
+		return unaryNode{op: "!", x: x}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	op := ""
+	switch {
+	case p.tok.kind == tokOp && comparisonOps[p.tok.text]:
+		op = p.tok.text
+	case p.tok.kind == tokIdent && p.tok.text == "in":
+		op = "in"
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("-") {
+		p.next()
+		x, err := p.parseUnary()
+		return unaryNode{op: "-", x: x}, err
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a primary expression followed by .key and [index] accessors
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.isOp("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("expected a key after \".\"")
+			}
+			node = indexNode{target: node, index: literalNode{value: p.tok.text}}
+			p.next()
+		case p.isOp("["):
+			p.next()
+			var index exprNode
+			if index, err = p.parseOr(); err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = indexNode{target: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokNumber || tok.kind == tokString:
+		p.next()
+		return literalNode{value: tok.value}, nil
+	case tok.kind == tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "null":
+			return literalNode{value: nil}, nil
+		}
+		if !p.isOp("(") {
+			return variableNode{name: tok.text}, nil
+		}
+		arity, ok := exprFunctions[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at %d", tok.text, tok.pos)
+		}
+		p.next()
+		args, err := p.parseList(")")
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != arity {
+			return nil, fmt.Errorf("%s takes %d argument(s), got %d at %d", tok.text, arity, len(args), tok.pos)
+		}
+		call := callNode{name: tok.text, args: args}
+		if call.name == "matches" {
+			// Patterns are compiled once here, so evaluating never compiles or caches a regular expression
+			literal, _ := args[1].(literalNode)
+			pattern, ok := literal.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches: the pattern must be a string literal at %d", tok.pos)
+			}
+			if call.re, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("matches: invalid pattern at %d: %w", tok.pos, err)
+			}
+		}
+		return call, nil
+	case p.isOp("("):
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.isOp("["):
+		p.next()
+		items, err := p.parseList("]")
+		return listNode{items: items}, err
+	case tok.kind == tokEOF:
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+// parseList parses comma separated expressions up to and including the closing operator
+func (p *exprParser) parseList(closing string) ([]exprNode, error) {
+	var items []exprNode
+	for !p.isOp(closing) {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return items, p.expect(closing)
+}
@@ -0,0 +1,244 @@
+package helper
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const exprTestEnv = `{
+	"address": "aws_s3_bucket.logs",
+	"change": {
+		"actions": ["update"],
+		"after": {"acl": "public-read", "versioning": [{"enabled": false}], "tags": {"Owner": "web", "cost-center": "42"}, "size": 10}
+	}
+}`
+
+// Expressions read paths, compare values and call functions, missing keys are null
+func TestExpressionEval(t *testing.T) {
+	var env map[string]any
+	if err := json.Unmarshal([]byte(exprTestEnv), &env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for source, want := range map[string]bool{
+		`change.after.acl == "public-read"`: true,
+		`change.after.acl != 'private' && !(change.after.tags.Owner in ["platform", "security"])`: true,
+		`change.after.versioning[0].enabled`:                                                      false,
+		`change.after.tags["cost-center"] == "42"`:                                                true,
+		`change.after.missing.deeper == null`:                                                     true,
+		`exists(change.after.missing)`:                                                            false,
+		`change.after.size >= 10 && change.after.size < 10.5`:                                     true,
+		`-change.after.size < 0`:                                                                  true,
+		`"update" in change.actions || contains(change.actions, "delete")`:                        true,
+		`len(change.after.tags) == 2 && len(change.before) == 0`:                                  true,
+		`startswith(address, "aws_s3") && endswith(lower(address), "logs")`:                       true,
+		`matches(address, "^aws_s3_bucket\\.(logs|state)$")`:                                      true,
+		`exists(change.after.missing) && change.after.missing > 1`:                                false,
+	} {
+		expr, err := CompileExpression(source)
+		if err != nil {
+			t.Fatalf("failed to compile %s: %v", source, err)
+		}
+		got, err := expr.EvalBool(env)
+		if err != nil {
+			t.Fatalf("failed to evaluate %s: %v", source, err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %t, got %t", source, want, got)
+		}
+	}
+}
+
+// Syntax errors are reported when compiling, type errors when evaluating
+func TestExpressionErrors(t *testing.T) {
+	for _, source := range []string{`change.after.acl ==`, `(a`, `a = b`, `nope(a)`, `len(a, b)`, `"unterminated`, `a b`} {
+		if _, err := CompileExpression(source); err == nil {
+			t.Errorf("expected %q not to compile", source)
+		}
+	}
+
+	env := map[string]any{"name": "web", "size": float64(3)}
+	for source, want := range map[string]string{
+		`name > 1`:     "cannot compare string > number",
+		`size && true`: "expected a boolean",
+		`unknown == 1`: "unknown variable",
+		`name`:         "expected a boolean",
+	} {
+		expr, err := CompileExpression(source)
+		if err != nil {
+			t.Fatalf("failed to compile %s: %v", source, err)
+		}
+		if _, err := expr.EvalBool(env); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", source, want, err)
+		}
+	}
+}
+
+const exprTypesEnv = `{
+	"name": "web",
+	"size": 3,
+	"enabled": true,
+	"list": ["a", "b"],
+	"tags": {"Owner": "web"}
+}`
+
+func evalExpression(t *testing.T, source string) (bool, error) {
+	t.Helper()
+	var env map[string]any
+	if err := json.Unmarshal([]byte(exprTypesEnv), &env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expr, err := CompileExpression(source)
+	if err != nil {
+		t.Fatalf("failed to compile %s: %v", source, err)
+	}
+	return expr.EvalBool(env)
+}
+
+// Operators bind from lowest to highest: ||, &&, !, comparisons and in, unary minus, then paths and calls
+func TestExpressionPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   bool
+	}{
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && true || true`, true},
+		{`false && (true || true)`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!!enabled`, true},
+		{`!size == 4`, true},
+		{`!name in list`, true},
+		{`-size < 0`, true},
+		{`-size == -3`, true},
+		{`- -size == size`, true},
+		{`"a" in list && "c" in list`, false},
+		{`"a" in list || "c" in list`, true},
+		{`list[0] == "a" && tags.Owner == name`, true},
+		{`upper(list[1]) == "B"`, true},
+	} {
+		got, err := evalExpression(t, tc.source)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.source, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %t, got %t", tc.source, tc.want, got)
+		}
+	}
+}
+
+// A missing attribute, key or index is null, which is false, empty and never matches
+func TestExpressionMissingAttributes(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   bool
+	}{
+		{`tags.missing == null`, true},
+		{`tags.missing.deeper[0].key == null`, true},
+		{`tags["missing"] == null`, true},
+		{`list[5] == null`, true},
+		{`list[-1] == null`, true},
+		{`exists(tags.missing)`, false},
+		{`exists(tags.Owner)`, true},
+		{`!tags.missing`, true},
+		{`tags.missing`, false},
+		{`len(tags.missing) == 0`, true},
+		{`contains(tags.missing, "a")`, false},
+		{`startswith(tags.missing, "a")`, false},
+		{`matches(tags.missing, ".*")`, false},
+		{`tags.missing in list`, false},
+		{`"Owner" in tags && !("Team" in tags)`, true},
+		{`exists(tags.missing) && tags.missing > 1`, false},
+		{`!exists(tags.missing) || tags.missing > 1`, true},
+	} {
+		got, err := evalExpression(t, tc.source)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.source, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %t, got %t", tc.source, tc.want, got)
+		}
+	}
+}
+
+// Operators and functions applied to the wrong types fail when evaluated
+func TestExpressionTypeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{`name > 1`, "cannot compare string > number"},
+		{`tags.missing > 1`, "cannot compare null > number"},
+		{`enabled < true`, "cannot compare bool < bool"},
+		{`list <= list`, "cannot compare list <= list"},
+		{`size && true`, "&&: expected a boolean, got number"},
+		{`false || name`, "||: expected a boolean, got string"},
+		{`!size`, "expected a boolean, got number"},
+		{`name`, "expected a boolean, got string"},
+		{`-name == 1`, "cannot negate string"},
+		{`name[0] == "w"`, "cannot index string"},
+		{`size.value == 1`, "cannot index number"},
+		{`tags[1] == null`, "map key must be a string, got number"},
+		{`list["a"] == null`, "list index must be an integer, got string"},
+		{`list[0.5] == null`, "list index must be an integer, got number"},
+		{`len(size) == 1`, "len: unsupported number"},
+		{`lower(size) == "3"`, "lower: expected a string, got number"},
+		{`startswith(name, 1)`, "startswith: expected strings, got string and number"},
+		{`matches(size, "3")`, "matches: expected strings, got number and string"},
+		{`1 in name`, "cannot look for number in a string"},
+		{`1 in size`, "cannot look into number"},
+		{`contains(tags, 1)`, "map key must be a string, got number"},
+		{`unknown == 1`, `unknown variable "unknown"`},
+	} {
+		if _, err := evalExpression(t, tc.source); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.source, tc.want, err)
+		}
+	}
+
+	// The right side of && and || is not evaluated when the left side decides the result
+	for _, source := range []string{`false && size`, `true || size`, `false && unknown`} {
+		if _, err := evalExpression(t, source); err != nil {
+			t.Errorf("%s: unexpected error: %v", source, err)
+		}
+	}
+}
+
+// Malformed expressions fail to compile with the position of the problem
+func TestExpressionMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{``, "unexpected end of expression at 0"},
+		{`!`, "unexpected end of expression at 1"},
+		{`()`, `unexpected ")" at 1`},
+		{`size > 2 == true`, `unexpected "==" at 9`},
+		{`a b`, `unexpected "b" at 2`},
+		{`a = b`, `unexpected character '=' at 2`},
+		{`a & b`, `unexpected character '&' at 2`},
+		{`a @ b`, `unexpected character '@' at 2`},
+		{`(a`, `expected ")" at 2`},
+		{`a[0`, `expected "]" at 3`},
+		{`[1, 2`, `expected "]" at 5`},
+		{`a.`, `expected a key after "." at 2`},
+		{`a.1`, `expected a key after "." at 2`},
+		{`1.2.3`, `invalid number "1.2.3" at 0`},
+		{`"unterminated`, "unterminated string at 0"},
+		{`'bad \q'`, "invalid string at 0"},
+		{`nope(a)`, `unknown function "nope" at 0`},
+		{`len(a, b)`, "len takes 1 argument(s), got 2 at 0"},
+		{`exists()`, "exists takes 1 argument(s), got 0 at 0"},
+		{`matches(name, pattern)`, "matches: the pattern must be a string literal at 0"},
+		{`matches(name, "web" + "x")`, `unexpected character '+' at 20`},
+		{`matches(name, "(")`, "matches: invalid pattern at 0"},
+	} {
+		_, err := CompileExpression(tc.source)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.source, tc.want, err)
+		}
+	}
+}
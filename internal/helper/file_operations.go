@@ -17,15 +17,34 @@ const (
 )
 
 // FileManager handles file operations for the run task
-type FileManager struct{}
+type FileManager struct {
+	redactor *Redactor
+}
 
 // NewFileManager creates a new FileManager instance
+// Everything it saves is redacted with the default sensitive fields
 func NewFileManager() *FileManager {
-	return &FileManager{}
+	return &FileManager{
+		redactor: NewRedactor(),
+	}
+}
+
+// WithRedactor sets the Redactor applied to everything the FileManager saves
+func (fm *FileManager) WithRedactor(redactor *Redactor) *FileManager {
+	if redactor != nil {
+		fm.redactor = redactor
+	}
+	return fm
 }
 
 // SaveStructToFile saves any struct to a file as JSON
+// Sensitive fields such as access tokens are masked with a stable fingerprint
 func (fm *FileManager) SaveStructToFile(outputDirectory string, filename string, s interface{}) error {
+	redacted, err := fm.redactor.Redact(s)
+	if err != nil {
+		return err
+	}
+
 	filePath := filepath.Join(outputDirectory, filename)
 	file, err := os.Create(filePath)
 	if err != nil {
@@ -35,7 +54,7 @@ func (fm *FileManager) SaveStructToFile(outputDirectory string, filename string,
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(s); err != nil {
+	if err := encoder.Encode(redacted); err != nil {
 		return fmt.Errorf("failed to encode struct to JSON: %w", err)
 	}
 	return nil
@@ -0,0 +1,136 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Defaults for following paginated list endpoints
+const (
+	// DefaultPageSize is the largest page the HCP Terraform API returns
+	DefaultPageSize = 100
+	DefaultMaxPages = 20
+)
+
+// ErrPartialResult is returned, together with the data that was fetched, when a list
+// has more pages than the client is allowed to follow
+var ErrPartialResult = errors.New("result is incomplete")
+
+// listEndpoints are the run sub-paths that return a paginated list
+var listEndpoints = map[string]bool{
+	"policy-checks": true,
+	"comments":      true,
+	"task-stages":   true,
+	"run-events":    true,
+}
+
+// listPage is a single page of a JSON:API list document
+type listPage struct {
+	Data     []json.RawMessage `json:"data"`
+	Included []json.RawMessage `json:"included,omitempty"`
+	Links    struct {
+		Next string `json:"next"`
+	} `json:"links"`
+	Meta struct {
+		Pagination json.RawMessage `json:"pagination,omitempty"`
+	} `json:"meta"`
+}
+
+// listResult is the merged document saved for a list endpoint
+// Meta describes the pages that were fetched, in addition to the pagination of the last page
+type listResult struct {
+	Data     []json.RawMessage `json:"data"`
+	Included []json.RawMessage `json:"included,omitempty"`
+	Meta     listResultMeta    `json:"meta"`
+}
+
+type listResultMeta struct {
+	Pagination   json.RawMessage `json:"pagination,omitempty"`
+	PagesFetched int             `json:"pages-fetched"`
+	PageSize     int             `json:"page-size"`
+	Truncated    bool            `json:"truncated"`
+}
+
+// WithPagination sets the page size requested from list endpoints and how many pages are followed
+func (c *Client) WithPagination(pageSize, maxPages int) *Client {
+	if pageSize > 0 {
+		c.pageSize = pageSize
+	}
+	if maxPages > 0 {
+		c.maxPages = maxPages
+	}
+	return c
+}
+
+// fetchAllPages follows links.next from the first page of a list endpoint and merges the pages
+// into a single document. Included resources are de-duplicated across pages.
+// If there are more pages than maxPages the merged document is returned with ErrPartialResult.
+func (c *Client) fetchAllPages(ctx context.Context, firstURL, token string) ([]byte, error) {
+	pageURL, err := url.Parse(firstURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	query := pageURL.Query()
+	query.Set("page[size]", strconv.Itoa(c.pageSize))
+	pageURL.RawQuery = query.Encode()
+
+	result := listResult{Data: []json.RawMessage{}, Meta: listResultMeta{PageSize: c.pageSize}}
+	seenIncluded := map[string]bool{}
+	next := pageURL.String()
+	for next != "" {
+		if result.Meta.PagesFetched == c.maxPages {
+			result.Meta.Truncated = true
+			break
+		}
+		// links.next comes from the response, it must pass the same checks as the first URL
+		if err := c.CheckURL(next); err != nil {
+			return nil, fmt.Errorf("refusing to follow next page: %w", err)
+		}
+
+		body, err := c.makeAPIRequest(ctx, "GET", next, token, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page %d: %w", result.Meta.PagesFetched+1, err)
+		}
+		var page listPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to decode page %d: %w", result.Meta.PagesFetched+1, err)
+		}
+
+		result.Data = append(result.Data, page.Data...)
+		for _, included := range page.Included {
+			var id struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+			}
+			_ = json.Unmarshal(included, &id)
+			if key := id.Type + "/" + id.ID; !seenIncluded[key] {
+				seenIncluded[key] = true
+				result.Included = append(result.Included, included)
+			}
+		}
+		result.Meta.Pagination = page.Meta.Pagination
+		result.Meta.PagesFetched++
+
+		next = ""
+		if page.Links.Next != "" {
+			nextURL, err := pageURL.Parse(page.Links.Next) // resolves relative links
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse next page link: %w", err)
+			}
+			next = nextURL.String()
+		}
+	}
+
+	merged, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged pages: %w", err)
+	}
+	if result.Meta.Truncated {
+		return merged, fmt.Errorf("%w: stopped after %d pages of %d", ErrPartialResult, c.maxPages, c.pageSize)
+	}
+	return merged, nil
+}
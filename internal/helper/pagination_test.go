@@ -0,0 +1,110 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// newPagedServer serves run events as pages of one event, total pages in all
+func newPagedServer(t *testing.T, total int) (*httptest.Server, *Client, api.TaskRequest) {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/runs/run-123/run-events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("page[size]") != "1" {
+			t.Errorf("expected page size 1, got %q", r.URL.Query().Get("page[size]"))
+		}
+		number, _ := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if number == 0 {
+			number = 1
+		}
+		next := ""
+		if number < total {
+			next = fmt.Sprintf("%s/api/v2/runs/run-123/run-events?page%%5Bnumber%%5D=%d&page%%5Bsize%%5D=1", srv.URL, number+1)
+		}
+		_, _ = fmt.Fprintf(w, `{
+			"data": [{"id": "re-%d", "type": "run-events", "attributes": {"action": "queued"}}],
+			"included": [{"id": "user-1", "type": "users", "attributes": {}}],
+			"links": {"next": %q},
+			"meta": {"pagination": {"current-page": %d, "total-pages": %d, "total-count": %d}}
+		}`, number, next, number, total, total)
+	}))
+	t.Setenv("TERRAFORM_API_TOKEN", "token")
+
+	serverURL, _ := url.Parse(srv.URL)
+	client := NewClient().
+		WithURLPolicy(NewURLPolicy(serverURL.Host).AllowScheme("http")).
+		WithPagination(1, 5)
+	request := api.TaskRequest{RunID: "run-123", TaskResultCallbackURL: srv.URL + "/api/v2/task-results/tr-1/callback"}
+	return srv, client, request
+}
+
+// Every page is merged into the artifact together with the page metadata
+func TestGetDataFromAPIFollowsPages(t *testing.T) {
+	srv, client, request := newPagedServer(t, 3)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := client.GetDataFromAPI(context.Background(), dir, "run-events", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "run-events_api.json"))
+	if err != nil {
+		t.Fatalf("failed to read artifact: %v", err)
+	}
+	var saved listResult
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("failed to decode artifact: %v", err)
+	}
+	if len(saved.Data) != 3 || saved.Meta.PagesFetched != 3 || saved.Meta.Truncated {
+		t.Fatalf("unexpected merged result: %d items, meta %+v", len(saved.Data), saved.Meta)
+	}
+	if len(saved.Included) != 1 {
+		t.Fatalf("expected included resources to be de-duplicated, got %d", len(saved.Included))
+	}
+
+	events, err := client.ListRunEvents(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events.Data) != 3 || events.Data[2].ID != "re-3" {
+		t.Fatalf("unexpected events: %+v", events.Data)
+	}
+}
+
+// Lists longer than the page limit are saved and reported as partial instead of silently truncated
+func TestGetDataFromAPIReportsPartialResult(t *testing.T) {
+	srv, client, request := newPagedServer(t, 8)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	err := client.GetDataFromAPI(context.Background(), dir, "run-events", request)
+	if !errors.Is(err, ErrPartialResult) {
+		t.Fatalf("expected a partial result error, got %v", err)
+	}
+
+	data, readErr := os.ReadFile(filepath.Join(dir, "run-events_api.json"))
+	if readErr != nil {
+		t.Fatalf("expected the fetched pages to be saved: %v", readErr)
+	}
+	var saved listResult
+	_ = json.Unmarshal(data, &saved)
+	if len(saved.Data) != 5 || !saved.Meta.Truncated {
+		t.Fatalf("unexpected partial result: %d items, meta %+v", len(saved.Data), saved.Meta)
+	}
+}
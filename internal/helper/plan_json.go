@@ -0,0 +1,342 @@
+package helper
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// DefaultMaxPlanJSONSize is the largest plan JSON downloaded, 1 GiB
+const DefaultMaxPlanJSONSize int64 = 1 << 30
+
+// ErrArtifactTooLarge is returned when a download is larger than the configured size cap
+var ErrArtifactTooLarge = errors.New("artifact exceeds the size limit")
+
+// PlanJSONOptions configures how the plan JSON is saved
+type PlanJSONOptions struct {
+	// MaxSize is the largest plan JSON downloaded in bytes, zero or less uses DefaultMaxPlanJSONSize
+	MaxSize int64
+	// Indent re-indents the plan JSON while it is written, otherwise it is saved as sent
+	Indent bool
+}
+
+// DefaultPlanJSONOptions returns the PlanJSONOptions used until WithPlanJSONOptions is called
+func DefaultPlanJSONOptions() PlanJSONOptions {
+	return PlanJSONOptions{MaxSize: DefaultMaxPlanJSONSize, Indent: true}
+}
+
+// WithPlanJSONOptions sets the size cap and indentation of the plan JSON download
+func (c *Client) WithPlanJSONOptions(options PlanJSONOptions) *Client {
+	if options.MaxSize <= 0 {
+		options.MaxSize = DefaultMaxPlanJSONSize
+	}
+	c.planJSON = options
+	return c
+}
+
+// Artifact describes a file written by a streaming download
+type Artifact struct {
+	Path string
+	// Size is the number of bytes written to Path
+	Size int64
+	// SHA256 is the hex encoded checksum of the file, also written to Path + ".sha256"
+	SHA256 string
+}
+
+// DownloadPlanJson streams the plan JSON to disk, the plan is never held in memory
+// The download is aborted with ErrArtifactTooLarge once it exceeds the size cap
+func (c *Client) DownloadPlanJson(ctx context.Context, outputDirectory string, request api.TaskRequest) (*Artifact, error) {
+	filePath := filepath.Join(outputDirectory, "plan_json.json")
+
+	if err := c.CheckURL(request.PlanJSONAPIURL); err != nil {
+		return nil, fmt.Errorf("failed to download plan JSON: %w", err)
+	}
+
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		return c.newRequest(ctx, "GET", request.PlanJSONAPIURL, request.AccessToken, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download plan JSON: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download plan JSON: %w", &StatusError{StatusCode: resp.StatusCode})
+	}
+	if resp.ContentLength > c.planJSON.MaxSize {
+		return nil, fmt.Errorf("failed to download plan JSON: %w (%d bytes, limit %d)", ErrArtifactTooLarge, resp.ContentLength, c.planJSON.MaxSize)
+	}
+
+	artifact, err := writeArtifact(resp.Body, filePath, c.planJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download plan JSON: %w", err)
+	}
+	return artifact, nil
+}
+
+// writeArtifact streams r into a temporary file next to filePath and renames it once complete,
+// so a failed or oversized download never leaves a truncated artifact behind
+func writeArtifact(r io.Reader, filePath string, options PlanJSONOptions) (*Artifact, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	checksum := sha256.New()
+	counter := &countingWriter{}
+	out := bufio.NewWriter(io.MultiWriter(tmp, checksum, counter))
+
+	var dst io.Writer = out
+	var indenter *indentWriter
+	if options.Indent {
+		indenter = newIndentWriter(out, "  ")
+		dst = indenter
+	}
+
+	// Read one byte past the cap to tell a plan of exactly MaxSize bytes from a larger one
+	read, err := io.Copy(dst, io.LimitReader(r, options.MaxSize+1))
+	if err == nil && read > options.MaxSize {
+		err = fmt.Errorf("%w (limit %d bytes)", ErrArtifactTooLarge, options.MaxSize)
+	}
+	if err == nil && indenter != nil {
+		err = indenter.Close()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	artifact := &Artifact{Path: filePath, Size: counter.n, SHA256: hex.EncodeToString(checksum.Sum(nil))}
+	if err := writeChecksum(artifact); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+// writeChecksum writes the checksum next to the artifact in the format sha256sum -c reads
+func writeChecksum(artifact *Artifact) error {
+	line := fmt.Sprintf("%s  %s\n", artifact.SHA256, filepath.Base(artifact.Path))
+	if err := os.WriteFile(artifact.Path+".sha256", []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write checksum: %w", err)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// indentWriter re-indents a JSON stream as it is written, producing the same output as json.Indent
+// without holding the document in memory. It does not validate the JSON beyond balancing brackets.
+type indentWriter struct {
+	out    *bufio.Writer
+	indent string
+	depth  int
+	// opened is set after { or [ until the next token, so empty objects and arrays stay on one line
+	opened   bool
+	inString bool
+	escaped  bool
+	err      error
+}
+
+func newIndentWriter(out *bufio.Writer, indent string) *indentWriter {
+	return &indentWriter{out: out, indent: indent}
+}
+
+func (w *indentWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if w.err != nil {
+			return 0, w.err
+		}
+		if w.inString {
+			w.writeByte(b)
+			switch {
+			case w.escaped:
+				w.escaped = false
+			case b == '\\':
+				w.escaped = true
+			case b == '"':
+				w.inString = false
+			}
+			continue
+		}
+
+		switch b {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		if w.opened {
+			w.opened = false
+			if b == '}' || b == ']' {
+				w.depth--
+				w.writeByte(b)
+				continue
+			}
+			w.newline()
+		}
+
+		switch b {
+		case '{', '[':
+			w.writeByte(b)
+			w.depth++
+			w.opened = true
+		case '}', ']':
+			w.depth--
+			if w.depth < 0 {
+				w.err = errors.New("invalid JSON: unbalanced brackets")
+				return 0, w.err
+			}
+			w.newline()
+			w.writeByte(b)
+		case ',':
+			w.writeByte(b)
+			w.newline()
+		case ':':
+			w.writeByte(b)
+			w.writeByte(' ')
+		case '"':
+			w.inString = true
+			w.writeByte(b)
+		default:
+			w.writeByte(b)
+		}
+	}
+	return len(p), w.err
+}
+
+// Close reports a document that ended inside a string or an unclosed object or array
+func (w *indentWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.inString || w.depth != 0 || w.opened {
+		return errors.New("invalid JSON: unexpected end of document")
+	}
+	return nil
+}
+
+func (w *indentWriter) writeByte(b byte) {
+	if w.err == nil {
+		w.err = w.out.WriteByte(b)
+	}
+}
+
+func (w *indentWriter) newline() {
+	w.writeByte('\n')
+	for i := 0; i < w.depth; i++ {
+		for j := 0; j < len(w.indent); j++ {
+			w.writeByte(w.indent[j])
+		}
+	}
+}
+
+// DecodeResourceChanges streams the resource_changes of a plan JSON document, calling fn for each
+// change in order. Only one change is held in memory at a time, and the rest of the plan
+// (planned_values, prior_state, configuration, ...) is skipped token by token.
+// Decode into json.RawMessage to keep the change as is. An error from fn stops the decoding and is returned.
+func DecodeResourceChanges[T any](r io.Reader, fn func(T) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read plan JSON: %w", err)
+		}
+		if key != "resource_changes" {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read resource_changes: %w", err)
+		}
+		if tok == nil {
+			return nil
+		}
+		if tok != json.Delim('[') {
+			return fmt.Errorf("failed to read resource_changes: expected an array, got %v", tok)
+		}
+		for dec.More() {
+			var change T
+			if err := dec.Decode(&change); err != nil {
+				return fmt.Errorf("failed to decode resource change: %w", err)
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		// Nothing after resource_changes is needed
+		return nil
+	}
+	return nil
+}
+
+// DecodeResourceChangesFile opens a saved plan JSON and streams its resource_changes, see DecodeResourceChanges
+func DecodeResourceChangesFile[T any](path string, fn func(T) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open plan JSON: %w", err)
+	}
+	defer f.Close()
+	return DecodeResourceChanges(bufio.NewReader(f), fn)
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read plan JSON: %w", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("failed to read plan JSON: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// skipValue consumes the next value without decoding it, so large values are never held in memory
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read plan JSON: %w", err)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
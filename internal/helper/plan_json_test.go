@@ -0,0 +1,162 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+const testPlanJSON = `{"format_version":"1.2","planned_values":{"root_module":{"resources":[{"address":"null_resource.a","values":{}}]}},
+	"resource_changes":[
+		{"address":"null_resource.a","change":{"actions":["create"],"after":{"triggers":{"key":"va\"l]ue"}}}},
+		{"address":"null_resource.b","change":{"actions":["delete"],"before":{}}}
+	],
+	"configuration":{"root_module":{}},"empty":[]}`
+
+// newPlanJSONServer serves body as the plan JSON of run-123
+func newPlanJSONServer(t *testing.T, body string) (*httptest.Server, *Client, api.TaskRequest) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	serverURL, _ := url.Parse(srv.URL)
+	client := NewClient().WithURLPolicy(NewURLPolicy(serverURL.Host).AllowScheme("http"))
+	request := api.TaskRequest{PlanJSONAPIURL: srv.URL + "/api/v2/plans/plan-1/json-output"}
+	return srv, client, request
+}
+
+// The streaming indenter produces the same output as json.Indent, however the input is split
+func TestIndentWriterMatchesJSONIndent(t *testing.T) {
+	var want bytes.Buffer
+	if err := json.Indent(&want, []byte(testPlanJSON), "", "  "); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, chunk := range []int{1, 7, len(testPlanJSON)} {
+		var got bytes.Buffer
+		out := bufio.NewWriter(&got)
+		w := newIndentWriter(out, "  ")
+		for i := 0; i < len(testPlanJSON); i += chunk {
+			if _, err := w.Write([]byte(testPlanJSON[i:min(i+chunk, len(testPlanJSON))])); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_ = out.Flush()
+		if got.String() != want.String() {
+			t.Fatalf("chunk size %d: expected\n%s\ngot\n%s", chunk, want.String(), got.String())
+		}
+	}
+}
+
+// The plan JSON is saved with a checksum file that matches its content
+func TestDownloadPlanJsonWritesChecksum(t *testing.T) {
+	srv, client, request := newPlanJSONServer(t, testPlanJSON)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	artifact, err := client.DownloadPlanJson(context.Background(), dir, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "plan_json.json"))
+	if err != nil {
+		t.Fatalf("failed to read artifact: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if artifact.SHA256 != hex.EncodeToString(sum[:]) || artifact.Size != int64(len(data)) {
+		t.Fatalf("artifact %+v does not match the saved file", artifact)
+	}
+	if !strings.Contains(string(data), "\n  \"resource_changes\": [") {
+		t.Fatalf("expected the plan JSON to be indented, got %s", data)
+	}
+
+	checksum, err := os.ReadFile(filepath.Join(dir, "plan_json.json.sha256"))
+	if err != nil {
+		t.Fatalf("failed to read checksum: %v", err)
+	}
+	if string(checksum) != artifact.SHA256+"  plan_json.json\n" {
+		t.Fatalf("unexpected checksum file: %q", checksum)
+	}
+}
+
+// Plans over the size cap fail without leaving a truncated artifact
+func TestDownloadPlanJsonSizeCap(t *testing.T) {
+	srv, client, request := newPlanJSONServer(t, testPlanJSON)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	client.WithPlanJSONOptions(PlanJSONOptions{MaxSize: int64(len(testPlanJSON) - 1)})
+	if _, err := client.DownloadPlanJson(context.Background(), dir, request); !errors.Is(err, ErrArtifactTooLarge) {
+		t.Fatalf("expected a size limit error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no files to be left behind, got %v", entries)
+	}
+
+	// Exactly at the cap is allowed, and without indentation the plan is saved as sent
+	client.WithPlanJSONOptions(PlanJSONOptions{MaxSize: int64(len(testPlanJSON))})
+	artifact, err := client.DownloadPlanJson(context.Background(), dir, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if artifact.Size != int64(len(testPlanJSON)) {
+		t.Fatalf("expected the plan to be saved unchanged, got %d bytes", artifact.Size)
+	}
+}
+
+// Resource changes are streamed in order, an error from the callback stops decoding
+func TestDecodeResourceChanges(t *testing.T) {
+	type change struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	}
+
+	var addresses []string
+	err := DecodeResourceChanges(strings.NewReader(testPlanJSON), func(c change) error {
+		addresses = append(addresses, c.Address+":"+strings.Join(c.Change.Actions, ","))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(addresses, " ") != "null_resource.a:create null_resource.b:delete" {
+		t.Fatalf("unexpected changes: %v", addresses)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = DecodeResourceChanges(strings.NewReader(testPlanJSON), func(json.RawMessage) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("expected decoding to stop after the first change, got %v after %d calls", err, calls)
+	}
+
+	// Plans without changes omit resource_changes
+	if err := DecodeResourceChanges(strings.NewReader(`{"format_version":"1.2"}`), func(json.RawMessage) error {
+		t.Fatalf("unexpected change")
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DefaultSensitiveFields are the JSON field names that are always masked when saving files
+var DefaultSensitiveFields = []string{
+	"access_token",
+	"token",
+	"authorization",
+	"password",
+	"secret",
+}
+
+// Redactor masks sensitive JSON fields before they are written to disk
+// Each value is replaced by a stable fingerprint, so the same token shows up as the same
+// fingerprint across captures without revealing the token itself
+type Redactor struct {
+	fields map[string]bool
+}
+
+// NewRedactor creates a Redactor for the default sensitive fields plus any extra field names
+// Field names are matched case-insensitively at any depth of the document
+func NewRedactor(extraFields ...string) *Redactor {
+	r := &Redactor{fields: map[string]bool{}}
+	for _, field := range append(DefaultSensitiveFields, extraFields...) {
+		if field = strings.TrimSpace(field); field != "" {
+			r.fields[strings.ToLower(field)] = true
+		}
+	}
+	return r
+}
+
+// Fingerprint returns the masked form of a sensitive value
+func (r *Redactor) Fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "[REDACTED sha256:" + hex.EncodeToString(sum[:])[:12] + "]"
+}
+
+// Redact returns the JSON encoding of s with every sensitive field masked
+// Field order is kept as-is so redacted captures read the same as the original
+func (r *Redactor) Redact(s interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode struct to JSON: %w", err)
+	}
+
+	redacted, err := r.redactJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact JSON: %w", err)
+	}
+	return redacted, nil
+}
+
+// redactJSON walks objects and arrays, replacing the string value of any sensitive field
+func (r *Redactor) redactJSON(data json.RawMessage) (json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return data, nil
+	}
+
+	switch trimmed[0] {
+	case '{':
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		if _, err := decoder.Token(); err != nil { // opening brace
+			return nil, err
+		}
+
+		var out bytes.Buffer
+		out.WriteByte('{')
+		for i := 0; decoder.More(); i++ {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := keyToken.(string)
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, err
+			}
+
+			var str string
+			if r.fields[strings.ToLower(key)] && json.Unmarshal(value, &str) == nil && str != "" {
+				value, _ = json.Marshal(r.Fingerprint(str))
+			} else if value, err = r.redactJSON(value); err != nil {
+				return nil, err
+			}
+
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			encodedKey, _ := json.Marshal(key)
+			out.Write(encodedKey)
+			out.WriteByte(':')
+			out.Write(value)
+		}
+		out.WriteByte('}')
+		return out.Bytes(), nil
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			redacted, err := r.redactJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = redacted
+		}
+		return json.Marshal(items)
+	default:
+		return trimmed, nil
+	}
+}
@@ -0,0 +1,69 @@
+package helper
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// The access token never reaches disk and the fingerprint is stable across saves
+func TestSaveStructToFileRedactsAccessToken(t *testing.T) {
+	dir := t.TempDir()
+	request := api.TaskRequest{AccessToken: "super-secret-token", RunID: "run-123"}
+
+	fm := NewFileManager()
+	if err := fm.SaveStructToFile(dir, "request.json", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "super-secret-token") {
+		t.Fatalf("access token was written to disk: %s", data)
+	}
+
+	var saved api.TaskRequest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if saved.RunID != "run-123" {
+		t.Fatalf("expected other fields to be kept, got %+v", saved)
+	}
+	if want := NewRedactor().Fingerprint("super-secret-token"); saved.AccessToken != want {
+		t.Fatalf("expected fingerprint %q, got %q", want, saved.AccessToken)
+	}
+
+	// Field order is kept so captures stay readable
+	if strings.Index(string(data), `"access_token"`) > strings.Index(string(data), `"run_id"`) {
+		t.Fatalf("expected the original field order to be kept: %s", data)
+	}
+}
+
+// Extra fields are matched case-insensitively at any depth, empty values are left alone
+func TestRedactorExtraFields(t *testing.T) {
+	r := NewRedactor("vcs_commit_url")
+	doc := map[string]interface{}{
+		"outer": []interface{}{
+			map[string]interface{}{"VCS_COMMIT_URL": "https://example.com/commit", "keep": "me"},
+		},
+		"token": "",
+	}
+
+	redacted, err := r.Redact(doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := string(redacted)
+	if strings.Contains(out, "https://example.com/commit") {
+		t.Fatalf("expected nested extra field to be redacted: %s", out)
+	}
+	if !strings.Contains(out, `"keep":"me"`) || !strings.Contains(out, `"token":""`) {
+		t.Fatalf("expected other values to be kept: %s", out)
+	}
+}
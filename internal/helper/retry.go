@@ -0,0 +1,217 @@
+package helper
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for retrying HCP Terraform API requests
+const (
+	DefaultMaxRetries     = 3
+	DefaultRetryBaseDelay = 1 * time.Second
+	DefaultRetryMaxDelay  = 30 * time.Second
+	// DefaultRateLimit stays under the HCP Terraform API limit of 30 requests per second per token
+	DefaultRateLimit = 25
+)
+
+// RetryPolicy decides how often a request is retried after a 429 or 5xx response
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used until WithRetryPolicy is called
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: DefaultMaxRetries,
+		BaseDelay:  DefaultRetryBaseDelay,
+		MaxDelay:   DefaultRetryMaxDelay,
+	}
+}
+
+// shouldRetry reports whether the status code is worth retrying
+func (p RetryPolicy) shouldRetry(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// delay returns how long to wait before the retry, preferring what the server asked for
+// Retry-After is used first, then X-RateLimit-Reset, then exponential backoff with jitter
+func (p RetryPolicy) delay(attempt int, header http.Header) time.Duration {
+	if wait, ok := retryAfter(header); ok {
+		return min(wait, p.MaxDelay)
+	}
+	if wait, ok := rateLimitReset(header); ok && header.Get("X-RateLimit-Remaining") == "0" {
+		return min(wait, p.MaxDelay)
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	// Full jitter keeps concurrent runs from retrying in lockstep
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryAfter parses the Retry-After header, either delay-seconds or an HTTP date
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// rateLimitReset parses X-RateLimit-Reset, the (fractional) seconds until the limit resets
+func rateLimitReset(header http.Header) (time.Duration, bool) {
+	value := header.Get("X-RateLimit-Reset")
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// RateLimiter paces requests per host and is shared by every run, so a busy workspace
+// cannot use up the API rate limit while others wait
+// Requests get a slot in the order they ask for one, and when HCP Terraform reports the limit
+// is exhausted every request to that host waits until it resets
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	hosts    map[string]*hostLimit
+}
+
+type hostLimit struct {
+	next         time.Time
+	blockedUntil time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing requestsPerSecond to each host
+// Zero or less disables pacing, the X-RateLimit-* and Retry-After headers are still honoured
+func NewRateLimiter(requestsPerSecond float64) *RateLimiter {
+	l := &RateLimiter{hosts: map[string]*hostLimit{}}
+	if requestsPerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return l
+}
+
+// Wait blocks until the next request to the host may be sent, or the context is done
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	h := l.host(host)
+	now := time.Now()
+	slot := now
+	if h.next.After(slot) {
+		slot = h.next
+	}
+	if h.blockedUntil.After(slot) {
+		slot = h.blockedUntil
+	}
+	h.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	wait := time.Until(slot)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Observe pauses every request to the host when the response says the rate limit is exhausted
+func (l *RateLimiter) Observe(host string, resp *http.Response) {
+	var until time.Time
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if wait, ok := retryAfter(resp.Header); ok {
+			until = time.Now().Add(wait)
+		}
+	}
+	if until.IsZero() && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if wait, ok := rateLimitReset(resp.Header); ok {
+			until = time.Now().Add(wait)
+		}
+	}
+	if until.IsZero() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h := l.host(host); until.After(h.blockedUntil) {
+		h.blockedUntil = until
+	}
+}
+
+func (l *RateLimiter) host(host string) *hostLimit {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// RequestStats records the retries made and the token class used for the requests sent with a
+// context from WithRequestStats
+type RequestStats struct {
+	retries    atomic.Int32
+	mu         sync.Mutex
+	tokenClass TokenClass
+}
+
+// Retries returns the number of retries made so far
+func (s *RequestStats) Retries() int {
+	return int(s.retries.Load())
+}
+
+// TokenClass returns the class of the token used for the last API request, empty if no token was needed
+func (s *RequestStats) TokenClass() TokenClass {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenClass
+}
+
+type requestStatsKey struct{}
+
+// WithRequestStats returns a context that records retries and token classes into stats
+// Use it to report how often a download had to be retried and which token it needed
+func WithRequestStats(ctx context.Context, stats *RequestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, stats)
+}
+
+func recordRetry(ctx context.Context) {
+	if stats, ok := ctx.Value(requestStatsKey{}).(*RequestStats); ok {
+		stats.retries.Add(1)
+	}
+}
+
+func recordTokenClass(ctx context.Context, class TokenClass) {
+	if stats, ok := ctx.Value(requestStatsKey{}).(*RequestStats); ok {
+		stats.mu.Lock()
+		stats.tokenClass = class
+		stats.mu.Unlock()
+	}
+}
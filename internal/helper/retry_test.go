@@ -0,0 +1,104 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRetryTestClient() *Client {
+	return NewClient().
+		WithRetryPolicy(RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}).
+		WithRateLimiter(NewRateLimiter(0))
+}
+
+// A 429 is retried after Retry-After and the retry is counted
+func TestClientRetriesRateLimitedRequests(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {}}`))
+	}))
+	defer srv.Close()
+
+	var stats RequestStats
+	ctx := WithRequestStats(context.Background(), &stats)
+	if _, err := newRetryTestClient().makeAPIRequest(ctx, http.MethodGet, srv.URL, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Retries() != 1 || calls.Load() != 2 {
+		t.Fatalf("expected 1 retry and 2 calls, got %d retries and %d calls", stats.Retries(), calls.Load())
+	}
+}
+
+// Server errors are retried up to MaxRetries, client errors are not retried
+func TestClientRetryLimits(t *testing.T) {
+	var calls atomic.Int32
+	status := http.StatusBadGateway
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	client := newRetryTestClient()
+	if _, err := client.makeAPIRequest(context.Background(), http.MethodGet, srv.URL, "", nil); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	status = http.StatusNotFound
+	if _, err := client.makeAPIRequest(context.Background(), http.MethodGet, srv.URL, "", nil); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected 1 call, got %d", calls.Load())
+	}
+}
+
+// An exhausted rate limit pauses every request to the host until it resets
+func TestRateLimiterObservesExhaustedLimit(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("X-RateLimit-Remaining", "0")
+	resp.Header.Set("X-RateLimit-Reset", "0.1")
+	limiter.Observe("app.terraform.io", resp)
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), "app.terraform.io"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if waited := time.Since(start); waited < 80*time.Millisecond {
+		t.Fatalf("expected to wait for the reset, waited %s", waited)
+	}
+
+	// Other hosts are not affected
+	start = time.Now()
+	_ = limiter.Wait(context.Background(), "archivist.terraform.io")
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Fatalf("expected no wait for another host, waited %s", waited)
+	}
+}
+
+func TestRetryAfterParsing(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "2")
+	if wait, ok := retryAfter(header); !ok || wait != 2*time.Second {
+		t.Fatalf("unexpected Retry-After delay %s", wait)
+	}
+
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait, ok := retryAfter(header); !ok || wait < 58*time.Second {
+		t.Fatalf("unexpected Retry-After date delay %s", wait)
+	}
+}
@@ -0,0 +1,124 @@
+package helper
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+// TokenClass says which kind of token was used for a request, from least to most privileged
+type TokenClass string
+
+const (
+	// TokenRunScoped is the access token HCP Terraform sends with the task request, it expires with the run
+	TokenRunScoped TokenClass = "run-scoped"
+	// TokenOrganization is the token configured for the organization of the run
+	TokenOrganization TokenClass = "organization"
+	// TokenHost is the token configured for the HCP Terraform/TFE hostname
+	TokenHost TokenClass = "host"
+	// TokenDefault is the permissive TERRAFORM_API_TOKEN
+	TokenDefault TokenClass = "default"
+)
+
+// Token is a candidate token for an API request
+type Token struct {
+	Value string
+	Class TokenClass
+}
+
+// isAccessDenied reports whether the error means the token cannot read the endpoint
+// A 404 is a real error, so a missing resource or a wrong URL is never sent to the more privileged tokens
+func isAccessDenied(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// TokenResolver picks the tokens to try for an API request, least privileged first
+// The run-scoped token from the request is tried first, then the organization and host tokens
+// from the TokenMap, then the default permissive token. When an endpoint needed a more privileged
+// token, later requests of the same organization for that endpoint on the same host start from that token.
+type TokenResolver struct {
+	secrets handler.SecretProvider
+	tokens  handler.TokenMap
+
+	mu       sync.Mutex
+	required map[endpointKey]TokenClass // least privileged class that worked
+}
+
+// endpointKey identifies an endpoint of one organization on one host
+type endpointKey struct {
+	organization, host, endpoint string
+}
+
+// NewTokenResolver creates a TokenResolver reading the mapped and default tokens from secrets
+func NewTokenResolver(secrets handler.SecretProvider, tokens handler.TokenMap) *TokenResolver {
+	return &TokenResolver{secrets: secrets, tokens: tokens, required: map[endpointKey]TokenClass{}}
+}
+
+// Candidates returns the tokens to try for the endpoint, in the order they should be tried
+func (r *TokenResolver) Candidates(request api.TaskRequest, host, endpoint string) []Token {
+	var candidates []Token
+	add := func(value string, class TokenClass) {
+		for _, c := range candidates {
+			if c.Value == value {
+				return // the same token configured twice is only tried once
+			}
+		}
+		if value != "" {
+			candidates = append(candidates, Token{Value: value, Class: class})
+		}
+	}
+
+	add(request.AccessToken, TokenRunScoped)
+	if name, ok := r.tokens.Organizations[request.OrganizationName]; ok {
+		add(r.secret(name), TokenOrganization)
+	}
+	if name, ok := r.tokens.Hosts[strings.ToLower(host)]; ok {
+		add(r.secret(name), TokenHost)
+	}
+	add(r.secret(handler.SecretAPIToken), TokenDefault)
+
+	// Skip the tokens that were not enough for this endpoint before
+	r.mu.Lock()
+	required, ok := r.required[endpointKey{request.OrganizationName, host, endpoint}]
+	r.mu.Unlock()
+	if ok {
+		for i, c := range candidates {
+			if c.Class == required {
+				return candidates[i:]
+			}
+		}
+	}
+	return candidates
+}
+
+// Remember records the class of token that worked for the endpoint, for the organization of the request
+func (r *TokenResolver) Remember(request api.TaskRequest, host, endpoint string, class TokenClass) {
+	key := endpointKey{request.OrganizationName, host, endpoint}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if class == TokenRunScoped {
+		delete(r.required, key)
+		return
+	}
+	r.required[key] = class
+}
+
+func (r *TokenResolver) secret(name string) string {
+	value, err := r.secrets.Secret(name)
+	if err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,157 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+type mapSecrets map[string]string
+
+func (m mapSecrets) Secret(name string) (string, error) {
+	if value, ok := m[name]; ok {
+		return value, nil
+	}
+	return "", handler.ErrSecretNotFound
+}
+
+// Tokens are tried from least to most privileged
+func TestTokenResolverCandidates(t *testing.T) {
+	resolver := NewTokenResolver(mapSecrets{
+		handler.SecretAPIToken: "default-token",
+		"ORG_TOKEN":            "org-token",
+		"HOST_TOKEN":           "host-token",
+	}, handler.TokenMap{
+		Hosts:         map[string]string{"tfe.example.com": "HOST_TOKEN"},
+		Organizations: map[string]string{"my-org": "ORG_TOKEN"},
+	})
+
+	request := api.TaskRequest{AccessToken: "run-token", OrganizationName: "my-org"}
+	candidates := resolver.Candidates(request, "tfe.example.com", "comments")
+	want := []TokenClass{TokenRunScoped, TokenOrganization, TokenHost, TokenDefault}
+	if len(candidates) != len(want) {
+		t.Fatalf("expected %d candidates, got %+v", len(want), candidates)
+	}
+	for i, class := range want {
+		if candidates[i].Class != class {
+			t.Fatalf("expected candidate %d to be %s, got %s", i, class, candidates[i].Class)
+		}
+	}
+
+	// Mapped tokens only apply to their host and organization
+	other := resolver.Candidates(api.TaskRequest{AccessToken: "run-token", OrganizationName: "other-org"}, "app.terraform.io", "comments")
+	if len(other) != 2 || other[1].Class != TokenDefault {
+		t.Fatalf("unexpected candidates for another org and host: %+v", other)
+	}
+}
+
+// The run-scoped token is used when it can read the endpoint, the permissive token only when it is denied
+func TestClientEscalatesTokens(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		seen = append(seen, r.URL.Path+" "+auth)
+		mu.Unlock()
+		// The run-scoped token can read the run, but not the comments
+		if r.URL.Path == "/api/v2/runs/run-123/comments" && auth != "Bearer default-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/api/v2/runs/run-123/run-events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": []}`))
+	}))
+	defer srv.Close()
+
+	serverURL, _ := url.Parse(srv.URL)
+	client := NewClient().
+		WithURLPolicy(NewURLPolicy(serverURL.Host).AllowScheme("http")).
+		WithSecrets(mapSecrets{handler.SecretAPIToken: "default-token"})
+	request := api.TaskRequest{RunID: "run-123", AccessToken: "run-token", OrganizationName: "org-a", TaskResultCallbackURL: srv.URL + "/api/v2/task-results/tr-1/callback"}
+
+	var runStats RequestStats
+	if _, err := client.fetchRunData(WithRequestStats(context.Background(), &runStats), request, "run"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if runStats.TokenClass() != TokenRunScoped {
+		t.Fatalf("expected the run to be read with the run-scoped token, got %s", runStats.TokenClass())
+	}
+
+	var commentStats RequestStats
+	if err := client.GetDataFromAPI(WithRequestStats(context.Background(), &commentStats), t.TempDir(), "comments", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commentStats.TokenClass() != TokenDefault {
+		t.Fatalf("expected the comments to need the default token, got %s", commentStats.TokenClass())
+	}
+
+	// The next run starts with the token the comments needed
+	mu.Lock()
+	seen = nil
+	mu.Unlock()
+	if err := client.GetDataFromAPI(context.Background(), t.TempDir(), "comments", request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(seen) != 1 {
+		t.Fatalf("expected a single request with the remembered token, got %v", seen)
+	}
+
+	// Another organization still starts with its run-scoped token
+	mu.Lock()
+	seen = nil
+	mu.Unlock()
+	other := request
+	other.OrganizationName = "org-b"
+	if err := client.GetDataFromAPI(context.Background(), t.TempDir(), "comments", other); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(seen) != 2 || seen[0] != "/api/v2/runs/run-123/comments Bearer run-token" {
+		t.Fatalf("expected the other organization to try the run-scoped token first, got %v", seen)
+	}
+
+	// A missing resource is an error, it is not retried with the more privileged tokens
+	mu.Lock()
+	seen = nil
+	mu.Unlock()
+	if err := client.GetDataFromAPI(context.Background(), t.TempDir(), "run-events", request); err == nil {
+		t.Fatalf("expected an error for a missing resource")
+	}
+	if len(seen) != 1 || seen[0] != "/api/v2/runs/run-123/run-events Bearer run-token" {
+		t.Fatalf("expected a single request with the run-scoped token, got %v", seen)
+	}
+}
+
+// The escalation of one organization, host and endpoint does not carry over to another
+func TestTokenResolverRemember(t *testing.T) {
+	resolver := NewTokenResolver(mapSecrets{handler.SecretAPIToken: "default-token"}, handler.TokenMap{})
+	request := api.TaskRequest{AccessToken: "run-token", OrganizationName: "org-a"}
+	resolver.Remember(request, "a.io", "b/x", TokenDefault)
+
+	if candidates := resolver.Candidates(request, "a.io", "b/x"); len(candidates) != 1 || candidates[0].Class != TokenDefault {
+		t.Fatalf("expected the remembered token only, got %+v", candidates)
+	}
+	other := request
+	other.OrganizationName = "org-b"
+	for _, tc := range []struct {
+		request        api.TaskRequest
+		host, endpoint string
+	}{
+		{other, "a.io", "b/x"},
+		{request, "a.iob", "/x"},
+		{request, "a.io", "b"},
+	} {
+		if candidates := resolver.Candidates(tc.request, tc.host, tc.endpoint); candidates[0].Class != TokenRunScoped {
+			t.Errorf("%s %s %s: expected the run-scoped token first, got %+v", tc.request.OrganizationName, tc.host, tc.endpoint, candidates)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultAllowedHosts are the HCP Terraform hosts accepted when no allowlist is configured
+// app.terraform.io serves the API, archivist.terraform.io serves logs and downloads
+var DefaultAllowedHosts = []string{
+	"app.terraform.io",
+	"archivist.terraform.io",
+}
+
+// ErrURLNotAllowed is returned when a URL does not pass the URLPolicy
+var ErrURLNotAllowed = errors.New("URL not allowed")
+
+// URLPolicy decides which URLs from a task request the server is willing to call
+// The request body is attacker controlled until it has been verified, and even then
+// the permissive API token must never be sent anywhere but HCP Terraform/TFE
+type URLPolicy struct {
+	hosts   map[string]bool // host (default port of the scheme) or host:port
+	schemes map[string]bool
+}
+
+// NewURLPolicy creates a URLPolicy for the allowed hosts over HTTPS
+// Hosts can include a port (tfe.example.com:8443), otherwise only the default port of the scheme is allowed
+// If no hosts are given DefaultAllowedHosts is used
+func NewURLPolicy(hosts ...string) *URLPolicy {
+	p := &URLPolicy{
+		hosts:   map[string]bool{},
+		schemes: map[string]bool{"https": true},
+	}
+
+	for _, host := range hosts {
+		p.addHost(host)
+	}
+	if len(p.hosts) == 0 {
+		for _, host := range DefaultAllowedHosts {
+			p.addHost(host)
+		}
+	}
+	return p
+}
+
+// AllowScheme also accepts URLs with the scheme, e.g. "http" for a local test TFE
+func (p *URLPolicy) AllowScheme(scheme string) *URLPolicy {
+	p.schemes[strings.ToLower(scheme)] = true
+	return p
+}
+
+// Check returns an error wrapping ErrURLNotAllowed if the URL is not allowed
+func (p *URLPolicy) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrURLNotAllowed, err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !p.schemes[scheme] {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrURLNotAllowed, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in the URL are not allowed", ErrURLNotAllowed)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+	if p.hosts[net.JoinHostPort(host, port)] || (port == defaultPort(scheme) && p.hosts[host]) {
+		return nil
+	}
+	return fmt.Errorf("%w: host %s is not in the allowlist", ErrURLNotAllowed, net.JoinHostPort(host, port))
+}
+
+func (p *URLPolicy) addHost(host string) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host != "" {
+		p.hosts[host] = true
+	}
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
@@ -0,0 +1,346 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// ExternalChecksOrder is the order the external checks are registered with, after the Starlark scripts.
+const ExternalChecksOrder = 50
+
+const (
+	// DefaultCheckTimeout is how long a check may run when its timeout is not set.
+	DefaultCheckTimeout = time.Minute
+	// CheckProtocolVersion is the version of the envelope sent to checks.
+	CheckProtocolVersion = 1
+	// maxCheckOutput limits the output read from a check, a check that writes more fails.
+	maxCheckOutput = 10 << 20
+	// maxCheckStderr is how much of the end of stderr is kept for the error outcome.
+	maxCheckStderr = 4 << 10
+)
+
+// checkEnvironment are the variables passed through from the server environment.
+// Nothing else is, so the API token and HMAC key are never handed to a check.
+var checkEnvironment = []string{"PATH", "HOME", "TMPDIR", "LANG", "HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"}
+
+// Check is an external executable run in one or more stages.
+// It receives a CheckEnvelope as JSON on stdin and writes a CheckOutput as JSON to stdout.
+type Check struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Stages the check runs in, by default every stage.
+	Stages []api.TaskStage `json:"stages,omitempty"`
+	// Timeout is a duration such as 30s or 2m, DefaultCheckTimeout when empty.
+	Timeout string `json:"timeout,omitempty"`
+	// Env sets extra environment variables, see checkEnvironment for the variables passed through.
+	Env map[string]string `json:"env,omitempty"`
+
+	timeout time.Duration
+}
+
+// RunsIn reports whether the check runs in the stage.
+func (c Check) RunsIn(stage api.TaskStage) bool {
+	return slices.Contains(c.Stages, stage)
+}
+
+// CheckEnvelope is the JSON document a check reads from stdin.
+type CheckEnvelope struct {
+	Version int           `json:"version"`
+	Stage   api.TaskStage `json:"stage"`
+	// Request is the TaskRequest with the access token and other sensitive fields redacted.
+	Request json.RawMessage `json:"request"`
+	// StageDirectory is the absolute path of the stage directory, the working directory of the check.
+	StageDirectory string `json:"stage_directory"`
+	// Artifacts maps the files and directories saved in the stage directory to their absolute path,
+	// e.g. plan_json.json or the extracted configuration version directory.
+	Artifacts map[string]string `json:"artifacts"`
+}
+
+// CheckOutput is the JSON document a check writes to stdout.
+type CheckOutput struct {
+	Outcomes []CheckOutcome `json:"outcomes"`
+}
+
+// CheckOutcome is an outcome reported by a check, its ID is prefixed with the check name.
+type CheckOutcome struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Body        string `json:"body,omitempty"`
+	URL         string `json:"url,omitempty"`
+	// Level is none, info, warning or error, info when empty. Error outcomes fail the stage.
+	Level string `json:"level,omitempty"`
+	// Label is the tag label, the level when empty.
+	Label string `json:"label,omitempty"`
+}
+
+type checksFile struct {
+	Checks []Check `json:"checks"`
+}
+
+// LoadChecks reads the external checks from a JSON file.
+// An empty path returns no checks, which disables the external checks handler.
+func LoadChecks(path string) ([]Check, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checks file %s: %w", path, err)
+	}
+	var file checksFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse checks file %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Checks {
+		check := &file.Checks[i]
+		if check.Name == "" {
+			return nil, fmt.Errorf("invalid checks file %s: check %d has no name", path, i)
+		}
+		if seen[check.Name] {
+			return nil, fmt.Errorf("invalid checks file %s: check %s is listed more than once", path, check.Name)
+		}
+		seen[check.Name] = true
+		if check.Command == "" {
+			return nil, fmt.Errorf("invalid checks file %s: check %s has no command", path, check.Name)
+		}
+		if len(check.Stages) == 0 {
+			check.Stages = AllStages
+		}
+		for _, stage := range check.Stages {
+			if !slices.Contains(AllStages, stage) {
+				return nil, fmt.Errorf("invalid checks file %s: check %s has unknown stage %q", path, check.Name, stage)
+			}
+		}
+		check.timeout = DefaultCheckTimeout
+		if check.Timeout != "" {
+			if check.timeout, err = time.ParseDuration(check.Timeout); err != nil || check.timeout <= 0 {
+				return nil, fmt.Errorf("invalid checks file %s: check %s has an invalid timeout %q", path, check.Name, check.Timeout)
+			}
+		}
+	}
+	return file.Checks, nil
+}
+
+// externalChecksHandler is the StageHandler that runs the external checks of the stage.
+type externalChecksHandler struct {
+	task *ScaffoldingRunTask
+}
+
+// Name returns the handler name.
+func (h *externalChecksHandler) Name() string { return "external-checks" }
+
+// Stages returns the stages the handler runs in.
+func (h *externalChecksHandler) Stages() []api.TaskStage { return AllStages }
+
+// Handle runs the checks of the stage in order and adds their outcomes, prefixed with the check name.
+// Checks that time out, exit with an error or write malformed output get an error outcome.
+func (h *externalChecksHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	var checks []Check
+	for _, check := range h.task.checks {
+		if check.RunsIn(request.Stage) {
+			checks = append(checks, check)
+		}
+	}
+	if len(checks) == 0 {
+		return nil, nil
+	}
+
+	envelope, err := h.task.checkEnvelope(request)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the check envelope: %w", err)
+	}
+
+	ntr := api.NewTaskResponse()
+	failed := 0
+	for _, check := range checks {
+		outcomes, err := h.task.runCheck(ctx, check, envelope.StageDirectory, data)
+		if err != nil {
+			failed++
+			h.task.logger.Printf("Check %s failed: %v", check.Name, err)
+			ntr.AddOutcome("check-error-"+check.Name, "Check "+check.Name+" failed", err.Error(), "", "check error", api.TagLevelError)
+			continue
+		}
+		for _, o := range outcomes {
+			level := api.ResponseTagLevel(o.Level)
+			if level == api.TagLevelError {
+				failed++
+			}
+			ntr.AddOutcome(check.Name+"-"+o.ID, o.Description, o.Body, o.URL, o.Label, level)
+		}
+	}
+
+	message := fmt.Sprintf("External checks: %d check(s) run, %d error(s)", len(checks), failed)
+	if failed > 0 {
+		return ntr.SetResult(api.TaskFailed, message), nil
+	}
+	return ntr.SetResult(api.TaskPassed, message), nil
+}
+
+// checkEnvelope builds the envelope shared by the checks of the stage.
+func (r *ScaffoldingRunTask) checkEnvelope(request api.TaskRequest) (CheckEnvelope, error) {
+	redacted, err := r.redactor.Redact(request)
+	if err != nil {
+		return CheckEnvelope{}, fmt.Errorf("failed to redact the request: %w", err)
+	}
+	dir, err := filepath.Abs(request.RunTaskDirectory())
+	if err != nil {
+		return CheckEnvelope{}, fmt.Errorf("failed to resolve the stage directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return CheckEnvelope{}, fmt.Errorf("failed to list the stage directory: %w", err)
+	}
+	artifacts := map[string]string{}
+	for _, entry := range entries {
+		artifacts[entry.Name()] = filepath.Join(dir, entry.Name())
+	}
+
+	return CheckEnvelope{
+		Version:        CheckProtocolVersion,
+		Stage:          request.Stage,
+		Request:        redacted,
+		StageDirectory: dir,
+		Artifacts:      artifacts,
+	}, nil
+}
+
+// runCheck runs the check in the stage directory with the envelope on stdin, and parses its output once it exits.
+// The check is killed when its timeout passes or the stage context is done.
+func (r *ScaffoldingRunTask) runCheck(ctx context.Context, check Check, dir string, envelope []byte) ([]CheckOutcome, error) {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, check.Command, check.Args...)
+	cmd.Dir = dir
+	// A nil Env would inherit the whole server environment
+	cmd.Env = []string{}
+	for _, name := range checkEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	for name, value := range check.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdin = bytes.NewReader(envelope)
+	stdout := &limitedBuffer{limit: maxCheckOutput}
+	stderr := &tailBuffer{limit: maxCheckStderr}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// Child processes that keep the pipes open must not hold up the stage after the check exits
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timed out after %s%s", check.timeout, stderrDetail(stderr))
+		}
+		return nil, fmt.Errorf("cancelled: %w%s", context.Cause(ctx), stderrDetail(stderr))
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("exited with code %d%s", exitErr.ExitCode(), stderrDetail(stderr))
+		}
+		return nil, fmt.Errorf("failed to run %s: %w", check.Command, err)
+	case stdout.exceeded:
+		return nil, fmt.Errorf("wrote more than %d bytes to stdout", maxCheckOutput)
+	}
+	return parseCheckOutput(stdout.Bytes())
+}
+
+// parseCheckOutput decodes and validates the output of a check.
+func parseCheckOutput(data []byte) ([]CheckOutcome, error) {
+	var output CheckOutput
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&output); err != nil {
+		return nil, fmt.Errorf("malformed output: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("malformed output: unexpected data after the JSON document")
+	}
+
+	seen := map[string]bool{}
+	for i := range output.Outcomes {
+		o := &output.Outcomes[i]
+		if o.ID == "" || o.Description == "" {
+			return nil, fmt.Errorf("malformed output: outcome %d needs an id and a description", i)
+		}
+		if seen[o.ID] {
+			return nil, fmt.Errorf("malformed output: outcome id %s is returned more than once", o.ID)
+		}
+		seen[o.ID] = true
+		if o.Level == "" {
+			o.Level = string(api.TagLevelInfo)
+		}
+		if !api.ResponseTagLevel(o.Level).IsValid() {
+			return nil, fmt.Errorf("malformed output: outcome %s has unknown level %q, expected none, info, warning or error", o.ID, o.Level)
+		}
+		if o.Label == "" {
+			o.Label = o.Level
+		}
+	}
+	return output.Outcomes, nil
+}
+
+// stderrDetail formats the end of stderr for an error message, empty when nothing was written.
+func stderrDetail(stderr *tailBuffer) string {
+	if s := strings.TrimSpace(string(stderr.Bytes())); s != "" {
+		return "\n\n```\n" + s + "\n```"
+	}
+	return ""
+}
+
+// limitedBuffer keeps up to limit bytes and records whether more were written.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.exceeded = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// tailBuffer keeps the last limit bytes written.
+type tailBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = b.data[len(b.data)-b.limit:]
+	}
+	return len(p), nil
+}
+
+// Bytes returns the bytes kept.
+func (b *tailBuffer) Bytes() []byte { return b.data }
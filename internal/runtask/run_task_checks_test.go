@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+var testCheckScripts = map[string]string{
+	"report.sh": `cat > envelope.json
+printf '{"outcomes": [{"id": "open-port", "description": "token=%s", "body": "Port 22 is open", "url": "https://example.com/open-port", "level": "warning"}, {"id": "ok", "description": "Scan complete"}]}' "$TERRAFORM_API_TOKEN"`,
+	"exit.sh":      "echo 'scanner crashed' >&2\nexit 3",
+	"slow.sh":      "exec sleep 5",
+	"malformed.sh": "echo 'not json'",
+	"level.sh":     `echo '{"outcomes": [{"id": "x", "description": "d", "level": "fatal"}]}'`,
+}
+
+func writeChecks(t *testing.T) []Check {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("checks are shell scripts")
+	}
+	dir := t.TempDir()
+	var checks []string
+	for _, name := range []string{"report.sh", "exit.sh", "slow.sh", "malformed.sh", "level.sh"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+testCheckScripts[name]+"\n"), 0700); err != nil {
+			t.Fatalf("failed to write check: %v", err)
+		}
+		timeout := "10s"
+		if name == "slow.sh" {
+			timeout = "200ms"
+		}
+		checks = append(checks, fmt.Sprintf(`{"name": %q, "command": %q, "stages": ["post_plan"], "timeout": %q}`, strings.TrimSuffix(name, ".sh"), path, timeout))
+	}
+	path := filepath.Join(dir, "checks.json")
+	if err := os.WriteFile(path, []byte(`{"checks": [`+strings.Join(checks, ",")+`]}`), 0600); err != nil {
+		t.Fatalf("failed to write checks file: %v", err)
+	}
+	loaded, err := LoadChecks(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return loaded
+}
+
+// Checks files are validated when loaded
+func TestLoadChecks(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing name":  `{"checks": [{"command": "scan"}]}`,
+		"duplicate":     `{"checks": [{"name": "a", "command": "scan"}, {"name": "a", "command": "scan"}]}`,
+		"no command":    `{"checks": [{"name": "a"}]}`,
+		"unknown stage": `{"checks": [{"name": "a", "command": "scan", "stages": ["plan"]}]}`,
+		"bad timeout":   `{"checks": [{"name": "a", "command": "scan", "timeout": "soon"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "checks.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write checks file: %v", err)
+		}
+		if _, err := LoadChecks(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "checks.json")
+	if err := os.WriteFile(path, []byte(`{"checks": [{"name": "a", "command": "scan"}]}`), 0600); err != nil {
+		t.Fatalf("failed to write checks file: %v", err)
+	}
+	checks, err := LoadChecks(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !checks[0].RunsIn(api.PreApply) || checks[0].timeout != DefaultCheckTimeout {
+		t.Fatalf("expected the defaults, got %+v", checks[0])
+	}
+}
+
+// Check output becomes outcomes, timeouts, non-zero exits and malformed output become error outcomes
+func TestExternalChecksHandler(t *testing.T) {
+	checks := writeChecks(t)
+	t.Setenv("TERRAFORM_API_TOKEN", "server-token")
+	t.Chdir(t.TempDir())
+	request := api.TaskRequest{TaskResultID: "taskrs-1", WorkspaceName: "ws", RunID: "run-123", Stage: api.PostPlan, AccessToken: "secret-token"}
+	dir, err := request.CreateRunTaskDirectoryStructure()
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, planJSONFile), []byte(`{}`), 0600); err != nil {
+		t.Fatalf("failed to write plan: %v", err)
+	}
+	task := &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0), redactor: helper.NewRedactor(), checks: checks, jobs: NewJobTracker()}
+
+	// The outbox entry and the pending job hold the access token, they are never part of the stage artifacts
+	if _, err := NewOutbox(task.logger, helper.NewClient()).Enqueue(request, api.NewTaskResponse()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	task.jobs.Queue(request)
+	if persisted := task.jobs.PersistPending(); persisted != 1 {
+		t.Fatalf("expected the pending job to be persisted, got %d", persisted)
+	}
+
+	response, err := (&externalChecksHandler{task: task}).Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, outcome := range response.Data.Relationships.Outcomes.Data {
+		got = append(got, outcome.Attributes.OutcomeID+"="+string(outcome.Attributes.Tags.Status[0].Level))
+	}
+	want := []string{
+		"report-open-port=warning",
+		"report-ok=info",
+		"check-error-exit=error",
+		"check-error-slow=error",
+		"check-error-malformed=error",
+		"check-error-level=error",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected outcomes %v, got %v", want, got)
+	}
+
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if report := outcomes[0].Attributes; report.Description != "token=" || report.Body != "Port 22 is open" || report.URL != "https://example.com/open-port" {
+		t.Fatalf("unexpected report outcome, the server environment may have leaked: %+v", report)
+	}
+	for i, want := range map[int]string{2: "exited with code 3", 3: "timed out after 200ms", 4: "malformed output", 5: `unknown level "fatal"`} {
+		if !strings.Contains(outcomes[i].Attributes.Body, want) {
+			t.Errorf("expected %s body to mention %q, got: %s", outcomes[i].Attributes.OutcomeID, want, outcomes[i].Attributes.Body)
+		}
+	}
+	if !strings.Contains(outcomes[2].Attributes.Body, "scanner crashed") {
+		t.Errorf("expected the exit outcome to include stderr, got: %s", outcomes[2].Attributes.Body)
+	}
+	if response.Data.Attributes.Status != api.TaskFailed || response.Data.Attributes.Message != "External checks: 5 check(s) run, 4 error(s)" {
+		t.Fatalf("unexpected result: %+v", response.Data.Attributes)
+	}
+
+	// The check wrote the envelope it received to its working directory, the stage directory
+	data, err := os.ReadFile(filepath.Join(dir, "envelope.json"))
+	if err != nil {
+		t.Fatalf("expected the check to run in the stage directory: %v", err)
+	}
+	var envelope CheckEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("failed to decode envelope: %v", err)
+	}
+	absDir, _ := filepath.Abs(dir)
+	if envelope.Version != CheckProtocolVersion || envelope.Stage != api.PostPlan || envelope.StageDirectory != absDir ||
+		envelope.Artifacts[planJSONFile] != filepath.Join(absDir, planJSONFile) {
+		t.Fatalf("unexpected envelope: %s", data)
+	}
+	for _, name := range []string{outboxFileName, pendingJobFileName} {
+		if _, ok := envelope.Artifacts[name]; ok {
+			t.Errorf("expected %s not to be an artifact of the stage", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be in the stage directory, got %v", name, err)
+		}
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Fatalf("expected the envelope not to contain the access token: %s", data)
+	}
+	if strings.Contains(string(envelope.Request), "secret-token") || !strings.Contains(string(envelope.Request), `"run_id":"run-123"`) {
+		t.Fatalf("expected the request with the token redacted, got: %s", envelope.Request)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// CollectorKind is what a collector fetches.
+type CollectorKind string
+
+const (
+	// CollectRequest saves the task request itself.
+	CollectRequest CollectorKind = "request"
+	// CollectAPI saves a run API endpoint, Path is the sub-path of /api/v2/runs/:id ("run" for the run itself).
+	CollectAPI CollectorKind = "api"
+	// CollectLogs downloads the logs of a plan or apply, Path is "plan" or "apply".
+	// It reads the log URL from the api collector with the same path, see Collector.After.
+	CollectLogs CollectorKind = "logs"
+	// CollectConfigurationVersion downloads and extracts the configuration version.
+	CollectConfigurationVersion CollectorKind = "configuration-version"
+	// CollectPlanJSON downloads the JSON plan.
+	CollectPlanJSON CollectorKind = "plan-json"
+)
+
+// Collector declares one artifact the data capture saves for a run.
+// Collectors run concurrently, each one adds a single outcome in the order the collectors are listed.
+type Collector struct {
+	Name   string          `json:"name"`
+	Kind   CollectorKind   `json:"kind,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Title  string          `json:"title,omitempty"`
+	Stages []api.TaskStage `json:"stages,omitempty"`
+	// After lists collectors, listed earlier, that must finish before this one starts.
+	// Collectors that don't run in the stage are ignored.
+	After    []string `json:"after,omitempty"`
+	Disabled bool     `json:"disabled,omitempty"`
+}
+
+// OutcomeID returns the ID of the outcome the collector adds.
+func (c Collector) OutcomeID() string {
+	if c.Kind == CollectRequest {
+		return "save-" + c.Name
+	}
+	return "download-" + c.Name
+}
+
+// RunsIn reports whether the collector is enabled for the stage.
+func (c Collector) RunsIn(stage api.TaskStage) bool {
+	return !c.Disabled && slices.Contains(c.Stages, stage)
+}
+
+// Validate checks the collector can be run.
+func (c Collector) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("collector has no name")
+	}
+	for _, stage := range c.Stages {
+		if !slices.Contains(AllStages, stage) {
+			return fmt.Errorf("collector %s has unknown stage %q", c.Name, stage)
+		}
+	}
+
+	switch c.Kind {
+	case CollectRequest, CollectConfigurationVersion, CollectPlanJSON:
+		return nil
+	case CollectAPI:
+		// The path is also used for the file name, so keep it to a single segment
+		if c.Path == "" || strings.ContainsAny(c.Path, "/\\.?#") {
+			return fmt.Errorf("collector %s has an invalid API path %q", c.Name, c.Path)
+		}
+		return nil
+	case CollectLogs:
+		if c.Path != "plan" && c.Path != "apply" {
+			return fmt.Errorf("collector %s has an invalid log type %q, expected plan or apply", c.Name, c.Path)
+		}
+		return nil
+	}
+	return fmt.Errorf("collector %s has unknown kind %q", c.Name, c.Kind)
+}
+
+// DefaultCollectors returns the artifacts the scaffolding captures when no collectors file is configured.
+func DefaultCollectors() []Collector {
+	planStages := []api.TaskStage{api.PrePlan, api.PostPlan}
+	applyStages := []api.TaskStage{api.PreApply, api.PostApply}
+	return []Collector{
+		{Name: "request", Kind: CollectRequest, Title: "Request", Stages: AllStages},
+		{Name: "run", Kind: CollectAPI, Path: "run", Title: "Run data", Stages: AllStages},
+		{Name: "configuration-version", Kind: CollectConfigurationVersion, Title: "Configuration version", Stages: planStages},
+		{Name: "plan-json", Kind: CollectPlanJSON, Title: "Plan JSON", Stages: []api.TaskStage{api.PostPlan}},
+		{Name: "plan", Kind: CollectAPI, Path: "plan", Title: "Plan data", Stages: []api.TaskStage{api.PostPlan}},
+		{Name: "plan-logs", Kind: CollectLogs, Path: "plan", Title: "Plan logs", Stages: []api.TaskStage{api.PostPlan}, After: []string{"plan"}},
+		{Name: "apply", Kind: CollectAPI, Path: "apply", Title: "Apply data", Stages: []api.TaskStage{api.PostApply}},
+		{Name: "apply-logs", Kind: CollectLogs, Path: "apply", Title: "Apply logs", Stages: []api.TaskStage{api.PostApply}, After: []string{"apply"}},
+		{Name: "policy-checks", Kind: CollectAPI, Path: "policy-checks", Title: "Policy checks", Stages: applyStages},
+		{Name: "comments", Kind: CollectAPI, Path: "comments", Title: "Comments", Stages: applyStages},
+		{Name: "task-stages", Kind: CollectAPI, Path: "task-stages", Title: "Task stages", Stages: applyStages},
+		{Name: "run-events", Kind: CollectAPI, Path: "run-events", Title: "Run events", Stages: applyStages},
+	}
+}
+
+type collectorFile struct {
+	Collectors []Collector `json:"collectors"`
+}
+
+// LoadCollectors returns the default collectors merged with a JSON collectors file.
+// An entry with the name of a default collector changes its stages, title or disables it,
+// any other entry adds a collector after the defaults. An empty path returns the defaults.
+func LoadCollectors(path string) ([]Collector, error) {
+	collectors := DefaultCollectors()
+	if path == "" {
+		return collectors, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collectors file %s: %w", path, err)
+	}
+	var file collectorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse collectors file %s: %w", path, err)
+	}
+
+	for _, entry := range file.Collectors {
+		i := slices.IndexFunc(collectors, func(c Collector) bool { return c.Name == entry.Name })
+		if i == -1 {
+			if entry.Path == "" {
+				entry.Path = entry.Name
+			}
+			if entry.Title == "" {
+				entry.Title = entry.Name
+			}
+			if entry.Kind == CollectLogs && entry.After == nil {
+				entry.After = []string{entry.Path} // the default plan/apply api collector
+			}
+			collectors = append(collectors, entry)
+			continue
+		}
+
+		existing := &collectors[i]
+		if entry.Kind != "" && entry.Kind != existing.Kind {
+			return nil, fmt.Errorf("collector %s in %s cannot change kind of a default collector", entry.Name, path)
+		}
+		if entry.Stages != nil {
+			existing.Stages = entry.Stages
+		}
+		if entry.Title != "" {
+			existing.Title = entry.Title
+		}
+		if entry.After != nil {
+			existing.After = entry.After
+		}
+		existing.Disabled = entry.Disabled
+	}
+
+	seen := map[string]bool{}
+	for _, c := range collectors {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid collectors file %s: %w", path, err)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("invalid collectors file %s: collector %s is listed more than once", path, c.Name)
+		}
+		// Only depending on earlier collectors keeps the order free of cycles
+		for _, dep := range c.After {
+			if !seen[dep] {
+				return nil, fmt.Errorf("invalid collectors file %s: collector %s runs after %s, which is not listed before it", path, c.Name, dep)
+			}
+		}
+		seen[c.Name] = true
+	}
+	return collectors, nil
+}
+
+// collectorResult is the result of a single collector, done is false if it did not finish before the deadline.
+// retries counts the API requests that were retried after rate limiting or server errors,
+// tokenClass is the class of API token the artifact was fetched with, artifact is set for
+// streamed downloads that report their size and checksum.
+type collectorResult struct {
+	done       bool
+	err        error
+	retries    int
+	tokenClass helper.TokenClass
+	artifact   *helper.Artifact
+}
+
+// runCollectors runs the collectors concurrently, at most parallelism at a time, and returns their results
+// in the same order. A collector starts once the collectors in its After list have finished.
+// It returns when every collector has finished or the context is done, whichever comes first;
+// report is called with the results so far each time a collector finishes.
+func (r *ScaffoldingRunTask) runCollectors(ctx context.Context, collectors []Collector, parallelism int, runTaskPath string, request api.TaskRequest, report func([]collectorResult)) []collectorResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var mu sync.Mutex
+	results := make([]collectorResult, len(collectors))
+	finished := make(map[string]chan struct{}, len(collectors))
+	for _, c := range collectors {
+		finished[c.Name] = make(chan struct{})
+	}
+	slots := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for i, c := range collectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(finished[c.Name])
+
+			for _, dep := range c.After {
+				if ch, ok := finished[dep]; ok {
+					select {
+					case <-ch:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			// Take a slot only once the dependencies are done, so waiting collectors don't hold one
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+
+			var stats helper.RequestStats
+			artifact, err := r.collect(helper.WithRequestStats(ctx, &stats), c, runTaskPath, request)
+
+			mu.Lock()
+			results[i] = collectorResult{done: true, err: err, retries: stats.Retries(), tokenClass: stats.TokenClass(), artifact: artifact}
+			snapshot := slices.Clone(results)
+			mu.Unlock()
+			report(snapshot)
+		}()
+	}
+
+	all := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(all)
+	}()
+	select {
+	case <-all:
+	case <-ctx.Done():
+		// Collectors still running see the cancelled context and return shortly, their results are dropped
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Clone(results)
+}
+
+// collect fetches the artifact of a single collector into the stage directory.
+// The Artifact is only returned by the streamed plan JSON download.
+func (r *ScaffoldingRunTask) collect(ctx context.Context, c Collector, runTaskPath string, request api.TaskRequest) (*helper.Artifact, error) {
+	switch c.Kind {
+	case CollectRequest:
+		return nil, r.fileManager.SaveStructToFile(runTaskPath, c.Name+".json", request)
+	case CollectAPI:
+		return nil, r.client.GetDataFromAPI(ctx, runTaskPath, c.Path, request)
+	case CollectLogs:
+		return nil, r.client.GetLogs(ctx, runTaskPath, c.Path, request)
+	case CollectConfigurationVersion:
+		return nil, r.client.DownloadConfigurationVersion(ctx, runTaskPath, request, r.fileManager)
+	case CollectPlanJSON:
+		return r.client.DownloadPlanJson(ctx, runTaskPath, request)
+	}
+	return nil, fmt.Errorf("unknown collector kind %q", c.Kind)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+func writeCollectorsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "collectors.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write collectors file: %v", err)
+	}
+	return path
+}
+
+// The collectors file can disable, move and add collectors
+func TestLoadCollectorsMergesFile(t *testing.T) {
+	path := writeCollectorsFile(t, `{"collectors": [
+		{"name": "comments", "disabled": true},
+		{"name": "run-events", "stages": ["post_apply"]},
+		{"name": "cost-estimate", "kind": "api", "stages": ["post_plan"]}
+	]}`)
+
+	collectors, err := LoadCollectors(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	byName := map[string]Collector{}
+	for _, c := range collectors {
+		byName[c.Name] = c
+	}
+
+	if byName["comments"].RunsIn(api.PreApply) {
+		t.Fatalf("expected comments to be disabled")
+	}
+	if byName["run-events"].RunsIn(api.PreApply) || !byName["run-events"].RunsIn(api.PostApply) {
+		t.Fatalf("expected run-events to only run in post_apply, got %v", byName["run-events"].Stages)
+	}
+	added := collectors[len(collectors)-1]
+	if added.Name != "cost-estimate" || added.Path != "cost-estimate" || !added.RunsIn(api.PostPlan) {
+		t.Fatalf("unexpected added collector: %+v", added)
+	}
+	if added.OutcomeID() != "download-cost-estimate" {
+		t.Fatalf("unexpected outcome ID %s", added.OutcomeID())
+	}
+	if !slices.ContainsFunc(collectors, func(c Collector) bool { return c.Name == "plan-json" }) {
+		t.Fatalf("expected default collectors to be kept")
+	}
+}
+
+func TestLoadCollectorsRejectsInvalidEntries(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown kind":  `{"collectors": [{"name": "x", "kind": "shell"}]}`,
+		"unknown stage": `{"collectors": [{"name": "run", "stages": ["pre_destroy"]}]}`,
+		"path segments": `{"collectors": [{"name": "x", "kind": "api", "path": "../../workspaces"}]}`,
+		"log type":      `{"collectors": [{"name": "x", "kind": "logs", "path": "policy"}]}`,
+		"change kind":   `{"collectors": [{"name": "run", "kind": "logs"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadCollectors(writeCollectorsFile(t, content)); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+// Collectors still running at the stage deadline are reported as not done, the others keep their results
+func TestRunCollectorsStageDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/plan") {
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"data": {}}`))
+	}))
+	defer srv.Close()
+	defer close(release)
+	t.Setenv("TERRAFORM_API_TOKEN", "token")
+
+	serverURL, _ := url.Parse(srv.URL)
+	task := NewRunTask()
+	task.logger = log.New(io.Discard, "", 0)
+	task.client.WithURLPolicy(helper.NewURLPolicy(serverURL.Host).AllowScheme("http"))
+
+	collectors := []Collector{
+		{Name: "plan", Kind: CollectAPI, Path: "plan"},
+		{Name: "run", Kind: CollectAPI, Path: "run"},
+		{Name: "plan-logs", Kind: CollectLogs, Path: "plan", After: []string{"plan"}},
+	}
+	request := api.TaskRequest{RunID: "run-123", TaskResultCallbackURL: srv.URL + "/api/v2/task-results/tr-123/callback"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := task.runCollectors(ctx, collectors, 2, t.TempDir(), request, func([]collectorResult) {})
+
+	if results[0].done || results[2].done {
+		t.Fatalf("expected plan and plan-logs to time out, got %+v", results)
+	}
+	if !results[1].done || results[1].err != nil {
+		t.Fatalf("expected run to finish, got %+v", results[1])
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// DestructiveGuardOrder is the order the destructive-change guard is registered with, after the plan summary.
+const DestructiveGuardOrder = 20
+
+// GuardRules are the destructive-change rules for a workspace.
+// Patterns match the whole resource type or address, * matches any characters.
+type GuardRules struct {
+	// ProtectedTypes are resource types that must not be deleted or replaced, e.g. aws_db_instance or aws_kms_*.
+	ProtectedTypes []string `json:"protected_types,omitempty"`
+	// ProtectedAddresses are resource addresses that must not be deleted or replaced. An address without an
+	// index also protects every instance of the resource, e.g. aws_s3_bucket.state matches aws_s3_bucket.state["eu"].
+	ProtectedAddresses []string `json:"protected_addresses,omitempty"`
+	// MaxDestructive is the number of deletes and replaces allowed in one plan, nil or negative for no limit.
+	MaxDestructive *int `json:"max_destructive,omitempty"`
+}
+
+// WorkspaceGuardRules are the rules for the workspaces whose name matches Workspace.
+type WorkspaceGuardRules struct {
+	// Workspace is a workspace name, * matches any characters.
+	Workspace string `json:"workspace"`
+	GuardRules
+}
+
+// GuardConfig configures the destructive-change guard.
+// Workspaces lists overrides, the first entry matching the workspace name is used. The fields
+// it sets replace the Default rules, the fields it leaves out are inherited.
+type GuardConfig struct {
+	Default    GuardRules            `json:"default"`
+	Workspaces []WorkspaceGuardRules `json:"workspaces,omitempty"`
+}
+
+// RulesFor returns the rules for the workspace.
+func (g GuardConfig) RulesFor(workspace string) GuardRules {
+	rules := g.Default
+	for _, w := range g.Workspaces {
+		if !matchPattern(w.Workspace, workspace) {
+			continue
+		}
+		if w.ProtectedTypes != nil {
+			rules.ProtectedTypes = w.ProtectedTypes
+		}
+		if w.ProtectedAddresses != nil {
+			rules.ProtectedAddresses = w.ProtectedAddresses
+		}
+		if w.MaxDestructive != nil {
+			rules.MaxDestructive = w.MaxDestructive
+		}
+		break
+	}
+	return rules
+}
+
+// IsEmpty reports whether the rules check nothing.
+func (r GuardRules) IsEmpty() bool {
+	return len(r.ProtectedTypes) == 0 && len(r.ProtectedAddresses) == 0 && (r.MaxDestructive == nil || *r.MaxDestructive < 0)
+}
+
+// Protects returns the rule protecting the resource, empty if it is not protected.
+func (r GuardRules) Protects(change api.ResourceChange) string {
+	for _, pattern := range r.ProtectedTypes {
+		if matchPattern(pattern, change.Type) {
+			return "protected type " + pattern
+		}
+	}
+	// A pattern without an index also matches the count/for_each instances of the resource
+	address := change.Address
+	base := address
+	if i := strings.LastIndex(address, "["); i > 0 && strings.HasSuffix(address, "]") {
+		base = address[:i]
+	}
+	for _, pattern := range r.ProtectedAddresses {
+		if matchPattern(pattern, address) || (!strings.HasSuffix(pattern, "]") && matchPattern(pattern, base)) {
+			return "protected address " + pattern
+		}
+	}
+	return ""
+}
+
+// matchPattern reports whether s matches the pattern, where * matches any characters, including none.
+// Unlike path.Match, brackets and dots in resource addresses have no special meaning.
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// LoadGuardConfig reads the destructive-change guard rules from a JSON file.
+// An empty path returns an empty GuardConfig, which disables the guard.
+func LoadGuardConfig(path string) (GuardConfig, error) {
+	if path == "" {
+		return GuardConfig{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return GuardConfig{}, fmt.Errorf("failed to read guard file %s: %w", path, err)
+	}
+	var config GuardConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return GuardConfig{}, fmt.Errorf("failed to parse guard file %s: %w", path, err)
+	}
+	for i, w := range config.Workspaces {
+		if w.Workspace == "" {
+			return GuardConfig{}, fmt.Errorf("invalid guard file %s: workspace entry %d has no workspace name", path, i)
+		}
+	}
+	return config, nil
+}
+
+// destructiveGuardHandler is the StageHandler that fails post-plan when the plan deletes or replaces
+// protected resources, or more resources than the workspace allows.
+type destructiveGuardHandler struct {
+	task *ScaffoldingRunTask
+}
+
+// Name returns the handler name.
+func (h *destructiveGuardHandler) Name() string { return "destructive-guard" }
+
+// Stages returns the stages the handler runs in.
+func (h *destructiveGuardHandler) Stages() []api.TaskStage { return []api.TaskStage{api.PostPlan} }
+
+// Handle checks the destructive changes of the saved plan JSON against the rules for the workspace.
+// The guard fails closed: when rules apply and the plan JSON was not saved, the handler returns an error.
+func (h *destructiveGuardHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	rules := h.task.guard.RulesFor(request.WorkspaceName)
+	if rules.IsEmpty() {
+		return nil, nil
+	}
+
+	path := filepath.Join(request.RunTaskDirectory(), planJSONFile)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("the plan JSON was not saved, destructive changes cannot be checked")
+	}
+
+	type violation struct {
+		change api.ResourceChange
+		rule   string
+	}
+	var protected, destructive []violation
+	err := helper.DecodeResourceChangesFile(path, func(change api.ResourceChange) error {
+		if !change.Change.Actions.IsDestructive() {
+			return ctx.Err()
+		}
+		v := violation{change: change, rule: rules.Protects(change)}
+		if v.rule != "" {
+			protected = append(protected, v)
+		} else {
+			destructive = append(destructive, v)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the plan JSON: %w", err)
+	}
+
+	ntr := api.NewTaskResponse()
+	for _, v := range protected {
+		ntr.AddOutcome("guard-protected-"+v.change.Address, v.change.Address+" is protected and would be "+destructiveVerb(v.change),
+			guardMarkdown(v.change, "Matched the "+v.rule+"."), "", "protected", api.TagLevelError)
+	}
+
+	total := len(protected) + len(destructive)
+	limitExceeded := rules.MaxDestructive != nil && *rules.MaxDestructive >= 0 && total > *rules.MaxDestructive
+	if limitExceeded {
+		reason := fmt.Sprintf("The plan deletes or replaces %d resource(s), the limit for workspace %s is %d.", total, request.WorkspaceName, *rules.MaxDestructive)
+		for i, v := range destructive {
+			// Protected resources already have an outcome, the rest are listed up to the outcome limit
+			if i == maxDestructiveOutcomes {
+				ntr.AddOutcome("guard-limit-more", fmt.Sprintf("%d more resource(s) over the destructive change limit", len(destructive)-i),
+					reason+" See `"+planJSONFile+"` for the rest.", "", "over limit", api.TagLevelError)
+				break
+			}
+			ntr.AddOutcome("guard-limit-"+v.change.Address, v.change.Address+" would be "+destructiveVerb(v.change)+", over the destructive change limit",
+				guardMarkdown(v.change, reason), "", "over limit", api.TagLevelError)
+		}
+		if len(destructive) == 0 {
+			ntr.AddOutcome("guard-limit", "Too many destructive changes", reason, "", "over limit", api.TagLevelError)
+		}
+	}
+
+	switch {
+	case len(protected) > 0 && limitExceeded:
+		ntr.SetResult(api.TaskFailed, fmt.Sprintf("Destructive-change guard: %d protected resource(s) and %d destructive change(s) over the limit of %d", len(protected), total, *rules.MaxDestructive))
+	case len(protected) > 0:
+		ntr.SetResult(api.TaskFailed, fmt.Sprintf("Destructive-change guard: %d protected resource(s) would be deleted or replaced", len(protected)))
+	case limitExceeded:
+		ntr.SetResult(api.TaskFailed, fmt.Sprintf("Destructive-change guard: %d destructive change(s) over the limit of %d", total, *rules.MaxDestructive))
+	default:
+		ntr.SetResult(api.TaskPassed, "Destructive-change guard passed")
+	}
+	return ntr, nil
+}
+
+// guardMarkdown renders a guard violation as markdown, the change details followed by the reason.
+func guardMarkdown(change api.ResourceChange, reason string) string {
+	return changeMarkdown(change) + "\n\n" + reason
+}
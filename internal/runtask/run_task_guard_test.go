@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+const guardPlan = `{"format_version": "1.2", "resource_changes": [
+	{"address": "aws_db_instance.main", "type": "aws_db_instance", "change": {"actions": ["delete", "create"]}},
+	{"address": "aws_s3_bucket.state[\"eu\"]", "type": "aws_s3_bucket", "change": {"actions": ["delete"]}},
+	{"address": "aws_s3_bucket.logs", "type": "aws_s3_bucket", "change": {"actions": ["delete"]}},
+	{"address": "aws_instance.web", "type": "aws_instance", "change": {"actions": ["update"]}}
+]}`
+
+func writeGuardFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "guard.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write guard file: %v", err)
+	}
+	return path
+}
+
+func newGuardHandler(t *testing.T, guard GuardConfig, workspace, plan string) (*destructiveGuardHandler, api.TaskRequest) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	request := api.TaskRequest{WorkspaceName: workspace, RunID: "run-123", Stage: api.PostPlan}
+	if plan != "" {
+		dir, err := request.CreateRunTaskDirectoryStructure()
+		if err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, planJSONFile), []byte(plan), 0600); err != nil {
+			t.Fatalf("failed to write plan: %v", err)
+		}
+	}
+	task := &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0), guard: guard}
+	return &destructiveGuardHandler{task: task}, request
+}
+
+// Workspace entries override the default rules field by field, the first match wins
+func TestLoadGuardConfigPerWorkspace(t *testing.T) {
+	guard, err := LoadGuardConfig(writeGuardFile(t, `{
+		"default": {"protected_types": ["aws_db_*", "aws_kms_key"], "max_destructive": 5},
+		"workspaces": [
+			{"workspace": "sandbox-*", "max_destructive": -1, "protected_types": []},
+			{"workspace": "prod-*", "protected_addresses": ["aws_s3_bucket.state"], "max_destructive": 0},
+			{"workspace": "prod-network", "max_destructive": 100}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prod := guard.RulesFor("prod-network")
+	if *prod.MaxDestructive != 0 || len(prod.ProtectedTypes) != 2 || prod.ProtectedAddresses[0] != "aws_s3_bucket.state" {
+		t.Fatalf("unexpected prod rules: %+v", prod)
+	}
+	if !guard.RulesFor("sandbox-1").IsEmpty() {
+		t.Fatalf("expected the sandbox rules to be empty")
+	}
+	if *guard.RulesFor("dev").MaxDestructive != 5 {
+		t.Fatalf("expected the default rules for other workspaces")
+	}
+
+	if _, err := LoadGuardConfig(writeGuardFile(t, `{"workspaces": [{"max_destructive": 1}]}`)); err == nil {
+		t.Fatalf("expected an error for a workspace entry without a name")
+	}
+}
+
+// Protected types and addresses match with wildcards and across instances
+func TestGuardRulesProtects(t *testing.T) {
+	rules := GuardRules{ProtectedTypes: []string{"aws_db_*"}, ProtectedAddresses: []string{"module.*.aws_s3_bucket.state", "aws_kms_key.main[0]"}}
+	for address, protected := range map[string]bool{
+		"aws_db_instance.main":                    true,
+		"module.core.aws_s3_bucket.state":         true,
+		"module.core.aws_s3_bucket.state[\"eu\"]": true,
+		"module.core.aws_s3_bucket.logs":          false,
+		"aws_kms_key.main[0]":                     true,
+		"aws_kms_key.main[1]":                     false,
+	} {
+		resourceType, _, _ := strings.Cut(strings.TrimPrefix(address, "module.core."), ".")
+		change := api.ResourceChange{Address: address, Type: resourceType}
+		if got := rules.Protects(change) != ""; got != protected {
+			t.Errorf("expected %s protected to be %t", address, protected)
+		}
+	}
+}
+
+// Each protected resource gets an error outcome and fails the stage
+func TestDestructiveGuardProtectedResources(t *testing.T) {
+	guard := GuardConfig{Default: GuardRules{ProtectedTypes: []string{"aws_db_instance"}, ProtectedAddresses: []string{"aws_s3_bucket.state"}}}
+	h, request := newGuardHandler(t, guard, "prod", guardPlan)
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.Data.Attributes.Status != api.TaskFailed {
+		t.Fatalf("expected the guard to fail, got %s", response.Data.Attributes.Status)
+	}
+	var ids []string
+	for _, outcome := range response.Data.Relationships.Outcomes.Data {
+		ids = append(ids, outcome.Attributes.OutcomeID)
+		if outcome.Attributes.Tags.Status[0].Level != api.TagLevelError {
+			t.Fatalf("expected error outcomes, got %+v", outcome)
+		}
+	}
+	if strings.Join(ids, " ") != `guard-protected-aws_db_instance.main guard-protected-aws_s3_bucket.state["eu"]` {
+		t.Fatalf("unexpected outcomes: %v", ids)
+	}
+}
+
+// Exceeding the destructive change limit fails the stage and lists the destructive resources
+func TestDestructiveGuardLimit(t *testing.T) {
+	limit := 2
+	h, request := newGuardHandler(t, GuardConfig{Default: GuardRules{MaxDestructive: &limit}}, "prod", guardPlan)
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if response.Data.Attributes.Status != api.TaskFailed || len(outcomes) != 3 {
+		t.Fatalf("expected three over limit outcomes, got %s %+v", response.Data.Attributes.Status, outcomes)
+	}
+	if !strings.Contains(outcomes[0].Attributes.Body, "the limit for workspace prod is 2") {
+		t.Fatalf("unexpected body: %s", outcomes[0].Attributes.Body)
+	}
+
+	// At the limit the guard passes
+	limit = 3
+	if response, _ := h.Handle(context.Background(), request, nil); response.Data.Attributes.Status != api.TaskPassed {
+		t.Fatalf("expected the guard to pass at the limit")
+	}
+}
+
+// The guard fails closed when the plan JSON is missing, and does nothing without rules
+func TestDestructiveGuardWithoutPlan(t *testing.T) {
+	h, request := newGuardHandler(t, GuardConfig{Default: GuardRules{ProtectedTypes: []string{"aws_db_instance"}}}, "prod", "")
+	if _, err := h.Handle(context.Background(), request, nil); err == nil {
+		t.Fatalf("expected an error without a plan JSON")
+	}
+
+	h.task.guard = GuardConfig{}
+	if response, err := h.Handle(context.Background(), request, nil); response != nil || err != nil {
+		t.Fatalf("expected no response without rules, got %+v, %v", response, err)
+	}
+}
@@ -4,13 +4,21 @@
 package runtask
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 
-	"github.com/straubt1/terraform-run-task/internal/helper"
 	"github.com/straubt1/terraform-run-task/internal/sdk/api"
 	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
 )
@@ -19,24 +27,123 @@ import (
 // This function only runs once when the task server starts.
 func HandleRequests(task *ScaffoldingRunTask) {
 	r := mux.NewRouter()
+	task.pool = NewWorkerPool(task.config.Workers, task.config.QueueLimit)
 
 	// Printing the HMAC key should be avoided in a production environment!
-	if task.config.HmacKey != "" {
-		task.logger.Println("Registering " + task.config.Path + " route (HMAC verification enabled)")
+	if task.config.HmacKeys.Enabled() {
+		task.logger.Println("Registering " + task.config.Path + " route (HMAC verification enabled, active keys: " + strings.Join(task.config.HmacKeys.Active(time.Now()), ", ") + ")")
 	} else {
 		task.logger.Println("Registering " + task.config.Path + " route (HMAC verification disabled)")
 	}
-	r.HandleFunc(task.config.Path, handleTFCRequestWrapper(task, sendTFCCallbackResponse())).
+	callback := sendTFCCallbackResponse()
+	r.HandleFunc(task.config.Path, handleTFCRequestWrapper(task, callback)).
 		Methods(http.MethodPost)
 
 	task.logger.Println("Registering /healthcheck route")
 	r.HandleFunc("/healthcheck", healthcheck(task)).
 		Methods(http.MethodGet)
 
-	task.logger.Printf("Starting server on port %s", task.config.Addr)
-	err := http.ListenAndServe(task.config.Addr, r)
-	if err != nil {
+	task.logger.Printf("Registering /stats route (%d workers, queue limit %d)", task.config.Workers, task.config.QueueLimit)
+	r.HandleFunc("/stats", stats(task)).
+		Methods(http.MethodGet)
+
+	// Deliver any callbacks that were still pending when the server last stopped
+	if resumed := task.outbox.Resume("."); resumed > 0 {
+		task.logger.Printf("Resumed %d pending callback(s)", resumed)
+	}
+	resumePendingJobs(task, ".", callback)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go reloadHmacKeysOnSignal(ctx, task)
+
+	server := &http.Server{Addr: task.config.Addr, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		task.logger.Printf("Starting server on port %s", task.config.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			task.logger.Println("Server stopped unexpectedly:", err)
+		}
 		return
+	case <-ctx.Done():
+	}
+	// Restore the default signal behaviour, so a second SIGINT/SIGTERM forces an exit during a long drain
+	stop()
+
+	shutdown(task, server)
+}
+
+// shutdown stops accepting new run task requests and waits up to the drain timeout for
+// in-flight stages and callbacks. Stages that don't finish in time are persisted so they
+// are rerun on the next start; callbacks are already persisted by the outbox.
+func shutdown(task *ScaffoldingRunTask, server *http.Server) {
+	started := time.Now()
+	task.draining.Store(true)
+	task.logger.Printf("Shutdown signal received, draining in-flight stages (timeout %s)", task.config.DrainTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), task.config.DrainTimeout)
+	defer cancel()
+
+	// Stop the listener and wait for open HTTP requests, these are short since stages run in the background
+	if err := server.Shutdown(drainCtx); err != nil {
+		task.logger.Println("Warning: HTTP server did not shut down cleanly:", err)
+	}
+
+	drained := task.jobs.Wait(drainCtx)
+	persisted := 0
+	if !drained {
+		persisted = task.jobs.PersistPending()
+	}
+
+	counts := task.jobs.Counts()
+	task.logger.Printf("Shutdown summary: drained=%t duration=%s completed=%d failed=%d persisted_stages=%d pending_callbacks=%d",
+		drained, time.Since(started).Round(time.Millisecond), counts[JobCompleted], counts[JobFailed], persisted, counts[JobDelivering])
+}
+
+// reloadHmacKeysOnSignal reloads the HMAC key file on SIGHUP, so keys can be rotated without a restart.
+func reloadHmacKeysOnSignal(ctx context.Context, task *ScaffoldingRunTask) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := task.config.HmacKeys.Reload(); err != nil {
+				task.logger.Println("Warning: Failed to reload HMAC keys, keeping the current keys:", err)
+				continue
+			}
+			task.logger.Println("Reloaded HMAC keys, active keys: " + strings.Join(task.config.HmacKeys.Active(time.Now()), ", "))
+		}
+	}
+}
+
+// resumePendingJobs reruns the stages that were interrupted by the last shutdown.
+func resumePendingJobs(task *ScaffoldingRunTask, root string, callback func(api.TaskRequest, *ScaffoldingRunTask, *api.TaskResponse) error) {
+	requests, err := task.jobs.LoadPending(root)
+	if err != nil {
+		task.logger.Println("Warning: Failed to load pending jobs:", err)
+	}
+
+	for _, request := range requests {
+		if _, err := request.CreateRunTaskDirectoryStructure(); err != nil {
+			task.logger.Println("Warning: Failed to create run task directory, job state will not be saved:", err)
+		}
+		job, queued := task.jobs.Queue(request)
+		if !queued {
+			continue
+		}
+		if err := submitStageJob(task, job, request, callback); err != nil {
+			continue
+		}
+		task.logger.Println("Resuming interrupted job for task result:", job.TaskResultID)
 	}
 }
 
@@ -45,6 +152,12 @@ func healthcheck(task *ScaffoldingRunTask) func(w http.ResponseWriter, r *http.R
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		task.logger.Println("/healthcheck called")
+		// Report unavailable while draining so load balancers stop sending new requests
+		if task.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		err := json.NewEncoder(w).Encode(map[string]string{"status": "available"})
 		if err != nil {
@@ -53,14 +166,37 @@ func healthcheck(task *ScaffoldingRunTask) func(w http.ResponseWriter, r *http.R
 	}
 }
 
+// Stats endpoint, reports the worker pool queue depth and wait times so the service can be sized.
+func stats(task *ScaffoldingRunTask) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"pool": task.pool.Stats(),
+			"jobs": task.jobs.Counts(),
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
 // This is the entry point for a Run Task request from HCP Terraform.
-// It validates the request, determines the stage, and calls the appropriate stage function.
-func handleTFCRequestWrapper(task *ScaffoldingRunTask, callback func(http.ResponseWriter, *http.Request, api.TaskRequest, *ScaffoldingRunTask, *api.TaskResponse)) func(http.ResponseWriter, *http.Request) {
+// It validates the request, acknowledges it, and runs the stage in a background job.
+func handleTFCRequestWrapper(task *ScaffoldingRunTask, callback func(api.TaskRequest, *ScaffoldingRunTask, *api.TaskResponse) error) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		task.logger.Println(task.config.Path + " called")
 		// Ensure body is closed when we're done
 		defer func() { _ = r.Body.Close() }()
 
+		// Once shutdown has started, no new stages are accepted. HCP Terraform retries the request.
+		if task.draining.Load() {
+			task.logger.Println("Rejecting request, server is shutting down")
+			http.Error(w, "Service Unavailable: server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
 		// Parse request
 		var runTaskReq api.TaskRequest
 		reqBody, err := io.ReadAll(r.Body)
@@ -81,24 +217,24 @@ func handleTFCRequestWrapper(task *ScaffoldingRunTask, callback func(http.Respon
 
 		requestSha := r.Header.Get(handler.HeaderTaskSignature)
 
-		if requestSha != "" && task.config.HmacKey == "" {
+		if requestSha != "" && !task.config.HmacKeys.Enabled() {
 			task.logger.Printf("Received a request for %s with a signature but this server cannot validate signed requests\n", r.URL)
 			http.Error(w, "Unexpected x-tfc-task-signature header", http.StatusBadRequest)
 			return
 		}
 
-		if requestSha == "" && task.config.HmacKey != "" {
+		if requestSha == "" && task.config.HmacKeys.Enabled() {
 			task.logger.Printf("Received an unsigned request for %s\n", r.URL)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		if requestSha != "" {
-			// Calculate expected HMAC
-			verified, err := handler.VerifyHMAC(reqBody, []byte(r.Header.Get(handler.HeaderTaskSignature)), []byte(task.config.HmacKey))
+			// Calculate expected HMAC for every active key
+			keyLabel, verified, err := task.config.HmacKeys.Verify(reqBody, []byte(requestSha))
 
 			if err != nil {
-				task.logger.Println("Unable to verify given HMAC key")
+				task.logger.Println("Unable to verify given HMAC key:", err)
 				http.Error(w, "Error verifying signed request", http.StatusInternalServerError)
 				return
 			}
@@ -108,7 +244,7 @@ func handleTFCRequestWrapper(task *ScaffoldingRunTask, callback func(http.Respon
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			task.logger.Println("Successfully verified HMAC signature")
+			task.logger.Printf("Successfully verified HMAC signature with key %q\n", keyLabel)
 		}
 
 		// IsEndpointValidation returns true if the Request is from the
@@ -121,68 +257,216 @@ func handleTFCRequestWrapper(task *ScaffoldingRunTask, callback func(http.Respon
 			return
 		}
 
-		// Call the appropriate stage function based on the stage in the request
-		var stageResponse *api.TaskResponse
-		var stageError error
-		switch runTaskReq.Stage {
-		case api.PrePlan:
-			stageResponse, stageError = task.PrePlanStage(runTaskReq)
-		case api.PostPlan:
-			stageResponse, stageError = task.PostPlanStage(runTaskReq)
-		case api.PreApply:
-			stageResponse, stageError = task.PreApplyStage(runTaskReq)
-		case api.PostApply:
-			stageResponse, stageError = task.PostApplyStage(runTaskReq)
-		default:
-			stageResponse = api.NewTaskResponse().SetResult(api.TaskFailed, "Run Task is running in an unknown stage: "+string(runTaskReq.Stage))
-			task.logger.Println("Run task is running in an unknown stage:", runTaskReq.Stage)
+		// The result is sent to the callback URL with the run-scoped token, it must point at an allowed host
+		if err := task.client.CheckURL(runTaskReq.TaskResultCallbackURL); err != nil {
+			task.logger.Printf("Rejecting task result %s, callback URL is not allowed: %v\n", runTaskReq.TaskResultID, err)
+			http.Error(w, "Bad Request: task_result_callback_url is not allowed: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		if stageError != nil {
-			stageResponse = api.NewTaskResponse().SetResult(api.TaskFailed, "Run Task had an unexpected error: "+stageError.Error())
+		// HCP Terraform can deliver the same task result more than once.
+		// Never recompute a stage that already produced a result, resend it instead.
+		if resendCachedResponse(task, runTaskReq) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
-			task.logger.Println("Error occurred during stage execution:", stageError.Error())
+		// Acknowledge the request right away and run the stage in the background.
+		// The result is sent to HCP Terraform with a PATCH to the callback URL once the stage is done.
+		if _, err := runTaskReq.CreateRunTaskDirectoryStructure(); err != nil {
+			task.logger.Println("Warning: Failed to create run task directory, job state will not be saved:", err)
+		}
+		job, queued := task.jobs.Queue(runTaskReq)
+		if !queued {
+			if existing, ok := task.jobs.Get(job.TaskResultID); ok {
+				task.logger.Printf("Duplicate delivery of task result %s, reusing in-progress job (state %s)\n", existing.TaskResultID, existing.State)
+			}
+			w.WriteHeader(http.StatusOK)
+			return
 		}
+		if err := submitStageJob(task, job, runTaskReq, callback); err != nil {
+			writeOverloaded(w, task)
+			return
+		}
+		task.logger.Println("Queued job for task result:", job.TaskResultID)
 
-		// Call the original function to send the response back to TFC with the stage result
-		callback(w, r, runTaskReq, task, stageResponse)
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
-// Function to reply back to HCP Terraform with the task result for the Stage.
-func sendTFCCallbackResponse() func(w http.ResponseWriter, r *http.Request, taskRequest api.TaskRequest, task *ScaffoldingRunTask, taskResponse *api.TaskResponse) {
-	return func(w http.ResponseWriter, r *http.Request, taskRequest api.TaskRequest, task *ScaffoldingRunTask, taskResponse *api.TaskResponse) {
-		respBody, err := json.Marshal(taskResponse)
-		if err != nil {
-			task.logger.Println("Unable to marshall callback response to TFC")
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
+// resendCachedResponse sends the response.json of an earlier delivery of the same task result.
+// It returns false when there is no cached response and the stage should run.
+func resendCachedResponse(task *ScaffoldingRunTask, runTaskReq api.TaskRequest) bool {
+	if job, ok := task.jobs.Get(runTaskReq.TaskResultID); ok && job.InProgress() {
+		return false // Queue reuses the in-progress job
+	}
+
+	cached, err := task.jobs.LoadCachedResponse(runTaskReq)
+	if err != nil {
+		return false
+	}
+
+	task.logger.Printf("Duplicate delivery of task result %s, resending cached response.json\n", runTaskReq.TaskResultID)
+	runTaskReq.TaskDirectory = runTaskReq.RunTaskDirectory()
+	entry, err := task.outbox.Enqueue(runTaskReq, cached)
+	if err != nil {
+		task.logger.Println("Warning: Failed to add cached response to the outbox:", err)
+		return false
+	}
+	go func() {
+		if err := task.outbox.Deliver(entry); err != nil {
+			task.logger.Printf("Error occurred while resending cached response for task result %s: %v\n", runTaskReq.TaskResultID, err)
+		}
+	}()
+	return true
+}
+
+// overloadRetryAfter is the Retry-After hint, in seconds, sent when the worker pool is saturated.
+const overloadRetryAfter = "30"
+
+// submitStageJob hands the job to the worker pool, marking it failed if the pool is saturated.
+func submitStageJob(task *ScaffoldingRunTask, job *Job, runTaskReq api.TaskRequest, callback func(api.TaskRequest, *ScaffoldingRunTask, *api.TaskResponse) error) error {
+	err := task.pool.Submit(runTaskReq.OrganizationName, func() {
+		runStageJob(task, job, runTaskReq, callback)
+	})
+	if err != nil {
+		task.logger.Printf("Rejecting task result %s for organization %s: %v\n", job.TaskResultID, runTaskReq.OrganizationName, err)
+		task.jobs.Finish(job, err)
+	}
+	return err
+}
+
+// writeOverloaded replies with 503 and a Retry-After header when no more stages can be queued.
+func writeOverloaded(w http.ResponseWriter, task *ScaffoldingRunTask) {
+	poolStats := task.pool.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", overloadRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       "overloaded",
+		"message":     ErrPoolSaturated.Error(),
+		"queue_depth": poolStats.QueueDepth,
+		"queue_limit": poolStats.QueueLimit,
+	})
+}
+
+// runStageJob executes the stage for the request and sends the result to the callback URL.
+// A panic in the stage is recovered, so one broken handler can't take down the server and every
+// other in-flight job: the job is marked failed and HCP Terraform still gets a failed result.
+func runStageJob(task *ScaffoldingRunTask, job *Job, runTaskReq api.TaskRequest, callback func(api.TaskRequest, *ScaffoldingRunTask, *api.TaskResponse) error) {
+	finished := false
+	defer func() {
+		// Last resort for a panic outside the stage, e.g. while sending the result
+		if p := recover(); p != nil {
+			task.logger.Printf("Panic in job for task result %s: %v\n%s", job.TaskResultID, p, debug.Stack())
+			if !finished {
+				task.jobs.Finish(job, fmt.Errorf("job panicked: %v", p))
+			}
+		}
+	}()
+	task.jobs.Running(job)
+
+	// The stage deadline is propagated to every handler, so a slow download reports a timed-out
+	// outcome instead of running until HCP Terraform gives up on the task
+	ctx, cancel := context.WithTimeout(context.Background(), task.config.StageTimeout)
+	progress := NewProgressReporter(task.logger, task.client, runTaskReq)
+	stageResponse, stageErr := runStageRecovered(ctx, task, runTaskReq, progress)
+	cancel()
+
+	// No progress updates may be sent after the final result
+	progress.Finish()
+	task.jobs.Delivering(job)
+	err := callback(runTaskReq, task, stageResponse)
+	if err != nil {
+		task.logger.Println("Error occurred while sending the callback response to TFC:", err)
+	}
+	finished = true
+	task.jobs.Finish(job, errors.Join(stageErr, err))
+	if finished, ok := task.jobs.Get(job.TaskResultID); ok {
+		task.logger.Printf("Job for task result %s finished with state %s\n", finished.TaskResultID, finished.State)
+	}
+}
+
+// runStageRecovered runs the stage and turns a panic into a failed TaskResponse and an error for the job.
+func runStageRecovered(ctx context.Context, task *ScaffoldingRunTask, runTaskReq api.TaskRequest, progress *ProgressReporter) (response *api.TaskResponse, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			task.logger.Printf("Panic in stage %s for task result %s: %v\n%s", runTaskReq.Stage, runTaskReq.TaskResultID, p, debug.Stack())
+			err = fmt.Errorf("stage panicked: %v", p)
+			response = api.NewTaskResponse().
+				AddOutcome("stage-panic", "The run task failed unexpectedly", err.Error(), "", "failed", api.TagLevelError).
+				SetResult(api.TaskFailed, "Run Task failed unexpectedly: "+err.Error())
 		}
+	}()
+	return runStage(ctx, task, runTaskReq, progress), nil
+}
 
+// runStage runs the handlers registered for the stage in the request.
+func runStage(ctx context.Context, task *ScaffoldingRunTask, runTaskReq api.TaskRequest, progress *ProgressReporter) *api.TaskResponse {
+	// Reject the stage outright if the request points downloads at hosts that are not allowed
+	if response := checkRequestURLs(task, runTaskReq); response != nil {
+		return response
+	}
+
+	return task.handlers.Run(ctx, runTaskReq, progress)
+}
+
+// checkRequestURLs validates the download URLs in the request against the URL policy.
+// It returns a failed TaskResponse with one outcome per rejected URL, or nil if every URL is allowed.
+func checkRequestURLs(task *ScaffoldingRunTask, runTaskReq api.TaskRequest) *api.TaskResponse {
+	urls := []struct {
+		field string
+		url   string
+	}{
+		{"configuration_version_download_url", runTaskReq.ConfigurationVersionDownloadURL},
+		{"plan_json_api_url", runTaskReq.PlanJSONAPIURL},
+	}
+
+	var response *api.TaskResponse
+	for _, u := range urls {
+		if u.url == "" {
+			continue // Not every stage has every URL
+		}
+		if err := task.client.CheckURL(u.url); err != nil {
+			task.logger.Printf("Rejecting %s for task result %s: %v\n", u.field, runTaskReq.TaskResultID, err)
+			if response == nil {
+				response = api.NewTaskResponse()
+			}
+			response.AddOutcome("url-not-allowed-"+strings.ReplaceAll(u.field, "_", "-"), "Request contains a "+u.field+" that is not allowed", err.Error(), "", "failed", api.TagLevelError)
+		}
+	}
+
+	if response != nil {
+		response.SetResult(api.TaskFailed, "Run Task rejected the request: it contains URLs for hosts that are not allowed")
+	}
+	return response
+}
+
+// Function to reply back to HCP Terraform with the task result for the Stage.
+// This runs after the original HTTP request has been acknowledged, so errors are returned to the job instead.
+// The result is written to the outbox before it is sent so it survives failed deliveries and restarts.
+func sendTFCCallbackResponse() func(taskRequest api.TaskRequest, task *ScaffoldingRunTask, taskResponse *api.TaskResponse) error {
+	return func(taskRequest api.TaskRequest, task *ScaffoldingRunTask, taskResponse *api.TaskResponse) error {
 		// Save response to file
 		// This is fairly ugly at the moment, but it works.
-		fileManager := helper.NewFileManager()
 		taskRequest.CreateRunTaskDirectoryStructure()
-		err = fileManager.SaveStructToFile(taskRequest.TaskDirectory, "response.json", taskResponse)
+		err := task.fileManager.SaveStructToFile(taskRequest.TaskDirectory, responseFileName, CachedResponse{TaskResultID: taskRequest.TaskResultID, TaskResponse: *taskResponse})
 		if err != nil {
 			task.logger.Printf("Warning: Failed to save response to file: %v", err)
 		}
 
-		// Send PATCH callback response to TFC
-		tfcClient := helper.NewClient()
-		request, err := tfcClient.SendGenericHttpRequest(taskRequest.TaskResultCallbackURL, http.MethodPatch, taskRequest.AccessToken, respBody)
-		// We don't need the response body here; just ensure it's closed if present
-		if request != nil && request.Body != nil {
-			_ = request.Body.Close()
-		}
+		entry, err := task.outbox.Enqueue(taskRequest, taskResponse)
 		if err != nil {
-			task.logger.Println("Error occurred while sending the callback response to TFC")
-			http.Error(w, "Bad Request:"+err.Error(), http.StatusNotFound)
-			return
+			task.logger.Println("Unable to add callback response to the outbox")
+			return err
+		}
+
+		// Send PATCH callback response to TFC, retrying until it is accepted
+		if err := task.outbox.Deliver(entry); err != nil {
+			return fmt.Errorf("failed to send callback response: %w", err)
 		}
 
 		task.logger.Println("Sent run task response to TFC")
-		// Return 200 OK to the original caller
-		w.WriteHeader(http.StatusOK)
+		return nil
 	}
 }
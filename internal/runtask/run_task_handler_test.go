@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+// A panicking stage fails the job and still sends a failed result, instead of crashing the server
+func TestRunStageJobRecoversPanic(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logger := log.New(io.Discard, "", 0)
+	task := &ScaffoldingRunTask{
+		logger: logger,
+		jobs:   NewJobTracker(),
+		config: handler.Configuration{StageTimeout: time.Minute},
+	}
+	// A nil registry panics while the stage runs, outside of any handler
+	request := api.TaskRequest{TaskResultID: "taskrs-1", WorkspaceName: "ws", RunID: "run-1", Stage: api.PostPlan}
+	job, _ := task.jobs.Queue(request)
+
+	var sent *api.TaskResponse
+	runStageJob(task, job, request, func(_ api.TaskRequest, _ *ScaffoldingRunTask, response *api.TaskResponse) error {
+		sent = response
+		return nil
+	})
+
+	if sent == nil || sent.Data.Attributes.Status != api.TaskFailed {
+		t.Fatalf("expected a failed result to be sent, got %+v", sent)
+	}
+	finished, _ := task.jobs.Get(job.TaskResultID)
+	if finished.State != JobFailed {
+		t.Fatalf("expected the job to fail, got %s", finished.State)
+	}
+}
+
+// Requests are rejected when the HMAC key file or secret was removed after the start, verification never falls back to accepting them
+func TestHandleTFCRequestMissingKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(keyFile, []byte(`{"keys":[{"label":"a","key":"key-a"}]}`), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretsDir := filepath.Join(dir, "secrets")
+	if err := os.MkdirAll(secretsDir, 0700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(secretsDir, handler.SecretHmacKey), []byte("key-a"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fromFile, err := handler.LoadKeySet(keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fromSecret := handler.NewKeySet().AddSecret("secret", handler.NewDirectoryProvider(secretsDir), handler.SecretHmacKey)
+	for _, path := range []string{keyFile, filepath.Join(secretsDir, handler.SecretHmacKey)} {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	body := `{"stage":"post_plan","task_result_id":"taskrs-1"}`
+	mac := hmac.New(sha512.New, []byte("key-a"))
+	mac.Write([]byte(body))
+	for name, keys := range map[string]*handler.KeySet{"key file": fromFile, "secret": fromSecret} {
+		task := &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0), config: handler.Configuration{HmacKeys: keys}}
+		handle := handleTFCRequestWrapper(task, nil)
+		for signature, want := range map[string]int{hex.EncodeToString(mac.Sum(nil)): http.StatusInternalServerError, "": http.StatusUnauthorized} {
+			request := httptest.NewRequest(http.MethodPost, "/runtask", strings.NewReader(body))
+			if signature != "" {
+				request.Header.Set(handler.HeaderTaskSignature, signature)
+			}
+			recorder := httptest.NewRecorder()
+			handle(recorder, request)
+			if recorder.Code != want {
+				t.Errorf("%s: expected the request with signature %q to be rejected with %d, got %d", name, signature, want, recorder.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// JobState describes where a background stage job is in its lifecycle.
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobRunning    JobState = "running"
+	JobDelivering JobState = "delivering"
+	JobCompleted  JobState = "completed"
+	JobFailed     JobState = "failed"
+)
+
+// responseFileName holds the final result of the stage, see CachedResponse.
+const responseFileName = "response.json"
+
+// CachedResponse is saved to response.json once a stage has its final result: the response sent to
+// HCP Terraform and the task result it belongs to, so it is only ever resent for that task result.
+type CachedResponse struct {
+	TaskResultID string `json:"task_result_id"`
+	api.TaskResponse
+}
+
+// pendingJobFileName holds the request of a job that was interrupted by a shutdown, so it can be rerun on the next start.
+// It is written to the private directory of the stage, see privateDirectory.
+const pendingJobFileName = "job_pending.json"
+
+// Job tracks a single stage execution that runs after the initial request has been acknowledged.
+type Job struct {
+	TaskResultID  string        `json:"task_result_id"`
+	RunID         string        `json:"run_id"`
+	WorkspaceName string        `json:"workspace_name"`
+	Stage         api.TaskStage `json:"stage"`
+	State         JobState      `json:"state"`
+	Error         string        `json:"error,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	StartedAt     time.Time     `json:"started_at,omitempty"`
+	FinishedAt    time.Time     `json:"finished_at,omitempty"`
+
+	// Internal use only, the stage directory the job state is persisted to
+	directory string
+	// Internal use only, the request is needed to rerun the job after a shutdown
+	request api.TaskRequest
+}
+
+// JobTracker keeps the state of every background job keyed by the task result ID.
+// Each state change is also written to job.json in the stage directory so a job
+// can be inspected on disk while it runs.
+type JobTracker struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	active      sync.WaitGroup
+	fileManager *helper.FileManager
+}
+
+// NewJobTracker creates an empty JobTracker.
+func NewJobTracker() *JobTracker {
+	return &JobTracker{
+		jobs:        map[string]*Job{},
+		fileManager: helper.NewFileManager(),
+	}
+}
+
+// Queue registers a new job for the request in the queued state.
+// If a job for the same task result is already in progress, that job is returned instead
+// and queued is false, so a duplicate delivery never runs the stage twice.
+func (t *JobTracker) Queue(request api.TaskRequest) (job *Job, queued bool) {
+	job = &Job{
+		TaskResultID:  request.TaskResultID,
+		RunID:         request.RunID,
+		WorkspaceName: request.WorkspaceName,
+		Stage:         request.Stage,
+		State:         JobQueued,
+		CreatedAt:     time.Now().UTC(),
+		directory:     request.TaskDirectory,
+		request:       request,
+	}
+
+	t.mu.Lock()
+	if existing, ok := t.jobs[job.TaskResultID]; ok && existing.InProgress() {
+		t.mu.Unlock()
+		return existing, false
+	}
+	t.jobs[job.TaskResultID] = job
+	t.mu.Unlock()
+	t.active.Add(1)
+
+	t.persist(job)
+	return job, true
+}
+
+// InProgress returns true while the job has not completed or failed.
+func (j *Job) InProgress() bool {
+	return j.State == JobQueued || j.State == JobRunning || j.State == JobDelivering
+}
+
+// Running marks the job as started.
+func (t *JobTracker) Running(job *Job) {
+	t.update(job, func(j *Job) {
+		j.State = JobRunning
+		j.StartedAt = time.Now().UTC()
+	})
+}
+
+// Delivering marks the job as done with the stage and sending the result through the outbox.
+func (t *JobTracker) Delivering(job *Job) {
+	t.update(job, func(j *Job) {
+		j.State = JobDelivering
+	})
+}
+
+// Finish marks the job as completed, or failed when err is not nil.
+func (t *JobTracker) Finish(job *Job, err error) {
+	t.update(job, func(j *Job) {
+		j.State = JobCompleted
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+		j.FinishedAt = time.Now().UTC()
+	})
+	t.active.Done()
+}
+
+// Wait blocks until every job has finished or the context is done.
+// It returns false if jobs were still active when the context ended.
+func (t *JobTracker) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// PersistPending writes the request of every job that has not finished its stage yet to
+// job_pending.json, so the stage can be rerun on the next start. Jobs that are already
+// delivering their result don't need this, the outbox has persisted the result.
+// It returns the number of jobs that were persisted.
+func (t *JobTracker) PersistPending() int {
+	t.mu.Lock()
+	var pending []*Job
+	for _, job := range t.jobs {
+		if job.State == JobQueued || job.State == JobRunning {
+			pending = append(pending, job)
+		}
+	}
+	t.mu.Unlock()
+
+	persisted := 0
+	for _, job := range pending {
+		if job.directory == "" {
+			continue
+		}
+		data, err := json.MarshalIndent(job.request, "", "  ")
+		if err != nil {
+			continue
+		}
+		// The request contains the access token, keep it out of the stage directory
+		if err := writePrivateFile(job.directory, pendingJobFileName, data); err != nil {
+			continue
+		}
+		persisted++
+	}
+	return persisted
+}
+
+// LoadPending reads and removes the job_pending.json files under root, returning the requests that should be rerun.
+func (t *JobTracker) LoadPending(root string) ([]api.TaskRequest, error) {
+	paths, err := findStageFiles(root, pendingJobFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []api.TaskRequest
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return requests, fmt.Errorf("failed to read pending job %s: %w", path, err)
+		}
+		var request api.TaskRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			return requests, fmt.Errorf("failed to parse pending job %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return requests, fmt.Errorf("failed to remove pending job %s: %w", path, err)
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// Counts returns the number of tracked jobs in each state.
+func (t *JobTracker) Counts() map[JobState]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := map[JobState]int{}
+	for _, job := range t.jobs {
+		counts[job.State]++
+	}
+	return counts
+}
+
+// LoadCachedResponse returns the response.json saved for the task result by an earlier delivery.
+// The response is only returned when the job.json in the stage directory shows the job for the same
+// task result completed, and response.json was saved for that task result. job.json is written as soon
+// as a job is queued, so a response from a different task result for the same run and stage is never reused.
+func (t *JobTracker) LoadCachedResponse(request api.TaskRequest) (*api.TaskResponse, error) {
+	directory := request.RunTaskDirectory()
+
+	data, err := os.ReadFile(filepath.Join(directory, "job.json"))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse job state: %w", err)
+	}
+	if job.TaskResultID != request.TaskResultID {
+		return nil, fmt.Errorf("job state belongs to task result %s", job.TaskResultID)
+	}
+	if job.State != JobCompleted {
+		return nil, fmt.Errorf("job for task result %s is %s, not %s", job.TaskResultID, job.State, JobCompleted)
+	}
+
+	data, err = os.ReadFile(filepath.Join(directory, responseFileName))
+	if err != nil {
+		return nil, err
+	}
+	var cached CachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("failed to parse cached response: %w", err)
+	}
+	if cached.TaskResultID != request.TaskResultID {
+		return nil, fmt.Errorf("cached response belongs to task result %q", cached.TaskResultID)
+	}
+	return &cached.TaskResponse, nil
+}
+
+// Get returns a copy of the job for the task result ID, if it is known.
+func (t *JobTracker) Get(taskResultID string) (Job, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	job, ok := t.jobs[taskResultID]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Snapshot returns a copy of every tracked job.
+func (t *JobTracker) Snapshot() []Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	jobs := make([]Job, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (t *JobTracker) update(job *Job, fn func(*Job)) {
+	t.mu.Lock()
+	fn(job)
+	t.mu.Unlock()
+
+	t.persist(job)
+}
+
+// persist writes the job state next to the other stage artifacts; failures are not fatal.
+func (t *JobTracker) persist(job *Job) {
+	if job.directory == "" {
+		return
+	}
+
+	t.mu.Lock()
+	snapshot := *job
+	t.mu.Unlock()
+
+	_ = t.fileManager.SaveStructToFile(job.directory, "job.json", snapshot)
+}
+
+// privateDirectory returns the directory next to the stage directory, {workspace}/{run}/.{stage}, that holds
+// the files with the access token: the outbox entry and the pending job. They are kept out of the stage
+// directory, which is the working directory of external checks and listed in their artifacts.
+func privateDirectory(stageDirectory string) string {
+	return filepath.Join(filepath.Dir(stageDirectory), "."+filepath.Base(stageDirectory))
+}
+
+// stageDirectoryOf returns the stage directory of a private directory, see privateDirectory.
+func stageDirectoryOf(privateDir string) string {
+	return filepath.Join(filepath.Dir(privateDir), strings.TrimPrefix(filepath.Base(privateDir), "."))
+}
+
+// writePrivateFile writes the file to the private directory of the stage, readable by the owner only.
+func writePrivateFile(stageDirectory string, name string, data []byte) error {
+	dir := privateDirectory(stageDirectory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), data, 0600)
+}
+
+// findStageFiles returns the path of every file with the given name in the
+// {workspace}/{run}/{stage} directories, and their private directories, under root.
+func findStageFiles(root string, name string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Skip anything we cannot read
+		}
+
+		// Stage directories are three levels below the root, don't descend into extracted configurations
+		rel, _ := filepath.Rel(root, path)
+		if d.IsDir() && rel != "." && strings.Count(rel, string(filepath.Separator)) >= 3 {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == name {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// A second delivery of an in-progress task result reuses the existing job
+func TestJobTrackerQueueDeduplicatesInProgress(t *testing.T) {
+	tracker := NewJobTracker()
+	request := api.TaskRequest{TaskResultID: "taskrs-1"}
+
+	first, queued := tracker.Queue(request)
+	if !queued {
+		t.Fatalf("expected the first delivery to be queued")
+	}
+	second, queued := tracker.Queue(request)
+	if queued || second != first {
+		t.Fatalf("expected the duplicate delivery to reuse the in-progress job")
+	}
+
+	tracker.Finish(first, nil)
+	if _, queued := tracker.Queue(request); !queued {
+		t.Fatalf("expected a finished job to be queued again")
+	}
+}
+
+// The cached response is only returned for the task result that produced it, once its job completed
+func TestJobTrackerLoadCachedResponse(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	previous := api.TaskRequest{TaskResultID: "taskrs-0", WorkspaceName: "ws", RunID: "run-1", Stage: api.PostPlan}
+	request := previous
+	request.TaskResultID = "taskrs-1"
+	if _, err := request.CreateRunTaskDirectoryStructure(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	previous.TaskDirectory = request.TaskDirectory
+	saveResponse := func(taskResultID, message string) {
+		t.Helper()
+		response := CachedResponse{TaskResultID: taskResultID, TaskResponse: *api.NewTaskResponse().SetResult(api.TaskPassed, message)}
+		if err := helper.NewFileManager().SaveStructToFile(request.TaskDirectory, responseFileName, response); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tracker := NewJobTracker()
+	if _, err := tracker.LoadCachedResponse(request); err == nil {
+		t.Fatalf("expected no cached response before the stage ran")
+	}
+
+	// An earlier task result for the same run and stage completed
+	job, _ := tracker.Queue(previous)
+	tracker.Finish(job, nil)
+	saveResponse(previous.TaskResultID, "previous")
+
+	// job.json already belongs to the new task result once it is queued, its response does not exist yet
+	job, _ = tracker.Queue(request)
+	if _, err := tracker.LoadCachedResponse(request); err == nil {
+		t.Fatalf("expected no cached response while the job is queued")
+	}
+	tracker.Finish(job, nil)
+	if _, err := tracker.LoadCachedResponse(request); err == nil {
+		t.Fatalf("expected the response of the previous task result to be ignored")
+	}
+
+	saveResponse(request.TaskResultID, "cached")
+	cached, err := tracker.LoadCachedResponse(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cached.Data.Attributes.Message != "cached" {
+		t.Fatalf("unexpected cached response: %+v", cached.Data.Attributes)
+	}
+	if _, err := tracker.LoadCachedResponse(previous); err == nil {
+		t.Fatalf("expected the cached response to be ignored for a different task result")
+	}
+
+	// A failed job is run again instead of resending its response
+	job, _ = tracker.Queue(request)
+	tracker.Finish(job, errors.New("callback failed"))
+	if _, err := tracker.LoadCachedResponse(request); err == nil {
+		t.Fatalf("expected no cached response for a failed job")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+const (
+	// outboxFileName is written to the private directory of the stage while a callback is waiting to be delivered.
+	outboxFileName = "callback_outbox.json"
+
+	defaultCallbackMaxAttempts = 8
+	defaultCallbackBaseDelay   = 1 * time.Second
+	defaultCallbackMaxDelay    = 1 * time.Minute
+	// A result delivered after handler.TaskResultDeadline is no longer accepted, the task has already errored.
+	defaultCallbackMaxAge = handler.TaskResultDeadline
+)
+
+// errPermanentCallbackFailure marks a response from HCP Terraform that will not succeed on retry.
+var errPermanentCallbackFailure = errors.New("permanent callback failure")
+
+// OutboxEntry is a task result waiting to be delivered to HCP Terraform.
+// The access token is stored so the entry can be delivered after a restart.
+type OutboxEntry struct {
+	TaskResultID  string          `json:"task_result_id"`
+	CallbackURL   string          `json:"callback_url"`
+	AccessToken   string          `json:"access_token"`
+	Body          json.RawMessage `json:"body"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+
+	// Internal use only, the stage directory the entry is persisted for, see privateDirectory
+	directory string
+}
+
+// Outbox persists task results to disk before sending them, retries failed
+// deliveries with exponential backoff and jitter, and resumes pending deliveries after a restart.
+type Outbox struct {
+	logger      *log.Logger
+	client      *helper.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxAge      time.Duration
+}
+
+// NewOutbox creates an Outbox with the default retry settings.
+func NewOutbox(logger *log.Logger, client *helper.Client) *Outbox {
+	return &Outbox{
+		logger:      logger,
+		client:      client,
+		maxAttempts: defaultCallbackMaxAttempts,
+		baseDelay:   defaultCallbackBaseDelay,
+		maxDelay:    defaultCallbackMaxDelay,
+		maxAge:      defaultCallbackMaxAge,
+	}
+}
+
+// Enqueue writes the task response for the request to the outbox file in the stage directory.
+func (o *Outbox) Enqueue(request api.TaskRequest, response *api.TaskResponse) (*OutboxEntry, error) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal callback response: %w", err)
+	}
+
+	now := time.Now().UTC()
+	entry := &OutboxEntry{
+		TaskResultID:  request.TaskResultID,
+		CallbackURL:   request.TaskResultCallbackURL,
+		AccessToken:   request.AccessToken,
+		Body:          body,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		directory:     request.TaskDirectory,
+	}
+
+	if err := o.save(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Deliver sends the entry until it succeeds, fails permanently, runs out of attempts, or is older
+// than the maximum age. The outbox file is removed once the entry no longer needs to be delivered.
+func (o *Outbox) Deliver(entry *OutboxEntry) error {
+	for {
+		if wait := time.Until(entry.NextAttemptAt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// HCP Terraform has already errored the task, like Resume the entry is dropped
+		if age := time.Since(entry.CreatedAt); age > o.maxAge {
+			err := fmt.Errorf("%w: task result expired after %s", errPermanentCallbackFailure, age.Round(time.Second))
+			o.logger.Printf("Giving up on task result %s after %d attempt(s): %v\n", entry.TaskResultID, entry.Attempts, err)
+			o.remove(entry)
+			return err
+		}
+
+		entry.Attempts++
+		err := o.send(entry)
+		if err == nil {
+			o.logger.Printf("Delivered task result %s after %d attempt(s)\n", entry.TaskResultID, entry.Attempts)
+			o.remove(entry)
+			return nil
+		}
+
+		entry.LastError = err.Error()
+		if errors.Is(err, errPermanentCallbackFailure) || entry.Attempts >= o.maxAttempts {
+			o.logger.Printf("Giving up on task result %s after %d attempt(s): %v\n", entry.TaskResultID, entry.Attempts, err)
+			o.remove(entry)
+			return err
+		}
+
+		delay := backoff(entry.Attempts, o.baseDelay, o.maxDelay)
+		entry.NextAttemptAt = time.Now().UTC().Add(delay)
+		o.logger.Printf("Callback for task result %s failed (attempt %d), retrying in %s: %v\n", entry.TaskResultID, entry.Attempts, delay.Round(time.Millisecond), err)
+		if err := o.save(entry); err != nil {
+			o.logger.Printf("Warning: Failed to update outbox entry for task result %s: %v\n", entry.TaskResultID, err)
+		}
+	}
+}
+
+// Resume finds outbox files left behind under the root directory and delivers them in the background.
+// Entries older than the maximum age are dropped, HCP Terraform has already given up on them.
+func (o *Outbox) Resume(root string) int {
+	entries, err := o.load(root)
+	if err != nil {
+		o.logger.Println("Warning: Failed to scan for pending callbacks:", err)
+	}
+
+	resumed := 0
+	for _, entry := range entries {
+		if time.Since(entry.CreatedAt) > o.maxAge {
+			o.logger.Printf("Dropping expired callback for task result %s created at %s\n", entry.TaskResultID, entry.CreatedAt.Format(time.RFC3339))
+			o.remove(entry)
+			continue
+		}
+
+		o.logger.Printf("Resuming callback for task result %s (%d previous attempt(s))\n", entry.TaskResultID, entry.Attempts)
+		resumed++
+		go func(entry *OutboxEntry) {
+			_ = o.Deliver(entry)
+		}(entry)
+	}
+	return resumed
+}
+
+// send performs a single PATCH of the entry; any non-2xx status is a failure.
+func (o *Outbox) send(entry *OutboxEntry) error {
+	// Delivery outlives the stage deadline, each attempt is bounded by the client timeouts instead
+	resp, err := o.client.SendGenericHttpRequest(context.Background(), entry.CallbackURL, http.MethodPatch, entry.AccessToken, entry.Body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	// Client errors will not change on retry, except for timeouts and rate limiting
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: unexpected status code: %d", errPermanentCallbackFailure, resp.StatusCode)
+	}
+	return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
+
+// save writes the entry to the private directory of the stage since it contains the access token.
+func (o *Outbox) save(entry *OutboxEntry) error {
+	if entry.directory == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox entry: %w", err)
+	}
+
+	if err := writePrivateFile(entry.directory, outboxFileName, data); err != nil {
+		return fmt.Errorf("failed to write outbox entry for task result %s: %w", entry.TaskResultID, err)
+	}
+	return nil
+}
+
+func (o *Outbox) remove(entry *OutboxEntry) {
+	if entry.directory == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(privateDirectory(entry.directory), outboxFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		o.logger.Printf("Warning: Failed to remove outbox entry for task result %s: %v\n", entry.TaskResultID, err)
+	}
+}
+
+// load reads the outbox files from the private stage directories under root.
+func (o *Outbox) load(root string) ([]*OutboxEntry, error) {
+	paths, err := findStageFiles(root, outboxFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*OutboxEntry
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			o.logger.Printf("Warning: Failed to read outbox entry %s: %v\n", path, err)
+			continue
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			o.logger.Printf("Warning: Failed to parse outbox entry %s: %v\n", path, err)
+			continue
+		}
+		entry.directory = stageDirectoryOf(filepath.Dir(path))
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// backoff returns the delay before the next attempt using exponential backoff with jitter.
+func backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// Spread retries between half and all of the computed delay so they don't arrive in lockstep
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+func newTestOutbox() *Outbox {
+	o := NewOutbox(log.New(io.Discard, "", 0), helper.NewClient())
+	o.baseDelay = time.Millisecond
+	o.maxDelay = 5 * time.Millisecond
+	return o
+}
+
+// Retries non-2xx responses and removes the outbox file once delivered
+func TestOutboxDeliverRetriesUntilAccepted(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	o := newTestOutbox()
+	entry, err := o.Enqueue(api.TaskRequest{TaskResultID: "taskrs-1", TaskResultCallbackURL: srv.URL, TaskDirectory: dir}, api.NewTaskResponse())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(privateDirectory(dir), outboxFileName)); err != nil {
+		t.Fatalf("expected outbox file to exist: %v", err)
+	}
+
+	if err := o.Deliver(entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", entry.Attempts)
+	}
+	if _, err := os.Stat(filepath.Join(privateDirectory(dir), outboxFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected outbox file to be removed, got %v", err)
+	}
+}
+
+// Client errors other than 408/429 are not retried
+func TestOutboxDeliverPermanentFailure(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer srv.Close()
+
+	o := newTestOutbox()
+	entry, err := o.Enqueue(api.TaskRequest{TaskResultCallbackURL: srv.URL}, api.NewTaskResponse())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.Deliver(entry); err == nil {
+		t.Fatalf("expected an error for a 422 response")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d", calls.Load())
+	}
+}
+
+// An entry older than the maximum age is dropped instead of retried
+func TestOutboxDeliverExpired(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	o := newTestOutbox()
+	// Each retry waits at least 5ms, so the entry expires before the eighth attempt
+	o.baseDelay, o.maxDelay, o.maxAge = 10*time.Millisecond, 10*time.Millisecond, 25*time.Millisecond
+	entry, err := o.Enqueue(api.TaskRequest{TaskResultID: "taskrs-1", TaskResultCallbackURL: srv.URL, TaskDirectory: dir}, api.NewTaskResponse())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.Deliver(entry); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expected the entry to expire, got %v", err)
+	}
+	if attempts := calls.Load(); attempts == 0 || int(attempts) >= o.maxAttempts {
+		t.Fatalf("expected the retries to stop before the maximum attempts, got %d", attempts)
+	}
+	if _, err := os.Stat(filepath.Join(privateDirectory(dir), outboxFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected outbox file to be removed, got %v", err)
+	}
+}
+
+// Pending entries on disk are picked up and delivered after a restart
+func TestOutboxResume(t *testing.T) {
+	delivered := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		delivered <- struct{}{}
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	stageDir := filepath.Join(root, "workspace", "run-1", "2_post_plan")
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := newTestOutbox().Enqueue(api.TaskRequest{TaskResultCallbackURL: srv.URL, TaskDirectory: stageDir}, api.NewTaskResponse()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resumed := newTestOutbox().Resume(root); resumed != 1 {
+		t.Fatalf("expected 1 resumed entry, got %d", resumed)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for resumed delivery")
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	for attempt := 1; attempt < 20; attempt++ {
+		d := backoff(attempt, time.Second, 10*time.Second)
+		if d < 500*time.Millisecond || d > 10*time.Second {
+			t.Fatalf("attempt %d: delay %s out of bounds", attempt, d)
+		}
+	}
+}
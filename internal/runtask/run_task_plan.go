@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// PlanSummaryOrder is the order the plan summary is registered with, after the data capture
+// has saved the plan JSON.
+const PlanSummaryOrder = 10
+
+// maxDestructiveOutcomes limits the per-resource outcomes, the summary still counts every change.
+const maxDestructiveOutcomes = 50
+
+// planJSONFile is the file the plan-json collector saves the plan to.
+const planJSONFile = "plan_json.json"
+
+// planSummaryHandler is the StageHandler that reads the saved plan JSON in post-plan, reports
+// a summary of the resource changes, and an outcome for every resource that is deleted or replaced.
+type planSummaryHandler struct {
+	task *ScaffoldingRunTask
+}
+
+// Name returns the handler name.
+func (h *planSummaryHandler) Name() string { return "plan-summary" }
+
+// Stages returns the stages the handler runs in.
+func (h *planSummaryHandler) Stages() []api.TaskStage { return []api.TaskStage{api.PostPlan} }
+
+// Handle streams the resource changes of the plan JSON, the plan is never loaded into memory as a whole.
+// Nothing is reported if the plan JSON was not saved, the data capture has already reported why.
+func (h *planSummaryHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	path := filepath.Join(request.RunTaskDirectory(), planJSONFile)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		h.task.logger.Println("No plan JSON saved, skipping the plan summary:", path)
+		return nil, nil
+	}
+
+	var summary api.ChangeSummary
+	var destructive []api.ResourceChange
+	err := helper.DecodeResourceChangesFile(path, func(change api.ResourceChange) error {
+		summary.Add(change)
+		if change.Change.Actions.IsDestructive() {
+			destructive = append(destructive, change)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the plan JSON: %w", err)
+	}
+
+	ntr := api.NewTaskResponse()
+	label, level := "no changes", api.TagLevelNone
+	switch {
+	case len(destructive) > 0:
+		label, level = "destructive", api.TagLevelWarning
+	case summary.HasChanges():
+		label, level = "changes", api.TagLevelInfo
+	}
+	ntr.AddOutcome("plan-summary", "Plan: "+summary.String(), summaryMarkdown(summary), "", label, level)
+
+	for i, change := range destructive {
+		if i == maxDestructiveOutcomes {
+			ntr.AddOutcome("plan-destructive-more", fmt.Sprintf("%d more resource(s) deleted or replaced", len(destructive)-i),
+				"Only the first "+fmt.Sprint(maxDestructiveOutcomes)+" destructive changes are listed, see `"+planJSONFile+"` for the rest.", "", "destructive", api.TagLevelWarning)
+			break
+		}
+		verb := destructiveVerb(change)
+		ntr.AddOutcome("plan-"+verb+"-"+change.Address, change.Address+" will be "+verb, changeMarkdown(change), "", verb, api.TagLevelWarning)
+	}
+
+	return ntr.SetResult(api.TaskPassed, "Plan: "+summary.String()), nil
+}
+
+// destructiveVerb describes what happens to the resource of a destructive change.
+func destructiveVerb(change api.ResourceChange) string {
+	if change.Change.Actions.IsReplace() {
+		return "replaced"
+	}
+	return "deleted"
+}
+
+// summaryMarkdown renders the change counts as a markdown table.
+func summaryMarkdown(summary api.ChangeSummary) string {
+	var b strings.Builder
+	b.WriteString("| Change | Resources |\n|---|---:|\n")
+	for _, row := range []struct {
+		name  string
+		count int
+	}{
+		{"Create", summary.Create},
+		{"Update", summary.Update},
+		{"Delete", summary.Delete},
+		{"Replace", summary.Replace},
+		{"Import", summary.Import},
+		{"Forget", summary.Forget},
+		{"Read", summary.Read},
+		{"No-op", summary.NoOp},
+	} {
+		fmt.Fprintf(&b, "| %s | %d |\n", row.name, row.count)
+	}
+	return b.String()
+}
+
+// changeMarkdown renders the details of a destructive change as markdown.
+func changeMarkdown(change api.ResourceChange) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Resource:** `%s`\n\n", change.Address)
+	fmt.Fprintf(&b, "**Actions:** %s\n\n", change.Change.Actions)
+	if change.ActionReason != "" {
+		fmt.Fprintf(&b, "**Reason:** `%s`\n\n", change.ActionReason)
+	}
+	if change.ProviderName != "" {
+		fmt.Fprintf(&b, "**Provider:** `%s`\n\n", change.ProviderName)
+	}
+	if change.Deposed != "" {
+		fmt.Fprintf(&b, "**Deposed object:** `%s`\n\n", change.Deposed)
+	}
+	if len(change.Change.ReplacePaths) > 0 {
+		paths := make([]string, len(change.Change.ReplacePaths))
+		for i, p := range change.Change.ReplacePaths {
+			paths[i] = "`" + string(p) + "`"
+		}
+		fmt.Fprintf(&b, "**Replaced because of:** %s\n\n", strings.Join(paths, ", "))
+	}
+	return strings.TrimSpace(b.String())
+}
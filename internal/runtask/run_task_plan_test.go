@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+const destructivePlan = `{"format_version": "1.2", "resource_changes": [
+	{"address": "null_resource.new", "change": {"actions": ["create"]}},
+	{"address": "null_resource.old", "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["delete"]}, "action_reason": "delete_because_no_resource_config"},
+	{"address": "null_resource.swap", "change": {"actions": ["delete", "create"], "replace_paths": [["triggers"]]}},
+	{"address": "null_resource.same", "change": {"actions": ["no-op"]}}
+]}`
+
+func newPlanSummaryHandler(t *testing.T, plan string) (*planSummaryHandler, api.TaskRequest) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	request := api.TaskRequest{WorkspaceName: "ws", RunID: "run-123", Stage: api.PostPlan}
+	if plan != "" {
+		dir, err := request.CreateRunTaskDirectoryStructure()
+		if err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, planJSONFile), []byte(plan), 0600); err != nil {
+			t.Fatalf("failed to write plan: %v", err)
+		}
+	}
+	return &planSummaryHandler{task: &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0)}}, request
+}
+
+// Post-plan reports the change counts and an outcome for every deleted or replaced resource
+func TestPlanSummaryHandler(t *testing.T) {
+	h, request := newPlanSummaryHandler(t, destructivePlan)
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if len(outcomes) != 3 {
+		t.Fatalf("expected a summary and two destructive outcomes, got %+v", outcomes)
+	}
+
+	summary := outcomes[0].Attributes
+	if summary.OutcomeID != "plan-summary" || summary.Description != "Plan: 1 to add, 0 to change, 1 to destroy, 1 to replace" {
+		t.Fatalf("unexpected summary outcome: %+v", summary)
+	}
+	if summary.Tags.Status[0].Level != api.TagLevelWarning || !strings.Contains(summary.Body, "| Replace | 1 |") {
+		t.Fatalf("unexpected summary outcome: %+v", summary)
+	}
+
+	deleted := outcomes[1].Attributes
+	if deleted.OutcomeID != "plan-deleted-null_resource.old" || !strings.Contains(deleted.Body, "**Reason:** `delete_because_no_resource_config`") {
+		t.Fatalf("unexpected delete outcome: %+v", deleted)
+	}
+	replaced := outcomes[2].Attributes
+	if replaced.OutcomeID != "plan-replaced-null_resource.swap" || !strings.Contains(replaced.Body, "`[\"triggers\"]`") {
+		t.Fatalf("unexpected replace outcome: %+v", replaced)
+	}
+
+	// Destructive changes are warnings, they do not fail the run
+	if response.Data.Attributes.Status != api.TaskPassed {
+		t.Fatalf("expected the summary to pass, got %s", response.Data.Attributes.Status)
+	}
+}
+
+// Without a saved plan JSON the handler reports nothing
+func TestPlanSummaryHandlerWithoutPlan(t *testing.T) {
+	h, request := newPlanSummaryHandler(t, "")
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil || response != nil {
+		t.Fatalf("expected no response, got %+v, %v", response, err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+// ErrPoolSaturated is returned by Submit when the queue limit has been reached.
+var ErrPoolSaturated = errors.New("worker pool queue is full")
+
+// WorkerPool runs stage jobs on a fixed number of workers.
+// Work waits in one queue per organization and workers take from the queues in turn,
+// so one organization planning many workspaces at once cannot starve the others.
+type WorkerPool struct {
+	mu         sync.Mutex
+	available  *sync.Cond
+	workers    int
+	queueLimit int
+	queues     map[string][]poolItem
+	order      []string // organizations with queued work, in round-robin order
+	queued     int
+	active     int
+
+	// Statistics exposed through Stats
+	processed int
+	rejected  int
+	totalWait time.Duration
+	maxWait   time.Duration
+	lastWait  time.Duration
+}
+
+type poolItem struct {
+	enqueuedAt time.Time
+	work       func()
+}
+
+// PoolStats is a point-in-time view of the WorkerPool used to size the service.
+type PoolStats struct {
+	Workers         int            `json:"workers"`
+	ActiveWorkers   int            `json:"active_workers"`
+	QueueLimit      int            `json:"queue_limit"`
+	QueueDepth      int            `json:"queue_depth"`
+	QueueDepthByOrg map[string]int `json:"queue_depth_by_organization"`
+	Processed       int            `json:"processed"`
+	Rejected        int            `json:"rejected"`
+	AverageWait     string         `json:"average_wait"`
+	MaxWait         string         `json:"max_wait"`
+	LastWait        string         `json:"last_wait"`
+}
+
+// NewWorkerPool creates a WorkerPool and starts its workers.
+func NewWorkerPool(workers int, queueLimit int) *WorkerPool {
+	if workers < 1 {
+		workers = handler.DefaultWorkers
+	}
+	if queueLimit < 1 {
+		queueLimit = handler.DefaultQueueLimit
+	}
+
+	p := &WorkerPool{
+		workers:    workers,
+		queueLimit: queueLimit,
+		queues:     map[string][]poolItem{},
+	}
+	p.available = sync.NewCond(&p.mu)
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit queues the work for the organization, or returns ErrPoolSaturated if the queue is full.
+func (p *WorkerPool) Submit(organization string, work func()) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.queued >= p.queueLimit {
+		p.rejected++
+		return ErrPoolSaturated
+	}
+
+	if len(p.queues[organization]) == 0 {
+		p.order = append(p.order, organization)
+	}
+	p.queues[organization] = append(p.queues[organization], poolItem{enqueuedAt: time.Now(), work: work})
+	p.queued++
+	p.available.Signal()
+	return nil
+}
+
+// Stats returns the current queue depth, worker usage and wait times.
+func (p *WorkerPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	byOrg := make(map[string]int, len(p.queues))
+	for org, items := range p.queues {
+		if len(items) > 0 {
+			byOrg[org] = len(items)
+		}
+	}
+
+	var average time.Duration
+	if p.processed > 0 {
+		average = p.totalWait / time.Duration(p.processed)
+	}
+
+	return PoolStats{
+		Workers:         p.workers,
+		ActiveWorkers:   p.active,
+		QueueLimit:      p.queueLimit,
+		QueueDepth:      p.queued,
+		QueueDepthByOrg: byOrg,
+		Processed:       p.processed,
+		Rejected:        p.rejected,
+		AverageWait:     average.Round(time.Millisecond).String(),
+		MaxWait:         p.maxWait.Round(time.Millisecond).String(),
+		LastWait:        p.lastWait.Round(time.Millisecond).String(),
+	}
+}
+
+func (p *WorkerPool) worker() {
+	for {
+		item := p.next()
+		p.run(item)
+
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+	}
+}
+
+// run calls the work of an item. A panic is recovered so the worker keeps serving the queue,
+// the work is expected to report its own failure (see runStageJob).
+func (p *WorkerPool) run(item poolItem) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered panic in worker pool: %v\n%s", r, debug.Stack())
+		}
+	}()
+	item.work()
+}
+
+// next blocks until work is queued and takes it from the next organization in turn.
+func (p *WorkerPool) next() poolItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.queued == 0 {
+		p.available.Wait()
+	}
+
+	org := p.order[0]
+	item := p.queues[org][0]
+	p.queues[org] = p.queues[org][1:]
+	p.queued--
+
+	// Move the organization to the back of the line, or drop it when it has nothing left
+	p.order = p.order[1:]
+	if len(p.queues[org]) > 0 {
+		p.order = append(p.order, org)
+	} else {
+		delete(p.queues, org)
+	}
+
+	wait := time.Since(item.enqueuedAt)
+	p.processed++
+	p.totalWait += wait
+	p.lastWait = wait
+	if wait > p.maxWait {
+		p.maxWait = wait
+	}
+	p.active++
+	return item
+}
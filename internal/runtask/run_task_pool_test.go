@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Work is taken from each organization in turn, not in submission order
+func TestWorkerPoolOrganizationFairness(t *testing.T) {
+	p := NewWorkerPool(1, 10)
+
+	// Hold the only worker so the queue fills up before anything runs
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := p.Submit("blocker", func() { close(started); <-release }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	submit := func(org string) {
+		wg.Add(1)
+		if err := p.Submit(org, func() {
+			mu.Lock()
+			order = append(order, org)
+			mu.Unlock()
+			wg.Done()
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	submit("org-a")
+	submit("org-a")
+	submit("org-a")
+	submit("org-b")
+
+	if got := p.Stats().QueueDepthByOrg["org-a"]; got != 3 {
+		t.Fatalf("expected 3 queued for org-a, got %d", got)
+	}
+
+	close(release)
+	wg.Wait()
+
+	want := []string{"org-a", "org-b", "org-a", "org-a"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("unexpected execution order: %v", order)
+		}
+	}
+}
+
+// Submissions beyond the queue limit are rejected
+func TestWorkerPoolSaturation(t *testing.T) {
+	p := NewWorkerPool(1, 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	_ = p.Submit("org", func() { close(started); <-release })
+	<-started
+	defer close(release)
+
+	if err := p.Submit("org", func() {}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.Submit("org", func() {}); !errors.Is(err, ErrPoolSaturated) {
+		t.Fatalf("expected ErrPoolSaturated, got %v", err)
+	}
+	if stats := p.Stats(); stats.Rejected != 1 || stats.QueueDepth != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// A panicking job does not stop the worker from running the next one
+func TestWorkerPoolRecoversPanic(t *testing.T) {
+	p := NewWorkerPool(1, 10)
+
+	done := make(chan struct{})
+	_ = p.Submit("org", func() { panic("boom") })
+	_ = p.Submit("org", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the worker to keep running after a panic")
+	}
+}
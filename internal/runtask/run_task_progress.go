@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+// defaultProgressInterval is the minimum time between two running updates, well within handler.TaskResultDeadline.
+const defaultProgressInterval = handler.TaskResultDeadline / 20
+
+// progressSendTimeout bounds a single running update, the stage waits for it while reporting.
+const progressSendTimeout = 10 * time.Second
+
+// ProgressReporter sends intermediate "running" task results to HCP Terraform while a stage executes.
+// Updates are throttled, and once Finish is called no further updates are sent so the final
+// passed/failed result is always the last one HCP Terraform receives.
+// A nil ProgressReporter is valid and never sends anything.
+type ProgressReporter struct {
+	mu          sync.Mutex
+	logger      *log.Logger
+	client      *helper.Client
+	request     api.TaskRequest
+	minInterval time.Duration
+	lastSent    time.Time
+	finished    bool
+}
+
+// NewProgressReporter creates a ProgressReporter for the task request.
+func NewProgressReporter(logger *log.Logger, client *helper.Client, request api.TaskRequest) *ProgressReporter {
+	return &ProgressReporter{
+		logger:      logger,
+		client:      client,
+		request:     request,
+		minInterval: defaultProgressInterval,
+	}
+}
+
+// Report sends a running update with the message and the outcomes collected so far in response.
+// It returns false when the update was throttled, the reporter is finished, or the update failed.
+// Progress updates are best effort, a failure never fails the stage.
+func (p *ProgressReporter) Report(message string, response *api.TaskResponse) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.finished || (!p.lastSent.IsZero() && time.Since(p.lastSent) < p.minInterval) {
+		return false
+	}
+
+	// Send a copy so later outcomes added by the stage don't race with the update
+	update := api.NewTaskResponse().SetResult(api.TaskRunning, message)
+	if response != nil && response.Data.Relationships != nil {
+		update.Data.Relationships.Outcomes.Data = append(update.Data.Relationships.Outcomes.Data, response.Data.Relationships.Outcomes.Data...)
+	}
+
+	if err := p.send(update); err != nil {
+		p.logger.Printf("Warning: Failed to send progress update for task result %s: %v\n", p.request.TaskResultID, err)
+		return false
+	}
+
+	p.lastSent = time.Now()
+	p.logger.Printf("Sent progress update for task result %s: %s\n", p.request.TaskResultID, message)
+	return true
+}
+
+// Finish stops any further updates. It waits for an update that is in flight,
+// so the caller can safely send the final result afterwards.
+func (p *ProgressReporter) Finish() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.finished = true
+	p.mu.Unlock()
+}
+
+func (p *ProgressReporter) send(update *api.TaskResponse) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal progress update: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), progressSendTimeout)
+	defer cancel()
+
+	resp, err := p.client.SendGenericHttpRequest(ctx, p.request.TaskResultCallbackURL, http.MethodPatch, p.request.AccessToken, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// StageHandler is a piece of run task logic that runs during one or more stages.
+// Register handlers on the StageRegistry to add logic without changing the scaffolding.
+type StageHandler interface {
+	// Name identifies the handler in logs and in outcome IDs when they collide.
+	Name() string
+	// Stages returns the stages the handler runs in.
+	Stages() []api.TaskStage
+	// Handle runs the handler and returns its outcomes and result.
+	// The outcomes of every handler are composed into the response sent to HCP Terraform.
+	// The context carries the stage deadline, handlers should return once it is done.
+	Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error)
+}
+
+// StageHandlerFunc adapts a function to the StageHandler interface.
+type StageHandlerFunc struct {
+	HandlerName   string
+	HandlerStages []api.TaskStage
+	Func          func(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error)
+}
+
+// Name returns the handler name.
+func (f StageHandlerFunc) Name() string { return f.HandlerName }
+
+// Stages returns the stages the handler runs in.
+func (f StageHandlerFunc) Stages() []api.TaskStage { return f.HandlerStages }
+
+// Handle calls the function.
+func (f StageHandlerFunc) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	return f.Func(ctx, request, progress)
+}
+
+// AllStages is every stage a run task can be called in.
+var AllStages = []api.TaskStage{api.PrePlan, api.PostPlan, api.PreApply, api.PostApply}
+
+// StageRegistry holds the handlers for each stage and runs them in order.
+type StageRegistry struct {
+	mu       sync.RWMutex
+	handlers []registeredHandler
+	logger   *log.Logger
+}
+
+type registeredHandler struct {
+	handler StageHandler
+	order   int
+}
+
+// NewStageRegistry creates an empty StageRegistry.
+func NewStageRegistry(logger *log.Logger) *StageRegistry {
+	return &StageRegistry{logger: logger}
+}
+
+// Register adds a handler. Handlers run in ascending order, handlers with the same
+// order run in the order they were registered.
+func (s *StageRegistry) Register(handler StageHandler, order int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers = append(s.handlers, registeredHandler{handler: handler, order: order})
+	slices.SortStableFunc(s.handlers, func(a, b registeredHandler) int {
+		return a.order - b.order
+	})
+}
+
+// HandlersFor returns the handlers registered for the stage, in the order they run.
+func (s *StageRegistry) HandlersFor(stage api.TaskStage) []StageHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var handlers []StageHandler
+	for _, h := range s.handlers {
+		if slices.Contains(h.handler.Stages(), stage) {
+			handlers = append(handlers, h.handler)
+		}
+	}
+	return handlers
+}
+
+// Run executes every handler for the request stage and composes their responses.
+// The stage fails if any handler fails, returns an error, panics, or adds an error outcome.
+// Handlers that have not started when the context is done are reported as timed out.
+func (s *StageRegistry) Run(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) *api.TaskResponse {
+	if !slices.Contains(AllStages, request.Stage) {
+		s.logger.Println("Run task is running in an unknown stage:", request.Stage)
+		return api.NewTaskResponse().SetResult(api.TaskFailed, "Run Task is running in an unknown stage: "+string(request.Stage))
+	}
+
+	handlers := s.HandlersFor(request.Stage)
+	composed := api.NewTaskResponse()
+	if len(handlers) == 0 {
+		return composed.SetResult(api.TaskPassed, "No handlers registered for stage "+string(request.Stage))
+	}
+
+	passed := true
+	var messages []string
+	outcomeIDs := map[string]bool{}
+	for _, handler := range handlers {
+		if ctx.Err() != nil {
+			s.logger.Printf("Skipping handler %s for stage %s: %v\n", handler.Name(), request.Stage, ctx.Err())
+			passed = false
+			composed.AddOutcome(handler.Name()+"-timed-out", "Handler "+handler.Name()+" did not run before the stage deadline", ctx.Err().Error(), "", "failed", api.TagLevelError)
+			messages = append(messages, handler.Name()+" timed out")
+			continue
+		}
+
+		s.logger.Printf("Running handler %s for stage %s\n", handler.Name(), request.Stage)
+		response, err := s.handle(ctx, handler, request, progress)
+		if err != nil {
+			s.logger.Printf("Error occurred in handler %s: %v\n", handler.Name(), err)
+			passed = false
+			composed.AddOutcome(handler.Name()+"-error", "Handler "+handler.Name()+" had an unexpected error", err.Error(), "", "failed", api.TagLevelError)
+			messages = append(messages, handler.Name()+" had an unexpected error: "+err.Error())
+		}
+		if response == nil {
+			continue
+		}
+
+		for _, outcome := range response.Data.Relationships.Outcomes.Data {
+			// HCP Terraform rejects the whole result for one invalid tag, so only the broken outcome is replaced
+			if err := outcome.Validate(); err != nil {
+				s.logger.Printf("Handler %s returned an invalid outcome: %v\n", handler.Name(), err)
+				passed = false
+				id := outcome.Attributes.OutcomeID
+				if id == "" {
+					id = handler.Name() + "-invalid-outcome"
+				}
+				outcome = *api.NewOutcome(id, "Handler "+handler.Name()+" returned an invalid outcome").
+					WithBody(err.Error()).
+					AddStatusTag("failed", api.TagLevelError)
+			}
+			// Keep outcome IDs unique when two handlers use the same ID
+			if outcomeIDs[outcome.Attributes.OutcomeID] {
+				outcome.Attributes.OutcomeID = handler.Name() + "-" + outcome.Attributes.OutcomeID
+			}
+			outcomeIDs[outcome.Attributes.OutcomeID] = true
+			composed.Data.Relationships.Outcomes.Data = append(composed.Data.Relationships.Outcomes.Data, outcome)
+		}
+
+		if response.Data.Attributes.Status == api.TaskFailed || !response.IsPassed() {
+			passed = false
+		}
+		if err == nil && response.Data.Attributes.Message != "" {
+			messages = append(messages, response.Data.Attributes.Message)
+		}
+		if composed.Data.Attributes.URL == "" {
+			composed.WithUrl(response.Data.Attributes.URL)
+		}
+	}
+
+	status := api.TaskPassed
+	if !passed {
+		status = api.TaskFailed
+	}
+	message := strings.Join(messages, "; ")
+	if message == "" {
+		message = fmt.Sprintf("%d handler(s) ran for stage %s", len(handlers), request.Stage)
+	}
+	return composed.SetResult(status, message)
+}
+
+// handle runs one handler and turns a panic into an error, so a broken handler is reported
+// like any other handler error and does not stop the handlers after it.
+func (s *StageRegistry) handle(ctx context.Context, handler StageHandler, request api.TaskRequest, progress *ProgressReporter) (response *api.TaskResponse, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.logger.Printf("Handler %s panicked: %v\n%s", handler.Name(), p, debug.Stack())
+			response, err = nil, fmt.Errorf("handler panicked: %v", p)
+		}
+	}()
+	return handler.Handle(ctx, request, progress)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+func testHandler(name string, calls *[]string, outcomeID string, status api.TaskStatus, err error) StageHandler {
+	return StageHandlerFunc{
+		HandlerName:   name,
+		HandlerStages: []api.TaskStage{api.PostPlan},
+		Func: func(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+			*calls = append(*calls, name)
+			if err != nil {
+				return nil, err
+			}
+			return api.NewTaskResponse().
+				AddOutcome(outcomeID, name+" ran", "", "", "success", api.TagLevelNone).
+				SetResult(status, name+" done"), nil
+		},
+	}
+}
+
+// Handlers run in order and their outcomes are composed into one response
+func TestStageRegistryComposesHandlersInOrder(t *testing.T) {
+	registry := NewStageRegistry(log.New(io.Discard, "", 0))
+	var calls []string
+	registry.Register(testHandler("second", &calls, "check", api.TaskPassed, nil), 10)
+	registry.Register(testHandler("first", &calls, "check", api.TaskPassed, nil), -10)
+	registry.Register(testHandler("third", &calls, "other", api.TaskPassed, nil), 10)
+
+	response := registry.Run(context.Background(), api.TaskRequest{Stage: api.PostPlan}, nil)
+
+	if len(calls) != 3 || calls[0] != "first" || calls[1] != "second" || calls[2] != "third" {
+		t.Fatalf("unexpected handler order: %v", calls)
+	}
+	if response.Data.Attributes.Status != api.TaskPassed {
+		t.Fatalf("expected passed, got %s", response.Data.Attributes.Status)
+	}
+
+	outcomes := response.Data.Relationships.Outcomes.Data
+	want := []string{"check", "second-check", "other"}
+	if len(outcomes) != len(want) {
+		t.Fatalf("expected %d outcomes, got %d", len(want), len(outcomes))
+	}
+	for i, id := range want {
+		if outcomes[i].Attributes.OutcomeID != id {
+			t.Fatalf("expected outcome %d to be %s, got %s", i, id, outcomes[i].Attributes.OutcomeID)
+		}
+	}
+}
+
+// A single failing or erroring handler fails the stage, the others still run
+func TestStageRegistryFailure(t *testing.T) {
+	registry := NewStageRegistry(log.New(io.Discard, "", 0))
+	var calls []string
+	registry.Register(testHandler("broken", &calls, "", api.TaskPassed, errors.New("boom")), 0)
+	registry.Register(testHandler("fine", &calls, "fine", api.TaskPassed, nil), 1)
+
+	response := registry.Run(context.Background(), api.TaskRequest{Stage: api.PostPlan}, nil)
+
+	if len(calls) != 2 {
+		t.Fatalf("expected both handlers to run, got %v", calls)
+	}
+	if response.Data.Attributes.Status != api.TaskFailed {
+		t.Fatalf("expected failed, got %s", response.Data.Attributes.Status)
+	}
+	if id := response.Data.Relationships.Outcomes.Data[0].Attributes.OutcomeID; id != "broken-error" {
+		t.Fatalf("expected error outcome first, got %s", id)
+	}
+
+	// Handlers only run in the stages they registered for
+	calls = nil
+	registry.Run(context.Background(), api.TaskRequest{Stage: api.PreApply}, nil)
+	if len(calls) != 0 {
+		t.Fatalf("expected no handlers for pre_apply, got %v", calls)
+	}
+}
+
+// An outcome with an invalid tag is replaced by an error outcome and fails the stage
+func TestStageRegistryInvalidOutcome(t *testing.T) {
+	registry := NewStageRegistry(log.New(io.Discard, "", 0))
+	registry.Register(StageHandlerFunc{
+		HandlerName:   "custom",
+		HandlerStages: []api.TaskStage{api.PostPlan},
+		Func: func(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+			return api.NewTaskResponse().
+				AddOutcome("valid", "Valid", "", "", "ok", api.TagLevelInfo).
+				AppendOutcome(api.NewOutcome("broken", "Broken").AddStatusTag("ok", api.TagLevelInfo).AddSeverityTag("High", "critical")).
+				SetResult(api.TaskPassed, "custom done"), nil
+		},
+	}, 0)
+
+	response := registry.Run(context.Background(), api.TaskRequest{Stage: api.PostPlan}, nil)
+
+	if response.Data.Attributes.Status != api.TaskFailed {
+		t.Fatalf("expected failed, got %s", response.Data.Attributes.Status)
+	}
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if len(outcomes) != 2 || outcomes[0].Attributes.OutcomeID != "valid" || outcomes[1].Attributes.OutcomeID != "broken" {
+		t.Fatalf("unexpected outcomes: %+v", outcomes)
+	}
+	if broken := outcomes[1].Attributes; len(broken.Tags.Severity) != 0 || broken.Tags.Status[0].Level != api.TagLevelError {
+		t.Fatalf("expected the invalid outcome to be replaced, got %+v", broken)
+	}
+	if err := response.Validate(); err != nil {
+		t.Fatalf("expected a valid response, got %v", err)
+	}
+}
+
+// A panicking handler gets an error outcome and fails the stage, the others still run
+func TestStageRegistryRecoversPanic(t *testing.T) {
+	registry := NewStageRegistry(log.New(io.Discard, "", 0))
+	var calls []string
+	registry.Register(StageHandlerFunc{
+		HandlerName:   "plugin",
+		HandlerStages: []api.TaskStage{api.PostPlan},
+		Func: func(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+			panic("plugin bug")
+		},
+	}, 0)
+	registry.Register(testHandler("fine", &calls, "fine", api.TaskPassed, nil), 1)
+
+	response := registry.Run(context.Background(), api.TaskRequest{Stage: api.PostPlan}, nil)
+
+	if len(calls) != 1 {
+		t.Fatalf("expected the handler after the panic to run, got %v", calls)
+	}
+	if response.Data.Attributes.Status != api.TaskFailed {
+		t.Fatalf("expected failed, got %s", response.Data.Attributes.Status)
+	}
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if len(outcomes) != 2 || outcomes[0].Attributes.OutcomeID != "plugin-error" || outcomes[1].Attributes.OutcomeID != "fine" {
+		t.Fatalf("unexpected outcomes: %+v", outcomes)
+	}
+	if plugin := outcomes[0].Attributes; plugin.Tags.Status[0].Level != api.TagLevelError || !strings.Contains(plugin.Body, "handler panicked") {
+		t.Fatalf("unexpected error outcome: %+v", plugin)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// PolicyRulesOrder is the order the policy rules are registered with, after the destructive-change guard.
+const PolicyRulesOrder = 30
+
+// maxRuleOutcomes limits the outcomes of a single rule, further findings are counted in one outcome.
+const maxRuleOutcomes = 50
+
+// ruleSeverities maps the severity of a rule to the tag level of its findings.
+var ruleSeverities = map[string]api.ResponseTagLevel{
+	"error":   api.TagLevelError,
+	"warning": api.TagLevelWarning,
+	"info":    api.TagLevelInfo,
+}
+
+// Rule is a declarative check evaluated against every resource change of the plan.
+// The rule finds a violation when its Condition is true, see helper.Expression for the syntax.
+// The condition can use address, type, name, mode, module_address, provider_name, action_reason,
+// workspace and change (actions, before, after, after_unknown, before_sensitive, after_sensitive).
+type Rule struct {
+	ID string `yaml:"id"`
+	// ResourceType selects the resource types the rule applies to, * matches any characters.
+	ResourceType string `yaml:"resource_type"`
+	// Actions limits the rule to changes with one of these actions, by default every change except no-op and read.
+	Actions   []api.Action `yaml:"actions,omitempty"`
+	Condition string       `yaml:"condition"`
+	// Severity is error, warning or info. Error findings fail the stage.
+	Severity string `yaml:"severity"`
+	Message  string `yaml:"message"`
+
+	expression *helper.Expression
+}
+
+// Level returns the tag level of the findings of the rule.
+func (r Rule) Level() api.ResponseTagLevel {
+	return ruleSeverities[r.Severity]
+}
+
+// AppliesTo reports whether the rule is evaluated for the change.
+func (r Rule) AppliesTo(change api.ResourceChange) bool {
+	if !matchPattern(r.ResourceType, change.Type) {
+		return false
+	}
+	actions := change.Change.Actions
+	if len(r.Actions) == 0 {
+		return !actions.IsNoOp() && !actions.IsRead()
+	}
+	return slices.ContainsFunc(r.Actions, func(a api.Action) bool { return slices.Contains(actions, a) })
+}
+
+type rulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadRules reads the policy rules from a YAML file and compiles their conditions.
+// An empty path returns no rules, which disables the policy rules handler.
+func LoadRules(path string) ([]Rule, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %w", path, err)
+	}
+	var file rulesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.ID == "" {
+			return nil, fmt.Errorf("invalid rules file %s: rule %d has no id", path, i)
+		}
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s is listed more than once", path, rule.ID)
+		}
+		seen[rule.ID] = true
+		if rule.ResourceType == "" {
+			rule.ResourceType = "*"
+		}
+		if rule.Severity == "" {
+			rule.Severity = "error"
+		}
+		if _, ok := ruleSeverities[rule.Severity]; !ok {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s has unknown severity %q, expected error, warning or info", path, rule.ID, rule.Severity)
+		}
+		if rule.Message == "" {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s has no message", path, rule.ID)
+		}
+		if rule.expression, err = helper.CompileExpression(rule.Condition); err != nil {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s: %w", path, rule.ID, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// ruleEnvironment returns the variables a rule condition is evaluated with.
+// Values are decoded the way encoding/json decodes into any.
+func ruleEnvironment(change api.ResourceChange, workspace string) (map[string]any, error) {
+	changeEnv := map[string]any{}
+	actions := make([]any, len(change.Change.Actions))
+	for i, action := range change.Change.Actions {
+		actions[i] = string(action)
+	}
+	changeEnv["actions"] = actions
+	for key, raw := range map[string]json.RawMessage{
+		"before":           change.Change.Before,
+		"after":            change.Change.After,
+		"after_unknown":    change.Change.AfterUnknown,
+		"before_sensitive": change.Change.BeforeSensitive,
+		"after_sensitive":  change.Change.AfterSensitive,
+	} {
+		var value any
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, fmt.Errorf("failed to decode change.%s of %s: %w", key, change.Address, err)
+			}
+		}
+		changeEnv[key] = value
+	}
+
+	return map[string]any{
+		"address":        change.Address,
+		"type":           change.Type,
+		"name":           change.Name,
+		"mode":           change.Mode,
+		"module_address": change.ModuleAddress,
+		"provider_name":  change.ProviderName,
+		"action_reason":  change.ActionReason,
+		"workspace":      workspace,
+		"change":         changeEnv,
+	}, nil
+}
+
+// policyRulesHandler is the StageHandler that evaluates the policy rules against the saved plan JSON
+// in post-plan. Every violation becomes an outcome with the tag level of the rule severity, and
+// rules that could not be evaluated are reported separately, as rule errors.
+type policyRulesHandler struct {
+	task *ScaffoldingRunTask
+}
+
+// Name returns the handler name.
+func (h *policyRulesHandler) Name() string { return "policy-rules" }
+
+// Stages returns the stages the handler runs in.
+func (h *policyRulesHandler) Stages() []api.TaskStage { return []api.TaskStage{api.PostPlan} }
+
+// ruleFinding is a violation, or an evaluation error when err is set.
+type ruleFinding struct {
+	change api.ResourceChange
+	err    error
+}
+
+// Handle streams the resource changes of the plan JSON and evaluates every rule that applies to them.
+func (h *policyRulesHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	rules := h.task.rules
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	path := filepath.Join(request.RunTaskDirectory(), planJSONFile)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("the plan JSON was not saved, policy rules cannot be evaluated")
+	}
+
+	violations := make([][]ruleFinding, len(rules))
+	evalErrors := make([][]ruleFinding, len(rules))
+	err := helper.DecodeResourceChangesFile(path, func(change api.ResourceChange) error {
+		var env map[string]any
+		var envErr error
+		for i, rule := range rules {
+			if !rule.AppliesTo(change) {
+				continue
+			}
+			if env == nil && envErr == nil {
+				env, envErr = ruleEnvironment(change, request.WorkspaceName)
+			}
+			if envErr != nil {
+				evalErrors[i] = append(evalErrors[i], ruleFinding{change: change, err: envErr})
+				continue
+			}
+			violated, err := rule.expression.EvalBool(env)
+			switch {
+			case err != nil:
+				evalErrors[i] = append(evalErrors[i], ruleFinding{change: change, err: err})
+			case violated:
+				violations[i] = append(violations[i], ruleFinding{change: change})
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the plan JSON: %w", err)
+	}
+
+	ntr := api.NewTaskResponse()
+	counts := map[api.ResponseTagLevel]int{}
+	ruleErrors := 0
+	for i, rule := range rules {
+		for j, finding := range violations[i] {
+			if j == maxRuleOutcomes {
+				ntr.AddOutcome(rule.ID+"-more", fmt.Sprintf("%d more resource(s) violate %s", len(violations[i])-j, rule.ID),
+					rule.Message, "", rule.Severity, rule.Level())
+				break
+			}
+			ntr.AddOutcome(rule.ID+"-"+finding.change.Address, finding.change.Address+": "+rule.Message,
+				ruleMarkdown(rule, finding.change), "", rule.Severity, rule.Level())
+		}
+		counts[rule.Level()] += len(violations[i])
+
+		// Evaluation errors are not violations, one outcome per rule lists the resources it failed on
+		if len(evalErrors[i]) > 0 {
+			ruleErrors++
+			ntr.AddOutcome("rule-error-"+rule.ID, fmt.Sprintf("Rule %s could not be evaluated for %d resource(s)", rule.ID, len(evalErrors[i])),
+				ruleErrorMarkdown(rule, evalErrors[i]), "", "rule error", api.TagLevelError)
+		}
+	}
+
+	message := fmt.Sprintf("Policy rules: %d error(s), %d warning(s), %d info finding(s), %d rule error(s)",
+		counts[api.TagLevelError], counts[api.TagLevelWarning], counts[api.TagLevelInfo], ruleErrors)
+	if counts[api.TagLevelError] > 0 || ruleErrors > 0 {
+		return ntr.SetResult(api.TaskFailed, message), nil
+	}
+	return ntr.SetResult(api.TaskPassed, message), nil
+}
+
+// ruleMarkdown renders a violation as markdown.
+func ruleMarkdown(rule Rule, change api.ResourceChange) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Rule:** `%s` (%s)\n\n", rule.ID, rule.Severity)
+	fmt.Fprintf(&b, "**Resource:** `%s`\n\n", change.Address)
+	fmt.Fprintf(&b, "**Actions:** %s\n\n", change.Change.Actions)
+	fmt.Fprintf(&b, "**Condition:** `%s`\n\n", rule.Condition)
+	b.WriteString(rule.Message)
+	return b.String()
+}
+
+// ruleErrorMarkdown lists the resources a rule could not be evaluated for, with the first errors.
+func ruleErrorMarkdown(rule Rule, findings []ruleFinding) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Condition:** `%s`\n\n", rule.Condition)
+	for i, finding := range findings {
+		if i == 10 {
+			fmt.Fprintf(&b, "- ... and %d more\n", len(findings)-i)
+			break
+		}
+		fmt.Fprintf(&b, "- `%s`: %s\n", finding.change.Address, finding.err)
+	}
+	return strings.TrimSpace(b.String())
+}
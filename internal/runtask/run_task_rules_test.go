@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+const rulesPlan = `{"format_version": "1.2", "resource_changes": [
+	{"address": "aws_s3_bucket.public", "type": "aws_s3_bucket", "change": {"actions": ["create"], "after": {"acl": "public-read", "tags": {"Owner": "web"}}}},
+	{"address": "aws_s3_bucket.private", "type": "aws_s3_bucket", "change": {"actions": ["update"], "after": {"acl": "private", "tags": {}}}},
+	{"address": "aws_s3_bucket.existing", "type": "aws_s3_bucket", "change": {"actions": ["no-op"], "after": {"acl": "public-read"}}},
+	{"address": "aws_instance.web", "type": "aws_instance", "change": {"actions": ["create"], "after": {"instance_type": "m5.large"}}}
+]}`
+
+const rulesYAML = `rules:
+  - id: s3-no-public-acl
+    resource_type: aws_s3_bucket
+    condition: change.after.acl == "public-read"
+    severity: error
+    message: S3 buckets must not be public
+  - id: s3-owner-tag
+    resource_type: aws_s3_*
+    condition: '!exists(change.after.tags.Owner)'
+    severity: warning
+    message: S3 buckets should have an Owner tag
+  - id: instance-size
+    resource_type: aws_instance
+    condition: change.after.instance_type > 3
+    message: Instance types are strings, so this rule cannot be evaluated
+`
+
+func writeRulesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write rules file: %v", err)
+	}
+	return path
+}
+
+// Rules files are validated and their conditions compiled when loaded
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules(writeRulesFile(t, rulesYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 3 || rules[2].Severity != "error" || rules[1].Level() != api.TagLevelWarning {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	for name, content := range map[string]string{
+		"missing id":       "rules:\n  - condition: 'true'\n    message: m\n",
+		"duplicate id":     "rules:\n  - {id: a, condition: 'true', message: m}\n  - {id: a, condition: 'true', message: m}\n",
+		"unknown severity": "rules:\n  - {id: a, condition: 'true', message: m, severity: fatal}\n",
+		"bad condition":    "rules:\n  - {id: a, condition: 'change.after ==', message: m}\n",
+		"unknown field":    "rules:\n  - {id: a, condition: 'true', message: m, level: error}\n",
+	} {
+		if _, err := LoadRules(writeRulesFile(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Violations become outcomes with the rule severity, evaluation errors are reported per rule
+func TestPolicyRulesHandler(t *testing.T) {
+	rules, err := LoadRules(writeRulesFile(t, rulesYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Chdir(t.TempDir())
+	request := api.TaskRequest{WorkspaceName: "ws", RunID: "run-123", Stage: api.PostPlan}
+	dir, err := request.CreateRunTaskDirectoryStructure()
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, planJSONFile), []byte(rulesPlan), 0600); err != nil {
+		t.Fatalf("failed to write plan: %v", err)
+	}
+	h := &policyRulesHandler{task: &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0), rules: rules}}
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, outcome := range response.Data.Relationships.Outcomes.Data {
+		got = append(got, outcome.Attributes.OutcomeID+"="+string(outcome.Attributes.Tags.Status[0].Level))
+	}
+	want := []string{
+		"s3-no-public-acl-aws_s3_bucket.public=error",
+		"s3-owner-tag-aws_s3_bucket.private=warning",
+		"rule-error-instance-size=error",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected outcomes %v, got %v", want, got)
+	}
+
+	ruleError := response.Data.Relationships.Outcomes.Data[2].Attributes
+	if !strings.Contains(ruleError.Body, "`aws_instance.web`: cannot compare string > number") {
+		t.Fatalf("unexpected rule error body: %s", ruleError.Body)
+	}
+	if response.Data.Attributes.Status != api.TaskFailed || response.Data.Attributes.Message != "Policy rules: 1 error(s), 1 warning(s), 0 info finding(s), 1 rule error(s)" {
+		t.Fatalf("unexpected result: %+v", response.Data.Attributes)
+	}
+}
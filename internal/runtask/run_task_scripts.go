@@ -0,0 +1,485 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+)
+
+// ScriptsOrder is the order the Starlark scripts are registered with, after the built-in checks.
+const ScriptsOrder = 40
+
+const (
+	// scriptEntryPoint is the function every script defines, it is called with the request, plan and files.
+	scriptEntryPoint = "check"
+	// maxScriptFileSize is the largest configuration file passed to scripts, larger files are left out.
+	maxScriptFileSize = 1 << 20
+	// maxScriptFilesSize limits the configuration files passed to scripts in total.
+	maxScriptFilesSize = 32 << 20
+)
+
+// scriptFileOptions are the Starlark dialect options, while loops and recursion stay disabled.
+var scriptFileOptions = &syntax.FileOptions{Set: true, TopLevelControl: true}
+
+// Script is a Starlark check compiled from <scripts dir>/<stage>/<name>.star.
+// The script defines check(request, plan, files) and returns an outcome, a list of outcomes or None.
+// request is the TaskRequest with the access token redacted, plan the parsed plan JSON in post-plan
+// (None otherwise) and files maps the paths of the extracted configuration version to their content.
+// Every input is frozen, a script that modifies them fails.
+type Script struct {
+	// Name is the file name without the .star extension, it prefixes the outcome IDs of the script.
+	Name  string
+	Stage api.TaskStage
+	Path  string
+
+	program *starlark.Program
+}
+
+// LoadScripts compiles the scripts found in a subdirectory per stage of dir, e.g. dir/post_plan/cost.star.
+// Scripts are compiled once, syntax errors and scripts without a check function are reported here.
+// An empty path returns no scripts, which disables the scripts handler.
+func LoadScripts(dir string) ([]Script, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to read scripts directory %s: %w", dir, err)
+	}
+
+	var scripts []Script
+	for _, stage := range AllStages {
+		paths, err := filepath.Glob(filepath.Join(dir, string(stage), "*.star"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list scripts in %s: %w", dir, err)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			script, err := compileScript(path, stage)
+			if err != nil {
+				return nil, err
+			}
+			scripts = append(scripts, script)
+		}
+	}
+	return scripts, nil
+}
+
+// compileScript parses and compiles a script file, checking that it defines the entry point.
+func compileScript(path string, stage api.TaskStage) (Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Script{}, fmt.Errorf("failed to read script %s: %w", path, err)
+	}
+	file, program, err := starlark.SourceProgramOptions(scriptFileOptions, path, data, scriptPredeclared.Has)
+	if err != nil {
+		return Script{}, fmt.Errorf("failed to compile script %s: %w", path, err)
+	}
+	defined := false
+	for _, stmt := range file.Stmts {
+		if def, ok := stmt.(*syntax.DefStmt); ok && def.Name.Name == scriptEntryPoint {
+			defined = true
+		}
+	}
+	if !defined {
+		return Script{}, fmt.Errorf("invalid script %s: it does not define %s(request, plan, files)", path, scriptEntryPoint)
+	}
+	return Script{
+		Name:    strings.TrimSuffix(filepath.Base(path), ".star"),
+		Stage:   stage,
+		Path:    path,
+		program: program,
+	}, nil
+}
+
+// scriptPredeclared are the names available to every script besides the Starlark built-ins.
+var scriptPredeclared = starlark.StringDict{
+	"json":    starlarkjson.Module,
+	"outcome": starlark.NewBuiltin("outcome", outcomeBuiltin),
+}
+
+// outcomeBuiltin implements outcome(id, description, level="info", body="", url="", label=""),
+// it returns the outcome as a dict so scripts can also build them by hand.
+func outcomeBuiltin(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var id, description string
+	level, body, url, label := "info", "", "", ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "description", &description,
+		"level?", &level, "body?", &body, "url?", &url, "label?", &label); err != nil {
+		return nil, err
+	}
+	if !api.ResponseTagLevel(level).IsValid() {
+		return nil, fmt.Errorf("%s: unknown level %q, expected none, info, warning or error", fn.Name(), level)
+	}
+	dict := starlark.NewDict(6)
+	for _, field := range [][2]string{{"id", id}, {"description", description}, {"level", level}, {"body", body}, {"url", url}, {"label", label}} {
+		if err := dict.SetKey(starlark.String(field[0]), starlark.String(field[1])); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+// scriptOutcome is an outcome returned by a script.
+type scriptOutcome struct {
+	id, description, body, url, label string
+	level                             api.ResponseTagLevel
+}
+
+// scriptInputs are the frozen arguments every script of a stage is called with.
+type scriptInputs struct {
+	request, plan, files starlark.Value
+}
+
+// scriptsHandler is the StageHandler that runs the Starlark scripts of the stage.
+// Each script runs on its own thread, bounded by the step limit and the script timeout.
+type scriptsHandler struct {
+	task *ScaffoldingRunTask
+}
+
+// Name returns the handler name.
+func (h *scriptsHandler) Name() string { return "starlark-scripts" }
+
+// Stages returns the stages the handler runs in.
+func (h *scriptsHandler) Stages() []api.TaskStage { return AllStages }
+
+// Handle runs the scripts of the stage in order and adds their outcomes, prefixed with the script name.
+// Scripts that fail, exceed their limits or return invalid outcomes get an error outcome.
+func (h *scriptsHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	var scripts []Script
+	for _, script := range h.task.scripts {
+		if script.Stage == request.Stage {
+			scripts = append(scripts, script)
+		}
+	}
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+
+	inputs, err := h.task.scriptInputs(request)
+	if err != nil {
+		return nil, err
+	}
+
+	ntr := api.NewTaskResponse()
+	failed := 0
+	for _, script := range scripts {
+		outcomes, err := h.task.runScript(ctx, script, inputs)
+		if err != nil {
+			failed++
+			h.task.logger.Printf("Script %s failed: %v", script.Path, err)
+			ntr.AddOutcome("script-error-"+script.Name, "Script "+script.Name+" failed", scriptErrorMarkdown(err), "", "script error", api.TagLevelError)
+			continue
+		}
+		for _, o := range outcomes {
+			if o.level == api.TagLevelError {
+				failed++
+			}
+			ntr.AddOutcome(script.Name+"-"+o.id, o.description, o.body, o.url, o.label, o.level)
+		}
+	}
+
+	message := fmt.Sprintf("Scripts: %d script(s) run, %d error(s)", len(scripts), failed)
+	if failed > 0 {
+		return ntr.SetResult(api.TaskFailed, message), nil
+	}
+	return ntr.SetResult(api.TaskPassed, message), nil
+}
+
+// scriptErrorMarkdown renders a script error, with the Starlark backtrace when there is one.
+func scriptErrorMarkdown(err error) string {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return "```\n" + evalErr.Backtrace() + "\n```"
+	}
+	return err.Error()
+}
+
+// runScript calls the check function of the script on a new thread. The thread is cancelled when
+// the script timeout passes or the stage context is done, and after the configured execution steps.
+func (r *ScaffoldingRunTask) runScript(ctx context.Context, script Script, inputs scriptInputs) ([]scriptOutcome, error) {
+	thread := &starlark.Thread{
+		Name: script.Name,
+		Print: func(_ *starlark.Thread, msg string) {
+			r.logger.Printf("[%s] %s", script.Name, msg)
+		},
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("load(%q): scripts cannot load modules", module)
+		},
+	}
+	if r.config.ScriptMaxSteps > 0 {
+		thread.SetMaxExecutionSteps(r.config.ScriptMaxSteps)
+	}
+	if r.config.ScriptTimeout > 0 {
+		timer := time.AfterFunc(r.config.ScriptTimeout, func() {
+			thread.Cancel(fmt.Sprintf("timed out after %s", r.config.ScriptTimeout))
+		})
+		defer timer.Stop()
+	}
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(context.Cause(ctx).Error()) })
+	defer stop()
+
+	globals, err := script.program.Init(thread, scriptPredeclared)
+	if err != nil {
+		return nil, err
+	}
+	check, ok := globals[scriptEntryPoint].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a function", scriptEntryPoint)
+	}
+	result, err := starlark.Call(thread, check, starlark.Tuple{inputs.request, inputs.plan, inputs.files}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseScriptOutcomes(result)
+}
+
+// parseScriptOutcomes reads the value returned by check: None, an outcome dict or a list of them.
+func parseScriptOutcomes(result starlark.Value) ([]scriptOutcome, error) {
+	var values []starlark.Value
+	switch v := result.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.Dict:
+		values = []starlark.Value{v}
+	case *starlark.List, starlark.Tuple:
+		iter := starlark.Iterate(v)
+		defer iter.Done()
+		var x starlark.Value
+		for iter.Next(&x) {
+			values = append(values, x)
+		}
+	default:
+		return nil, fmt.Errorf("%s returned a %s, expected an outcome, a list of outcomes or None", scriptEntryPoint, result.Type())
+	}
+
+	outcomes := make([]scriptOutcome, 0, len(values))
+	seen := map[string]bool{}
+	for i, value := range values {
+		dict, ok := value.(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("outcome %d is a %s, expected a dict", i, value.Type())
+		}
+		fields := map[string]string{"level": "info"}
+		for _, item := range dict.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("outcome %d has a non-string key %s", i, item[0])
+			}
+			switch key {
+			case "id", "description", "level", "body", "url", "label":
+			default:
+				return nil, fmt.Errorf("outcome %d has unknown field %q", i, key)
+			}
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				return nil, fmt.Errorf("outcome %d field %s is a %s, expected a string", i, key, item[1].Type())
+			}
+			fields[key] = value
+		}
+		o := scriptOutcome{id: fields["id"], description: fields["description"], body: fields["body"], url: fields["url"], label: fields["label"]}
+		if o.id == "" || o.description == "" {
+			return nil, fmt.Errorf("outcome %d needs an id and a description", i)
+		}
+		if seen[o.id] {
+			return nil, fmt.Errorf("outcome id %s is returned more than once", o.id)
+		}
+		seen[o.id] = true
+		if o.level = api.ResponseTagLevel(fields["level"]); !o.level.IsValid() {
+			return nil, fmt.Errorf("outcome %s has unknown level %q, expected none, info, warning or error", o.id, fields["level"])
+		}
+		if o.label == "" {
+			o.label = fields["level"]
+		}
+		outcomes = append(outcomes, o)
+	}
+	return outcomes, nil
+}
+
+// scriptInputs builds the frozen request, plan and files the scripts of the stage are called with.
+func (r *ScaffoldingRunTask) scriptInputs(request api.TaskRequest) (scriptInputs, error) {
+	redacted, err := r.redactor.Redact(request)
+	if err != nil {
+		return scriptInputs{}, fmt.Errorf("failed to redact the request: %w", err)
+	}
+	requestValue, err := jsonToStarlark(redacted)
+	if err != nil {
+		return scriptInputs{}, fmt.Errorf("failed to convert the request: %w", err)
+	}
+
+	inputs := scriptInputs{request: requestValue}
+	dir := request.RunTaskDirectory()
+	if inputs.plan, err = scriptPlan(filepath.Join(dir, planJSONFile)); err != nil {
+		return scriptInputs{}, err
+	}
+
+	files := starlark.NewDict(0)
+	if request.ConfigurationVersionID != "" {
+		if err := r.readScriptFiles(filepath.Join(dir, request.ConfigurationVersionID), files); err != nil {
+			return scriptInputs{}, fmt.Errorf("failed to read the configuration files: %w", err)
+		}
+	}
+	inputs.files = files
+
+	for _, v := range []starlark.Value{inputs.request, inputs.plan, inputs.files} {
+		v.Freeze()
+	}
+	return inputs, nil
+}
+
+// scriptPlan decodes the saved plan JSON into a dict one top-level key at a time, so the raw document is
+// never read into memory as a whole. It is None when the stage has no plan JSON.
+func scriptPlan(path string) (starlark.Value, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return starlark.None, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the plan JSON: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("failed to read the plan JSON: expected an object")
+	}
+	fields := map[string]starlark.Value{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the plan JSON: %w", err)
+		}
+		key, _ := tok.(string)
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("failed to read %s of the plan JSON: %w", key, err)
+		}
+		if fields[key], err = toStarlark(value); err != nil {
+			return nil, fmt.Errorf("failed to convert %s of the plan JSON: %w", key, err)
+		}
+	}
+
+	// Like every other object, the plan is a dict with sorted keys
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	plan := starlark.NewDict(len(keys))
+	for _, key := range keys {
+		if err := plan.SetKey(starlark.String(key), fields[key]); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// readScriptFiles adds the files of the extracted configuration version to files, keyed by their
+// slash separated path. Files over maxScriptFileSize, or past maxScriptFilesSize in total, are left out.
+func (r *ScaffoldingRunTask) readScriptFiles(root string, files *starlark.Dict) error {
+	total := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.Size() > maxScriptFileSize || total+int(info.Size()) > maxScriptFilesSize {
+			r.logger.Printf("Configuration file %s is left out of the script inputs, it is too large", rel)
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		total += len(data)
+		return files.SetKey(starlark.String(filepath.ToSlash(rel)), starlark.String(data))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// jsonToStarlark decodes a JSON document into Starlark values, objects become dicts with sorted keys.
+func jsonToStarlark(data []byte) (starlark.Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return toStarlark(v)
+}
+
+// toStarlark converts a value decoded by encoding/json with UseNumber.
+func toStarlark(v any) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case json.Number:
+		if i, ok := new(big.Int).SetString(v.String(), 10); ok {
+			return starlark.MakeBigInt(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case []any:
+		elems := make([]starlark.Value, len(v))
+		for i, e := range v {
+			var err error
+			if elems[i], err = toStarlark(e); err != nil {
+				return nil, err
+			}
+		}
+		return starlark.NewList(elems), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, k := range keys {
+			value, err := toStarlark(v[k])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(k), value); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unsupported JSON value %T", v)
+}
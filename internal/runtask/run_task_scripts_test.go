@@ -0,0 +1,189 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package runtask
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/straubt1/terraform-run-task/internal/helper"
+	"github.com/straubt1/terraform-run-task/internal/sdk/api"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
+)
+
+const scriptsPlan = `{"format_version": "1.2", "prior_state": {"values": {"root_module": {}}}, "resource_changes": [
+	{"address": "aws_instance.web", "type": "aws_instance", "change": {"actions": ["create"], "after": {"instance_type": "m5.24xlarge"}}},
+	{"address": "aws_instance.db", "type": "aws_instance", "change": {"actions": ["create"], "after": {"instance_type": "t3.micro"}}}
+]}`
+
+var testScripts = map[string]string{
+	"post_plan/instances.star": `
+def check(request, plan, files):
+    if request["access_token"] == "secret-token":
+        fail("the access token was not redacted")
+    if plan.keys() != ["format_version", "prior_state", "resource_changes"]:
+        fail("expected the whole plan, got %s" % plan.keys())
+    found = []
+    for rc in plan["resource_changes"]:
+        if rc["change"]["after"]["instance_type"].endswith("xlarge"):
+            found.append(outcome(rc["address"], rc["address"] + " is too large", level = "warning", label = "size"))
+    return found
+`,
+	"post_plan/files.star": `
+def check(request, plan, files):
+    if "main.tf" not in files:
+        return outcome("main", "main.tf is missing", level = "error")
+    return {"id": "count", "description": "%d file(s) in %s" % (len(files), request["workspace_name"])}
+`,
+	"post_plan/mutate.star": `
+def check(request, plan, files):
+    plan["resource_changes"].append({})
+`,
+	"post_plan/steps.star": `
+def check(request, plan, files):
+    total = 0
+    for i in range(1000000):
+        total += i
+`,
+	"post_plan/invalid.star": `
+def check(request, plan, files):
+    return [outcome("ok", "fine"), "not an outcome"]
+`,
+	"pre_plan/noop.star": `
+def check(request, plan, files):
+    return None
+`,
+}
+
+func writeScripts(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range scripts {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("failed to create script directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write script: %v", err)
+		}
+	}
+	return dir
+}
+
+// Scripts are compiled per stage in name order, invalid scripts fail the load
+func TestLoadScripts(t *testing.T) {
+	scripts, err := LoadScripts(writeScripts(t, testScripts))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, script := range scripts {
+		got = append(got, string(script.Stage)+"/"+script.Name)
+	}
+	want := "pre_plan/noop post_plan/files post_plan/instances post_plan/invalid post_plan/mutate post_plan/steps"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("expected scripts %s, got %v", want, got)
+	}
+
+	for name, content := range map[string]string{
+		"syntax error":   "def check(request, plan, files)\n    return None\n",
+		"no check":       "def run(request):\n    return None\n",
+		"undefined name": "def check(request, plan, files):\n    return missing\n",
+	} {
+		if _, err := LoadScripts(writeScripts(t, map[string]string{"post_plan/bad.star": content})); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Script outcomes are prefixed with the script name, failing scripts and scripts over the limits get an error outcome
+func TestScriptsHandler(t *testing.T) {
+	scripts, err := LoadScripts(writeScripts(t, testScripts))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Chdir(t.TempDir())
+	request := api.TaskRequest{WorkspaceName: "ws", RunID: "run-123", Stage: api.PostPlan, AccessToken: "secret-token", ConfigurationVersionID: "cv-1"}
+	dir, err := request.CreateRunTaskDirectoryStructure()
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, planJSONFile), []byte(scriptsPlan), 0600); err != nil {
+		t.Fatalf("failed to write plan: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "cv-1", "modules"), 0700); err != nil {
+		t.Fatalf("failed to create configuration directory: %v", err)
+	}
+	for _, name := range []string{"main.tf", "modules/vpc.tf"} {
+		if err := os.WriteFile(filepath.Join(dir, "cv-1", name), []byte("# "+name), 0600); err != nil {
+			t.Fatalf("failed to write configuration file: %v", err)
+		}
+	}
+	task := &ScaffoldingRunTask{
+		logger:   log.New(io.Discard, "", 0),
+		redactor: helper.NewRedactor(),
+		scripts:  scripts,
+		config:   handler.Configuration{ScriptTimeout: handler.DefaultScriptTimeout, ScriptMaxSteps: 10000},
+	}
+	h := &scriptsHandler{task: task}
+
+	response, err := h.Handle(context.Background(), request, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, outcome := range response.Data.Relationships.Outcomes.Data {
+		got = append(got, outcome.Attributes.OutcomeID+"="+string(outcome.Attributes.Tags.Status[0].Level))
+	}
+	want := []string{
+		"files-count=info",
+		"instances-aws_instance.web=warning",
+		"script-error-invalid=error",
+		"script-error-mutate=error",
+		"script-error-steps=error",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected outcomes %v, got %v", want, got)
+	}
+
+	outcomes := response.Data.Relationships.Outcomes.Data
+	if outcomes[0].Attributes.Description != "2 file(s) in ws" || outcomes[1].Attributes.Tags.Status[0].Label != "size" {
+		t.Fatalf("unexpected script outcomes: %+v", outcomes[:2])
+	}
+	for i, want := range map[int]string{2: "expected a dict", 3: "frozen", 4: "too many steps"} {
+		if !strings.Contains(outcomes[i].Attributes.Body, want) {
+			t.Errorf("expected %s body to mention %q, got: %s", outcomes[i].Attributes.OutcomeID, want, outcomes[i].Attributes.Body)
+		}
+	}
+	if response.Data.Attributes.Status != api.TaskFailed || response.Data.Attributes.Message != "Scripts: 5 script(s) run, 3 error(s)" {
+		t.Fatalf("unexpected result: %+v", response.Data.Attributes)
+	}
+}
+
+// A script is cancelled when the stage context is done
+func TestScriptsHandlerCancelled(t *testing.T) {
+	scripts, err := LoadScripts(writeScripts(t, map[string]string{"pre_plan/loop.star": testScripts["post_plan/steps.star"]}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Chdir(t.TempDir())
+	task := &ScaffoldingRunTask{logger: log.New(io.Discard, "", 0), redactor: helper.NewRedactor(), scripts: scripts}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response, err := (&scriptsHandler{task: task}).Handle(ctx, api.TaskRequest{WorkspaceName: "ws", RunID: "run-123", Stage: api.PrePlan}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outcome := response.Data.Relationships.Outcomes.Data[0].Attributes
+	if outcome.OutcomeID != "script-error-loop" || !strings.Contains(outcome.Body, "context canceled") {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+}
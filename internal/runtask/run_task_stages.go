@@ -4,9 +4,13 @@
 package runtask
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/straubt1/terraform-run-task/internal/helper"
 	"github.com/straubt1/terraform-run-task/internal/sdk/api"
@@ -15,322 +19,249 @@ import (
 
 // ScaffoldingRunTask defines the run task implementation.
 type ScaffoldingRunTask struct {
-	config handler.Configuration
-	logger *log.Logger
+	config      handler.Configuration
+	logger      *log.Logger
+	client      *helper.Client
+	fileManager *helper.FileManager
+	redactor    *helper.Redactor
+	jobs        *JobTracker
+	outbox      *Outbox
+	pool        *WorkerPool
+	handlers    *StageRegistry
+	collectors  []Collector
+	guard       GuardConfig
+	rules       []Rule
+	scripts     []Script
+	checks      []Check
+	// draining is set once shutdown starts, new run task requests are rejected from then on
+	draining atomic.Bool
 }
 
 // NewRunTask instantiates a new ScaffoldingRunTask with a new Logger.
 func NewRunTask() *ScaffoldingRunTask {
-	return &ScaffoldingRunTask{
-		logger: log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime),
-	}
+	logger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime)
+	// A single client is shared by every stage so connections are reused across runs
+	client := helper.NewClient()
+	task := &ScaffoldingRunTask{
+		logger:      logger,
+		client:      client,
+		fileManager: helper.NewFileManager(),
+		redactor:    helper.NewRedactor(),
+		jobs:        NewJobTracker(),
+		outbox:      NewOutbox(logger, client),
+		handlers:    NewStageRegistry(logger),
+		collectors:  DefaultCollectors(),
+	}
+	task.handlers.Register(&dataCaptureHandler{task: task}, DataCaptureOrder)
+	task.handlers.Register(&planSummaryHandler{task: task}, PlanSummaryOrder)
+	task.handlers.Register(&destructiveGuardHandler{task: task}, DestructiveGuardOrder)
+	task.handlers.Register(&policyRulesHandler{task: task}, PolicyRulesOrder)
+	task.handlers.Register(&scriptsHandler{task: task}, ScriptsOrder)
+	task.handlers.Register(&externalChecksHandler{task: task}, ExternalChecksOrder)
+	return task
 }
 
-// Configure defines the configuration for the server and run task.
-// This method is called before the server is initialized.
-func (r *ScaffoldingRunTask) Configure(addr string, path string, hmacKey string) {
-	r.config = handler.Configuration{
-		Addr:    fmt.Sprintf(":%s", addr),
-		Path:    path,
-		HmacKey: hmacKey,
+// WithCollectors sets the artifacts the data capture saves, see LoadCollectors.
+func (r *ScaffoldingRunTask) WithCollectors(collectors []Collector) *ScaffoldingRunTask {
+	if collectors != nil {
+		r.collectors = collectors
 	}
+	return r
 }
 
-// Below are the 4 potential stages of a run task
-
-// PrePlanStage is executed before the plan is created.
-func (r *ScaffoldingRunTask) PrePlanStage(request api.TaskRequest) (*api.TaskResponse, error) {
-	// Demo link to show how to set a URL in the response
-	referenceURL := fmt.Sprintf("https://example.com/task/%s", request.RunID)
-
-	r.logger.Println("Running Pre-Plan Stage")
-	ntr := api.NewTaskResponse()
-	runTaskPath, err := request.CreateRunTaskDirectoryStructure()
-	if err != nil {
-		r.logger.Println("Error creating directory:", err)
-		return ntr.AddOutcome("create-directory", "Failed to create directory", err.Error(), referenceURL, "failed", api.TagLevelError).
-			SetResult(api.TaskFailed, "Pre-Plan Stage Failed: "+err.Error()), err
-	}
-
-	// Initialize clients used throughout this stage
-	fileManager := helper.NewFileManager()
-	tfcClient := helper.NewClient()
-
-	err = fileManager.SaveStructToFile(runTaskPath, "request.json", request)
-	if err == nil {
-		ntr.AddOutcome("save-request", "Request saved to file successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("save-request", "Failed to save request to file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run", request)
-	if err == nil {
-		ntr.AddOutcome("download-run", "Run data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run", "Failed to download run from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	err = tfcClient.DownloadConfigurationVersion(runTaskPath, request, fileManager)
-	if err == nil {
-		ntr.AddOutcome("download-configuration-version", "Configuration version downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-configuration-version", "Failed to download configuration version", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Set the final result based on whether any outcomes were failures
-	if ntr.IsPassed() {
-		ntr.SetResult(api.TaskPassed, "Pre Plan Stage - Success").
-			WithUrl(referenceURL)
-	} else {
-		ntr.SetResult(api.TaskFailed, "Pre Plan Stage - Failed").
-			WithUrl(referenceURL)
-	}
-
-	return ntr, nil
+// WithGuard sets the destructive-change guard rules, see LoadGuardConfig.
+func (r *ScaffoldingRunTask) WithGuard(guard GuardConfig) *ScaffoldingRunTask {
+	r.guard = guard
+	return r
 }
 
-// PostPlanStage is executed after the plan is created.
-func (r *ScaffoldingRunTask) PostPlanStage(request api.TaskRequest) (*api.TaskResponse, error) {
-	// Demo link to show how to set a URL in the response
-	referenceURL := fmt.Sprintf("https://example.com/task/%s", request.RunID)
-
-	r.logger.Println("Running Post-Plan Stage")
-	ntr := api.NewTaskResponse()
-	runTaskPath, err := request.CreateRunTaskDirectoryStructure()
-	if err != nil {
-		r.logger.Println("Error creating directory:", err)
-		return ntr.AddOutcome("create-directory", "Failed to create directory", err.Error(), referenceURL, "failed", api.TagLevelError).
-			SetResult(api.TaskFailed, "Post-Plan Stage Failed: "+err.Error()), err
-	}
-
-	// Initialize clients used throughout this stage
-	fileManager := helper.NewFileManager()
-	tfcClient := helper.NewClient()
-
-	err = tfcClient.DownloadConfigurationVersion(runTaskPath, request, fileManager)
-	if err == nil {
-		ntr.AddOutcome("download-configuration-version", "Configuration version downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-configuration-version", "Failed to download configuration version", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Save request to JSON file
-	err = fileManager.SaveStructToFile(runTaskPath, "request.json", request)
-	if err == nil {
-		ntr.AddOutcome("save-request", "Request saved to file successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("save-request", "Failed to save request to file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run", request)
-	if err == nil {
-		ntr.AddOutcome("download-run", "Run data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run", "Failed to download run from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Download Plan as a JSON file
-	err = tfcClient.DownloadPlanJson(runTaskPath, request)
-	if err == nil {
-		ntr.AddOutcome("download-plan-json", "Plan JSON downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-plan-json", "Failed to download plan JSON file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Plan from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "plan", request)
-	if err == nil {
-		ntr.AddOutcome("download-plan", "Plan data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-plan", "Failed to download plan file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
+// WithRules sets the policy rules evaluated in post-plan, see LoadRules.
+func (r *ScaffoldingRunTask) WithRules(rules []Rule) *ScaffoldingRunTask {
+	r.rules = rules
+	return r
+}
 
-	// Get the Plan logs
-	err = tfcClient.GetLogs(runTaskPath, "plan", request)
-	if err == nil {
-		ntr.AddOutcome("download-plan-logs", "Plan logs downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-plan-logs", "Failed to get plan logs", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
+// WithScripts sets the Starlark scripts run in each stage, see LoadScripts.
+func (r *ScaffoldingRunTask) WithScripts(scripts []Script) *ScaffoldingRunTask {
+	r.scripts = scripts
+	return r
+}
 
-	// Set the final result based on whether any outcomes were failures
-	if ntr.IsPassed() {
-		ntr.SetResult(api.TaskPassed, "Post Plan Stage - Success").
-			WithUrl(referenceURL)
-	} else {
-		ntr.SetResult(api.TaskFailed, "Post Plan Stage - Failed").
-			WithUrl(referenceURL)
-	}
+// WithChecks sets the external checks run in each stage, see LoadChecks.
+func (r *ScaffoldingRunTask) WithChecks(checks []Check) *ScaffoldingRunTask {
+	r.checks = checks
+	return r
+}
 
-	return ntr, nil
+// Handlers returns the registry of stage handlers.
+// Register additional handlers before the server starts, they run alongside the data capture.
+func (r *ScaffoldingRunTask) Handlers() *StageRegistry {
+	return r.handlers
 }
 
-// PreApplyStage is executed before the apply is executed.
-func (r *ScaffoldingRunTask) PreApplyStage(request api.TaskRequest) (*api.TaskResponse, error) {
-	// Demo link to show how to set a URL in the response
-	referenceURL := fmt.Sprintf("https://example.com/task/%s", request.RunID)
+// Configure defines the configuration for the server and run task.
+// This method is called before the server is initialized.
+func (r *ScaffoldingRunTask) Configure(addr string, path string, hmacKey string, opts ...handler.Option) {
+	r.config = handler.Configuration{
+		Addr:                 fmt.Sprintf(":%s", addr),
+		Path:                 path,
+		HmacKey:              hmacKey,
+		HmacKeys:             handler.NewKeySet(handler.HmacKey{Key: hmacKey, Label: "default"}),
+		DrainTimeout:         handler.DefaultDrainTimeout,
+		Workers:              handler.DefaultWorkers,
+		QueueLimit:           handler.DefaultQueueLimit,
+		StageTimeout:         handler.DefaultStageTimeout,
+		CollectorParallelism: handler.DefaultCollectorParallelism,
+		MaxRetries:           helper.DefaultMaxRetries,
+		RateLimit:            helper.DefaultRateLimit,
+		PageSize:             helper.DefaultPageSize,
+		MaxPages:             helper.DefaultMaxPages,
+		MaxPlanJSONSize:      helper.DefaultMaxPlanJSONSize,
+		IndentPlanJSON:       true,
+		ScriptTimeout:        handler.DefaultScriptTimeout,
+		ScriptMaxSteps:       handler.DefaultScriptMaxSteps,
+	}
+	for _, opt := range opts {
+		opt(&r.config)
+	}
+	r.client.WithSecrets(r.config.Secrets).
+		WithURLPolicy(helper.NewURLPolicy(r.config.AllowedHosts...)).
+		WithHTTPConfig(helper.HTTPConfig{
+			ConnectTimeout:      r.config.ConnectTimeout,
+			TLSHandshakeTimeout: r.config.TLSHandshakeTimeout,
+			ResponseTimeout:     r.config.ResponseTimeout,
+			RootCAs:             r.config.RootCAs,
+			ProxyURL:            r.config.ProxyURL,
+		}).
+		WithRetryPolicy(helper.RetryPolicy{
+			MaxRetries: r.config.MaxRetries,
+			BaseDelay:  helper.DefaultRetryBaseDelay,
+			MaxDelay:   helper.DefaultRetryMaxDelay,
+		}).
+		WithRateLimiter(helper.NewRateLimiter(r.config.RateLimit)).
+		WithPagination(r.config.PageSize, r.config.MaxPages).
+		WithTokens(r.config.Tokens).
+		WithPlanJSONOptions(helper.PlanJSONOptions{
+			MaxSize: r.config.MaxPlanJSONSize,
+			Indent:  r.config.IndentPlanJSON,
+		})
+	r.redactor = helper.NewRedactor(r.config.RedactFields...)
+	r.fileManager.WithRedactor(r.redactor)
+}
 
-	r.logger.Println("Running Pre-Apply Stage")
-	ntr := api.NewTaskResponse()
-	runTaskPath, err := request.CreateRunTaskDirectoryStructure()
-	if err != nil {
-		r.logger.Println("Error creating directory:", err)
-		return ntr.AddOutcome("create-directory", "Failed to create directory", err.Error(), referenceURL, "failed", api.TagLevelError).
-			SetResult(api.TaskFailed, "Pre-Apply Stage Failed: "+err.Error()), err
-	}
+// DataCaptureOrder is the order the scaffolding data capture is registered with.
+// Handlers registered with a lower order run before it, a higher order runs after it.
+const DataCaptureOrder = 0
 
-	// Initialize clients used throughout this stage
-	fileManager := helper.NewFileManager()
-	tfcClient := helper.NewClient()
+// dataCaptureHandler is the StageHandler that saves the request and downloads
+// the run data for each stage, driven by the configured collectors.
+type dataCaptureHandler struct {
+	task *ScaffoldingRunTask
+}
 
-	// Save request to JSON file
-	err = fileManager.SaveStructToFile(runTaskPath, "request.json", request)
-	if err == nil {
-		ntr.AddOutcome("save-request", "Request saved to file successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("save-request", "Failed to save request to file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
+func (h *dataCaptureHandler) Name() string {
+	return "data-capture"
+}
 
-	// Get the Run data from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run", request)
-	if err == nil {
-		ntr.AddOutcome("download-run", "Run data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run", "Failed to download run from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
+func (h *dataCaptureHandler) Stages() []api.TaskStage {
+	return AllStages
+}
 
-	// Get the Policy Checks from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "policy-checks", request)
-	if err == nil {
-		ntr.AddOutcome("download-policy-checks", "Policy checks downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-policy-checks", "Failed to download policy checks from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
+func (h *dataCaptureHandler) Handle(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
+	return h.task.CaptureStage(ctx, request, progress)
+}
 
-	// Get the Comments from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "comments", request)
-	if err == nil {
-		ntr.AddOutcome("download-comments", "Comments downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-comments", "Failed to download comments from API", err.Error(), referenceURL, "failed", api.TagLevelError)
+// outcomeBody describes a collector result for the outcome body: the error, the class of
+// API token used, and the retries made.
+func outcomeBody(result collectorResult) string {
+	var lines []string
+	if result.err != nil {
+		lines = append(lines, result.err.Error())
 	}
-
-	// Get the Task Stages from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "task-stages", request)
-	if err == nil {
-		ntr.AddOutcome("download-task-stages", "Task stages downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-task-stages", "Failed to download task stages from API", err.Error(), referenceURL, "failed", api.TagLevelError)
+	if result.artifact != nil {
+		lines = append(lines, fmt.Sprintf("Saved %d bytes, SHA-256 %s.", result.artifact.Size, result.artifact.SHA256))
 	}
-
-	// Get the Run Events from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run-events", request)
-	if err == nil {
-		ntr.AddOutcome("download-run-events", "Run events downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run-events", "Failed to download run events from API", err.Error(), referenceURL, "failed", api.TagLevelError)
+	if result.tokenClass != "" {
+		lines = append(lines, fmt.Sprintf("Fetched with the %s API token.", result.tokenClass))
 	}
-
-	// Set the final result based on whether any outcomes were failures
-	if ntr.IsPassed() {
-		ntr.SetResult(api.TaskPassed, "Pre Apply Stage - Success").
-			WithUrl(referenceURL)
-	} else {
-		ntr.SetResult(api.TaskFailed, "Pre Apply Stage - Failed").
-			WithUrl(referenceURL)
+	if result.retries > 0 {
+		lines = append(lines, fmt.Sprintf("Retried %d API request(s) after rate limiting or server errors.", result.retries))
 	}
+	return strings.Join(lines, "\n\n")
+}
 
-	return ntr, nil
+// stageTitles are the names used for each stage in the result message.
+var stageTitles = map[api.TaskStage]string{
+	api.PrePlan:   "Pre Plan Stage",
+	api.PostPlan:  "Post Plan Stage",
+	api.PreApply:  "Pre Apply Stage",
+	api.PostApply: "Post Apply Stage",
 }
 
-// PostApplyStage is executed after the apply is executed.
-func (r *ScaffoldingRunTask) PostApplyStage(request api.TaskRequest) (*api.TaskResponse, error) {
+// CaptureStage runs the collectors enabled for the stage in the request, each one saving an artifact
+// to the run task directory and adding an outcome. Collectors that have not finished when the
+// context is done are reported as timed out, so the stage returns partial results in time.
+// The ProgressReporter sends "running" updates with the outcomes collected so far,
+// the final passed/failed result is sent by the handler once the stage returns.
+func (r *ScaffoldingRunTask) CaptureStage(ctx context.Context, request api.TaskRequest, progress *ProgressReporter) (*api.TaskResponse, error) {
 	// Demo link to show how to set a URL in the response
 	referenceURL := fmt.Sprintf("https://example.com/task/%s", request.RunID)
+	title := stageTitles[request.Stage]
 
-	r.logger.Println("Running Post-Apply Stage")
+	r.logger.Println("Running", title)
 	ntr := api.NewTaskResponse()
 	runTaskPath, err := request.CreateRunTaskDirectoryStructure()
 	if err != nil {
 		r.logger.Println("Error creating directory:", err)
 		return ntr.AddOutcome("create-directory", "Failed to create directory", err.Error(), referenceURL, "failed", api.TagLevelError).
-			SetResult(api.TaskFailed, "Post-Apply Stage Failed: "+err.Error()), err
-	}
-
-	// Initialize clients used throughout this stage
-	fileManager := helper.NewFileManager()
-	tfcClient := helper.NewClient()
-
-	// Save request to JSON file
-	err = fileManager.SaveStructToFile(runTaskPath, "request.json", request)
-	if err == nil {
-		ntr.AddOutcome("save-request", "Request saved to file successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("save-request", "Failed to save request to file", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Run data from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run", request)
-	if err == nil {
-		ntr.AddOutcome("download-run", "Run data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run", "Failed to download run from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Apply data from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "apply", request)
-	if err == nil {
-		ntr.AddOutcome("download-apply", "Apply data downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-apply", "Failed to download apply from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Apply logs
-	err = tfcClient.GetLogs(runTaskPath, "apply", request)
-	if err == nil {
-		ntr.AddOutcome("download-apply-logs", "Apply logs downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-apply-logs", "Failed to get apply logs", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Policy Checks from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "policy-checks", request)
-	if err == nil {
-		ntr.AddOutcome("download-policy-checks", "Policy checks downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-policy-checks", "Failed to download policy checks from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Comments from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "comments", request)
-	if err == nil {
-		ntr.AddOutcome("download-comments", "Comments downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-comments", "Failed to download comments from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Task Stages from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "task-stages", request)
-	if err == nil {
-		ntr.AddOutcome("download-task-stages", "Task stages downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-task-stages", "Failed to download task stages from API", err.Error(), referenceURL, "failed", api.TagLevelError)
-	}
-
-	// Get the Run Events from API
-	err = tfcClient.GetDataFromAPI(runTaskPath, "run-events", request)
-	if err == nil {
-		ntr.AddOutcome("download-run-events", "Run events downloaded successfully", "", referenceURL, "success", api.TagLevelNone)
-	} else {
-		ntr.AddOutcome("download-run-events", "Failed to download run events from API", err.Error(), referenceURL, "failed", api.TagLevelError)
+			SetResult(api.TaskFailed, title+" Failed: "+err.Error()), err
+	}
+
+	var collectors []Collector
+	for _, c := range r.collectors {
+		if c.RunsIn(request.Stage) {
+			collectors = append(collectors, c)
+		}
+	}
+
+	// Build the outcomes in collector order, so the result reads the same however the downloads interleave
+	buildOutcomes := func(ntr *api.TaskResponse, results []collectorResult, final bool) int {
+		done := 0
+		for i, result := range results {
+			c := collectors[i]
+			switch {
+			case result.done && result.err == nil:
+				ntr.AddOutcome(c.OutcomeID(), c.Title+" saved successfully", outcomeBody(result), referenceURL, "success", api.TagLevelNone)
+			case result.done && errors.Is(result.err, helper.ErrPartialResult):
+				// More pages than the client follows, what was fetched is saved but the stage should know it is incomplete
+				ntr.AddOutcome(c.OutcomeID(), c.Title+" saved partially", outcomeBody(result), referenceURL, "partial", api.TagLevelWarning)
+			case result.done:
+				ntr.AddOutcome(c.OutcomeID(), "Failed to save "+strings.ToLower(c.Title), outcomeBody(result), referenceURL, "failed", api.TagLevelError)
+			case final:
+				ntr.AddOutcome(c.OutcomeID(), "Timed out saving "+strings.ToLower(c.Title), "The collector did not finish before the stage deadline: "+context.Cause(ctx).Error(), referenceURL, "failed", api.TagLevelError)
+			}
+			if result.done {
+				done++
+			}
+		}
+		return done
+	}
+
+	results := r.runCollectors(ctx, collectors, r.config.CollectorParallelism, runTaskPath, request, func(results []collectorResult) {
+		partial := api.NewTaskResponse()
+		done := buildOutcomes(partial, results, false)
+		progress.Report(fmt.Sprintf("Collected %d of %d artifacts", done, len(collectors)), partial)
+	})
+	if done := buildOutcomes(ntr, results, true); done < len(collectors) {
+		r.logger.Printf("%s timed out with %d of %d collectors finished\n", title, done, len(collectors))
 	}
 
 	// Set the final result based on whether any outcomes were failures
 	if ntr.IsPassed() {
-		ntr.SetResult(api.TaskPassed, "Post Apply Stage - Success").
+		ntr.SetResult(api.TaskPassed, title+" - Success").
 			WithUrl(referenceURL)
 	} else {
-		ntr.SetResult(api.TaskFailed, "Post Apply Stage - Failed").
+		ntr.SetResult(api.TaskFailed, title+" - Failed").
 			WithUrl(referenceURL)
 	}
 
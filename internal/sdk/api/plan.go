@@ -0,0 +1,318 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Plan is Terraform's machine-readable plan, as returned by the plan JSON output API
+// (terraform show -json). Values that depend on provider schemas (resource attributes,
+// expressions) are kept as json.RawMessage or generic maps.
+// For large plans prefer helper.DecodeResourceChanges, which streams ResourceChanges one at a time.
+type Plan struct {
+	FormatVersion    string                  `json:"format_version"`
+	TerraformVersion string                  `json:"terraform_version"`
+	Variables        map[string]PlanVariable `json:"variables,omitempty"`
+	PlannedValues    StateValues             `json:"planned_values"`
+	// ResourceDrift lists the changes made outside of Terraform since the last apply.
+	ResourceDrift   []ResourceChange  `json:"resource_drift,omitempty"`
+	ResourceChanges []ResourceChange  `json:"resource_changes,omitempty"`
+	OutputChanges   map[string]Change `json:"output_changes,omitempty"`
+	PriorState      *State            `json:"prior_state,omitempty"`
+	Configuration   Configuration     `json:"configuration"`
+	// RelevantAttributes are the attributes of drifted resources that contributed to the changes.
+	RelevantAttributes []ResourceAttribute `json:"relevant_attributes,omitempty"`
+	Timestamp          string              `json:"timestamp,omitempty"`
+	Applyable          bool                `json:"applyable"`
+	Complete           bool                `json:"complete"`
+	Errored            bool                `json:"errored"`
+}
+
+// PlanVariable is the value of a root module input variable.
+type PlanVariable struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// ResourceAttribute identifies an attribute of a resource by its path.
+type ResourceAttribute struct {
+	Resource  string          `json:"resource"`
+	Attribute json.RawMessage `json:"attribute"`
+}
+
+// Action is a single action Terraform takes on a resource or output.
+type Action string
+
+// Terraform plan actions.
+const (
+	ActionNoOp   Action = "no-op"
+	ActionCreate Action = "create"
+	ActionRead   Action = "read"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	// ActionForget removes a resource from state without destroying it (Terraform 1.7+).
+	ActionForget Action = "forget"
+)
+
+// Actions are the actions of a change. Replacing a resource is two actions,
+// ["delete", "create"] or ["create", "delete"] with create_before_destroy.
+type Actions []Action
+
+// IsNoOp reports whether nothing changes.
+func (a Actions) IsNoOp() bool { return slices.Equal(a, Actions{ActionNoOp}) }
+
+// IsCreate reports whether a new object is created.
+func (a Actions) IsCreate() bool { return slices.Equal(a, Actions{ActionCreate}) }
+
+// IsRead reports whether a data source is read during apply.
+func (a Actions) IsRead() bool { return slices.Equal(a, Actions{ActionRead}) }
+
+// IsUpdate reports whether the object is updated in place.
+func (a Actions) IsUpdate() bool { return slices.Equal(a, Actions{ActionUpdate}) }
+
+// IsDelete reports whether the object is destroyed.
+func (a Actions) IsDelete() bool { return slices.Equal(a, Actions{ActionDelete}) }
+
+// IsForget reports whether the object is removed from state but kept.
+func (a Actions) IsForget() bool { return slices.Equal(a, Actions{ActionForget}) }
+
+// IsReplace reports whether the object is destroyed and re-created, in either order.
+func (a Actions) IsReplace() bool {
+	return slices.Equal(a, Actions{ActionDelete, ActionCreate}) || slices.Equal(a, Actions{ActionCreate, ActionDelete})
+}
+
+// IsDestructive reports whether an existing object is destroyed, by a delete or a replace.
+func (a Actions) IsDestructive() bool {
+	return a.IsDelete() || a.IsReplace()
+}
+
+// String returns the actions the way Terraform describes them, e.g. "create", "delete, create".
+func (a Actions) String() string {
+	names := make([]string, len(a))
+	for i, action := range a {
+		names[i] = string(action)
+	}
+	return strings.Join(names, ", ")
+}
+
+// ResourceChange is the planned change to a single resource instance.
+type ResourceChange struct {
+	Address string `json:"address"`
+	// PreviousAddress is set when the resource was moved.
+	PreviousAddress string          `json:"previous_address,omitempty"`
+	ModuleAddress   string          `json:"module_address,omitempty"`
+	Mode            string          `json:"mode"`
+	Type            string          `json:"type"`
+	Name            string          `json:"name"`
+	Index           json.RawMessage `json:"index,omitempty"`
+	ProviderName    string          `json:"provider_name"`
+	// Deposed is set for a deposed object left by a failed create_before_destroy.
+	Deposed string `json:"deposed,omitempty"`
+	Change  Change `json:"change"`
+	// ActionReason explains the actions, e.g. "replace_because_tainted" or "delete_because_no_resource_config".
+	ActionReason string `json:"action_reason,omitempty"`
+}
+
+// Change describes the before and after values of a resource or output.
+// Before and After are null when the object does not exist before or after the change.
+type Change struct {
+	Actions         Actions         `json:"actions"`
+	Before          json.RawMessage `json:"before,omitempty"`
+	After           json.RawMessage `json:"after,omitempty"`
+	AfterUnknown    json.RawMessage `json:"after_unknown,omitempty"`
+	BeforeSensitive json.RawMessage `json:"before_sensitive,omitempty"`
+	AfterSensitive  json.RawMessage `json:"after_sensitive,omitempty"`
+	// ReplacePaths are the attribute paths that forced a replace.
+	ReplacePaths []json.RawMessage `json:"replace_paths,omitempty"`
+	Importing    *Importing        `json:"importing,omitempty"`
+	// GeneratedConfig is the configuration generated for an import (terraform plan -generate-config-out).
+	GeneratedConfig string `json:"generated_config,omitempty"`
+}
+
+// Importing is set on a change that imports an existing object.
+type Importing struct {
+	ID       string `json:"id,omitempty"`
+	Identity any    `json:"identity,omitempty"`
+}
+
+// State is a Terraform state, the prior state of a plan.
+type State struct {
+	FormatVersion    string      `json:"format_version"`
+	TerraformVersion string      `json:"terraform_version,omitempty"`
+	Values           StateValues `json:"values"`
+}
+
+// StateValues are the outputs and resources of a state, or of the planned state.
+type StateValues struct {
+	Outputs    map[string]StateOutput `json:"outputs,omitempty"`
+	RootModule StateModule            `json:"root_module"`
+}
+
+// StateOutput is the value of a root module output.
+type StateOutput struct {
+	Value     json.RawMessage `json:"value"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+// StateModule holds the resources of a module and its child modules.
+type StateModule struct {
+	Address      string          `json:"address,omitempty"`
+	Resources    []StateResource `json:"resources,omitempty"`
+	ChildModules []StateModule   `json:"child_modules,omitempty"`
+}
+
+// StateResource is a resource instance in a state.
+type StateResource struct {
+	Address         string          `json:"address"`
+	Mode            string          `json:"mode"`
+	Type            string          `json:"type"`
+	Name            string          `json:"name"`
+	Index           json.RawMessage `json:"index,omitempty"`
+	ProviderName    string          `json:"provider_name"`
+	SchemaVersion   int             `json:"schema_version"`
+	Values          map[string]any  `json:"values,omitempty"`
+	SensitiveValues json.RawMessage `json:"sensitive_values,omitempty"`
+	DependsOn       []string        `json:"depends_on,omitempty"`
+	Tainted         bool            `json:"tainted,omitempty"`
+	DeposedKey      string          `json:"deposed_key,omitempty"`
+}
+
+// AllResources returns the resources of the module and every child module, depth first.
+func (m StateModule) AllResources() []StateResource {
+	resources := slices.Clone(m.Resources)
+	for _, child := range m.ChildModules {
+		resources = append(resources, child.AllResources()...)
+	}
+	return resources
+}
+
+// Configuration is the configuration the plan was made from.
+// Expressions are kept as json.RawMessage, see the Terraform JSON output format for their shape.
+type Configuration struct {
+	ProviderConfig map[string]ProviderConfig `json:"provider_config,omitempty"`
+	RootModule     ConfigModule              `json:"root_module"`
+}
+
+// ProviderConfig is a provider block.
+type ProviderConfig struct {
+	Name              string                     `json:"name"`
+	FullName          string                     `json:"full_name,omitempty"`
+	Alias             string                     `json:"alias,omitempty"`
+	ModuleAddress     string                     `json:"module_address,omitempty"`
+	VersionConstraint string                     `json:"version_constraint,omitempty"`
+	Expressions       map[string]json.RawMessage `json:"expressions,omitempty"`
+}
+
+// ConfigModule is a module in the configuration.
+type ConfigModule struct {
+	Outputs     map[string]ConfigOutput   `json:"outputs,omitempty"`
+	Resources   []ConfigResource          `json:"resources,omitempty"`
+	ModuleCalls map[string]ModuleCall     `json:"module_calls,omitempty"`
+	Variables   map[string]ConfigVariable `json:"variables,omitempty"`
+}
+
+// ConfigOutput is an output block.
+type ConfigOutput struct {
+	Expression  json.RawMessage `json:"expression,omitempty"`
+	Sensitive   bool            `json:"sensitive,omitempty"`
+	Description string          `json:"description,omitempty"`
+	DependsOn   []string        `json:"depends_on,omitempty"`
+}
+
+// ConfigResource is a resource or data block.
+type ConfigResource struct {
+	Address           string                     `json:"address"`
+	Mode              string                     `json:"mode"`
+	Type              string                     `json:"type"`
+	Name              string                     `json:"name"`
+	ProviderConfigKey string                     `json:"provider_config_key"`
+	Provisioners      []json.RawMessage          `json:"provisioners,omitempty"`
+	Expressions       map[string]json.RawMessage `json:"expressions,omitempty"`
+	SchemaVersion     int                        `json:"schema_version"`
+	CountExpression   json.RawMessage            `json:"count_expression,omitempty"`
+	ForEachExpression json.RawMessage            `json:"for_each_expression,omitempty"`
+	DependsOn         []string                   `json:"depends_on,omitempty"`
+}
+
+// ModuleCall is a module block and the configuration of the called module.
+type ModuleCall struct {
+	Source            string                     `json:"source"`
+	Expressions       map[string]json.RawMessage `json:"expressions,omitempty"`
+	CountExpression   json.RawMessage            `json:"count_expression,omitempty"`
+	ForEachExpression json.RawMessage            `json:"for_each_expression,omitempty"`
+	Module            ConfigModule               `json:"module"`
+	VersionConstraint string                     `json:"version_constraint,omitempty"`
+	DependsOn         []string                   `json:"depends_on,omitempty"`
+}
+
+// ConfigVariable is a variable block.
+type ConfigVariable struct {
+	Default     json.RawMessage `json:"default,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Sensitive   bool            `json:"sensitive,omitempty"`
+}
+
+// ChangeSummary counts the resource changes of a plan by kind, replaces are not counted as deletes or creates.
+type ChangeSummary struct {
+	Create  int `json:"create"`
+	Update  int `json:"update"`
+	Delete  int `json:"delete"`
+	Replace int `json:"replace"`
+	NoOp    int `json:"no-op"`
+	Read    int `json:"read"`
+	Forget  int `json:"forget"`
+	// Import counts the changes that import an object, whatever their actions.
+	Import int `json:"import"`
+}
+
+// Add counts a resource change.
+func (s *ChangeSummary) Add(change ResourceChange) {
+	actions := change.Change.Actions
+	switch {
+	case actions.IsCreate():
+		s.Create++
+	case actions.IsUpdate():
+		s.Update++
+	case actions.IsDelete():
+		s.Delete++
+	case actions.IsReplace():
+		s.Replace++
+	case actions.IsRead():
+		s.Read++
+	case actions.IsForget():
+		s.Forget++
+	case actions.IsNoOp():
+		s.NoOp++
+	}
+	if change.Change.Importing != nil {
+		s.Import++
+	}
+}
+
+// HasChanges reports whether applying the plan changes any resource.
+func (s ChangeSummary) HasChanges() bool {
+	return s.Create+s.Update+s.Delete+s.Replace+s.Forget+s.Import > 0
+}
+
+// String summarizes the changes like the last line of terraform plan, e.g. "2 to add, 1 to change, 0 to destroy, 1 to replace".
+func (s ChangeSummary) String() string {
+	summary := fmt.Sprintf("%d to add, %d to change, %d to destroy, %d to replace", s.Create, s.Update, s.Delete, s.Replace)
+	if s.Import > 0 {
+		summary = fmt.Sprintf("%d to import, %s", s.Import, summary)
+	}
+	if s.Forget > 0 {
+		summary += fmt.Sprintf(", %d to forget", s.Forget)
+	}
+	return summary
+}
+
+// Summary counts the resource changes of the plan.
+func (p *Plan) Summary() ChangeSummary {
+	var summary ChangeSummary
+	for _, change := range p.ResourceChanges {
+		summary.Add(change)
+	}
+	return summary
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const samplePlan = `{
+  "format_version": "1.2",
+  "terraform_version": "1.9.5",
+  "variables": {"name": {"value": "demo"}},
+  "planned_values": {"outputs": {"id": {"sensitive": false}}, "root_module": {"resources": [
+    {"address": "null_resource.new", "mode": "managed", "type": "null_resource", "name": "new", "provider_name": "registry.terraform.io/hashicorp/null", "schema_version": 0, "values": {"triggers": null}}
+  ], "child_modules": [{"address": "module.child", "resources": [
+    {"address": "module.child.null_resource.a", "mode": "managed", "type": "null_resource", "name": "a", "provider_name": "registry.terraform.io/hashicorp/null", "schema_version": 0}
+  ]}]}},
+  "resource_drift": [
+    {"address": "null_resource.old", "mode": "managed", "type": "null_resource", "name": "old", "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["update"], "before": {}, "after": {}}}
+  ],
+  "resource_changes": [
+    {"address": "null_resource.new", "mode": "managed", "type": "null_resource", "name": "new", "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["create"], "before": null, "after": {"triggers": null}, "after_unknown": {"id": true}}},
+    {"address": "null_resource.old", "mode": "managed", "type": "null_resource", "name": "old", "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["delete"], "before": {"id": "1"}, "after": null}, "action_reason": "delete_because_no_resource_config"},
+    {"address": "null_resource.swap[0]", "mode": "managed", "type": "null_resource", "name": "swap", "index": 0, "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["create", "delete"], "replace_paths": [["triggers"]]}, "action_reason": "replace_because_cannot_update"},
+    {"address": "null_resource.same", "mode": "managed", "type": "null_resource", "name": "same", "provider_name": "registry.terraform.io/hashicorp/null", "change": {"actions": ["no-op"], "importing": {"id": "abc"}}}
+  ],
+  "output_changes": {"id": {"actions": ["create"], "before": null, "after_unknown": true}},
+  "prior_state": {"format_version": "1.0", "terraform_version": "1.9.5", "values": {"root_module": {"resources": [
+    {"address": "null_resource.old", "mode": "managed", "type": "null_resource", "name": "old", "provider_name": "registry.terraform.io/hashicorp/null", "schema_version": 0, "values": {"id": "1"}}
+  ]}}},
+  "configuration": {"provider_config": {"null": {"name": "null", "full_name": "registry.terraform.io/hashicorp/null"}}, "root_module": {
+    "resources": [{"address": "null_resource.new", "mode": "managed", "type": "null_resource", "name": "new", "provider_config_key": "null", "schema_version": 0}],
+    "module_calls": {"child": {"source": "./child", "module": {"resources": [{"address": "null_resource.a", "mode": "managed", "type": "null_resource", "name": "a", "provider_config_key": "null", "schema_version": 0}]}}},
+    "variables": {"name": {"default": "demo"}}
+  }},
+  "applyable": true,
+  "complete": true,
+  "errored": false
+}`
+
+// Every section of the plan JSON format is decoded
+func TestPlanDecode(t *testing.T) {
+	var plan Plan
+	if err := json.Unmarshal([]byte(samplePlan), &plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.TerraformVersion != "1.9.5" || !plan.Applyable || len(plan.ResourceChanges) != 4 || len(plan.ResourceDrift) != 1 {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	if !plan.OutputChanges["id"].Actions.IsCreate() {
+		t.Fatalf("unexpected output changes: %+v", plan.OutputChanges)
+	}
+	if plan.PriorState == nil || plan.PriorState.Values.RootModule.Resources[0].Values["id"] != "1" {
+		t.Fatalf("unexpected prior state: %+v", plan.PriorState)
+	}
+	if len(plan.PlannedValues.RootModule.AllResources()) != 2 {
+		t.Fatalf("expected the child module resources to be included")
+	}
+	if plan.Configuration.RootModule.ModuleCalls["child"].Source != "./child" {
+		t.Fatalf("unexpected configuration: %+v", plan.Configuration)
+	}
+	if plan.ResourceChanges[3].Change.Importing == nil || plan.ResourceChanges[3].Change.Importing.ID != "abc" {
+		t.Fatalf("expected the import to be decoded")
+	}
+}
+
+// Replaces are counted separately from creates and deletes, in either order
+func TestPlanSummary(t *testing.T) {
+	var plan Plan
+	if err := json.Unmarshal([]byte(samplePlan), &plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	summary := plan.Summary()
+	want := ChangeSummary{Create: 1, Delete: 1, Replace: 1, NoOp: 1, Import: 1}
+	if summary != want {
+		t.Fatalf("expected %+v, got %+v", want, summary)
+	}
+	if summary.String() != "1 to import, 1 to add, 0 to change, 1 to destroy, 1 to replace" {
+		t.Fatalf("unexpected summary: %s", summary)
+	}
+
+	for _, tc := range []struct {
+		actions     Actions
+		destructive bool
+	}{
+		{Actions{ActionDelete, ActionCreate}, true},
+		{Actions{ActionCreate, ActionDelete}, true},
+		{Actions{ActionDelete}, true},
+		{Actions{ActionForget}, false},
+		{Actions{ActionUpdate}, false},
+	} {
+		if tc.actions.IsDestructive() != tc.destructive {
+			t.Errorf("expected %s destructive to be %t", tc.actions, tc.destructive)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// JSON:API resource types returned by the HCP Terraform runs API.
+const (
+	RunType         = "runs"
+	PlanType        = "plans"
+	ApplyType       = "applies"
+	PolicyCheckType = "policy-checks"
+	CommentType     = "comments"
+	TaskStageType   = "task-stages"
+	RunEventType    = "run-events"
+)
+
+// Document is a JSON:API document with a single primary resource.
+type Document[T any] struct {
+	Data     Resource[T]   `json:"data"`
+	Included []RawResource `json:"included,omitempty"`
+}
+
+// ListDocument is a JSON:API document with a list of primary resources.
+type ListDocument[T any] struct {
+	Data     []Resource[T]  `json:"data"`
+	Included []RawResource  `json:"included,omitempty"`
+	Links    map[string]any `json:"links,omitempty"`
+	Meta     map[string]any `json:"meta,omitempty"`
+}
+
+// Resource is a JSON:API resource object with typed attributes.
+type Resource[T any] struct {
+	ID            string                  `json:"id"`
+	Type          string                  `json:"type"`
+	Attributes    T                       `json:"attributes"`
+	Relationships map[string]Relationship `json:"relationships,omitempty"`
+	Links         map[string]any          `json:"links,omitempty"`
+}
+
+// RawResource is a resource whose attributes have not been decoded yet, used for included resources.
+type RawResource = Resource[json.RawMessage]
+
+// ResourceIdentifier identifies a related resource.
+type ResourceIdentifier struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// Relationship links a resource to one or many other resources.
+type Relationship struct {
+	// Data is a single ResourceIdentifier, a list of them, or null.
+	Data  json.RawMessage `json:"data,omitempty"`
+	Links map[string]any  `json:"links,omitempty"`
+}
+
+// Identifiers returns the related resources, whether the relationship is to-one or to-many.
+func (r Relationship) Identifiers() ([]ResourceIdentifier, error) {
+	data := bytes.TrimSpace(r.Data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	if data[0] == '[' {
+		var ids []ResourceIdentifier
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, fmt.Errorf("failed to decode relationship: %w", err)
+		}
+		return ids, nil
+	}
+	var id ResourceIdentifier
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("failed to decode relationship: %w", err)
+	}
+	return []ResourceIdentifier{id}, nil
+}
+
+// Related returns the included resource the named relationship of the resource points to,
+// decoding its attributes into T. It returns nil if the relationship or the resource was not included.
+func Related[T, R any](resource Resource[R], included []RawResource, relationship string) (*Resource[T], error) {
+	ids, err := resource.Relationships[relationship].Identifiers()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return FindIncluded[T](included, ids[0].Type, ids[0].ID)
+}
+
+// FindIncluded finds an included resource by type and ID and decodes its attributes into T.
+// It returns nil if the resource is not included.
+func FindIncluded[T any](included []RawResource, resourceType, id string) (*Resource[T], error) {
+	for _, raw := range included {
+		if raw.Type != resourceType || raw.ID != id {
+			continue
+		}
+		resource := &Resource[T]{ID: raw.ID, Type: raw.Type, Relationships: raw.Relationships, Links: raw.Links}
+		if len(raw.Attributes) > 0 {
+			if err := json.Unmarshal(raw.Attributes, &resource.Attributes); err != nil {
+				return nil, fmt.Errorf("failed to decode included %s %s: %w", resourceType, id, err)
+			}
+		}
+		return resource, nil
+	}
+	return nil, nil
+}
+
+// RunAttributes are the attributes of a run.
+type RunAttributes struct {
+	Status           string               `json:"status"`
+	Message          string               `json:"message"`
+	Source           string               `json:"source"`
+	TriggerReason    string               `json:"trigger-reason"`
+	IsDestroy        bool                 `json:"is-destroy"`
+	HasChanges       bool                 `json:"has-changes"`
+	AutoApply        bool                 `json:"auto-apply"`
+	PlanOnly         bool                 `json:"plan-only"`
+	Refresh          bool                 `json:"refresh"`
+	RefreshOnly      bool                 `json:"refresh-only"`
+	AllowEmptyApply  bool                 `json:"allow-empty-apply"`
+	SavePlan         bool                 `json:"save-plan"`
+	TargetAddrs      []string             `json:"target-addrs"`
+	ReplaceAddrs     []string             `json:"replace-addrs"`
+	Variables        []RunVariable        `json:"variables"`
+	CreatedAt        time.Time            `json:"created-at"`
+	StatusTimestamps map[string]time.Time `json:"status-timestamps"`
+	Actions          map[string]bool      `json:"actions"`
+	Permissions      map[string]bool      `json:"permissions"`
+}
+
+// RunVariable is a run-specific variable value.
+type RunVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PlanAttributes are the attributes of a plan.
+type PlanAttributes struct {
+	Status               string               `json:"status"`
+	HasChanges           bool                 `json:"has-changes"`
+	LogReadURL           string               `json:"log-read-url"`
+	ResourceAdditions    int                  `json:"resource-additions"`
+	ResourceChanges      int                  `json:"resource-changes"`
+	ResourceDestructions int                  `json:"resource-destructions"`
+	ResourceImports      int                  `json:"resource-imports"`
+	StatusTimestamps     map[string]time.Time `json:"status-timestamps"`
+}
+
+// ApplyAttributes are the attributes of an apply.
+type ApplyAttributes struct {
+	Status               string               `json:"status"`
+	LogReadURL           string               `json:"log-read-url"`
+	ResourceAdditions    int                  `json:"resource-additions"`
+	ResourceChanges      int                  `json:"resource-changes"`
+	ResourceDestructions int                  `json:"resource-destructions"`
+	ResourceImports      int                  `json:"resource-imports"`
+	StatusTimestamps     map[string]time.Time `json:"status-timestamps"`
+}
+
+// PolicyCheckAttributes are the attributes of a Sentinel policy check.
+type PolicyCheckAttributes struct {
+	Status           string               `json:"status"`
+	Scope            string               `json:"scope"`
+	Result           PolicyCheckResult    `json:"result"`
+	StatusTimestamps map[string]time.Time `json:"status-timestamps"`
+	Actions          map[string]bool      `json:"actions"`
+	Permissions      map[string]bool      `json:"permissions"`
+}
+
+// PolicyCheckResult summarizes the policies evaluated by a policy check.
+type PolicyCheckResult struct {
+	Result         bool            `json:"result"`
+	Passed         int             `json:"passed"`
+	TotalFailed    int             `json:"total-failed"`
+	HardFailed     int             `json:"hard-failed"`
+	SoftFailed     int             `json:"soft-failed"`
+	AdvisoryFailed int             `json:"advisory-failed"`
+	DurationMs     int             `json:"duration-ms"`
+	Sentinel       json.RawMessage `json:"sentinel,omitempty"`
+}
+
+// CommentAttributes are the attributes of a run comment.
+type CommentAttributes struct {
+	Body string `json:"body"`
+}
+
+// TaskStageAttributes are the attributes of a task stage.
+type TaskStageAttributes struct {
+	Status           string               `json:"status"`
+	Stage            TaskStage            `json:"stage"`
+	StatusTimestamps map[string]time.Time `json:"status-timestamps"`
+	CreatedAt        time.Time            `json:"created-at"`
+	UpdatedAt        time.Time            `json:"updated-at"`
+	Actions          map[string]bool      `json:"actions"`
+	Permissions      map[string]bool      `json:"permissions"`
+}
+
+// RunEventAttributes are the attributes of a run event.
+type RunEventAttributes struct {
+	Action      string    `json:"action"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created-at"`
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const runWithIncludedPlan = `{
+  "data": {
+    "id": "run-123",
+    "type": "runs",
+    "attributes": {"status": "planned", "is-destroy": false, "has-changes": true, "target-addrs": ["aws_instance.web"]},
+    "relationships": {
+      "plan": {"data": {"id": "plan-456", "type": "plans"}},
+      "comments": {"data": [{"id": "wsc-1", "type": "comments"}, {"id": "wsc-2", "type": "comments"}]},
+      "apply": {"data": null}
+    }
+  },
+  "included": [
+    {"id": "plan-456", "type": "plans", "attributes": {"status": "finished", "log-read-url": "https://archivist.terraform.io/v1/object/abc", "resource-destructions": 2}}
+  ]
+}`
+
+// Typed attributes are decoded and included resources are found through relationships
+func TestDocumentRelatedIncluded(t *testing.T) {
+	var run Document[RunAttributes]
+	if err := json.Unmarshal([]byte(runWithIncludedPlan), &run); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if run.Data.Attributes.Status != "planned" || !run.Data.Attributes.HasChanges || run.Data.Attributes.TargetAddrs[0] != "aws_instance.web" {
+		t.Fatalf("unexpected run attributes: %+v", run.Data.Attributes)
+	}
+
+	plan, err := Related[PlanAttributes](run.Data, run.Included, "plan")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan == nil || plan.ID != "plan-456" || plan.Attributes.ResourceDestructions != 2 || plan.Attributes.LogReadURL == "" {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+
+	// Null and missing relationships have no related resource
+	for _, name := range []string{"apply", "workspace"} {
+		if related, err := Related[ApplyAttributes](run.Data, run.Included, name); err != nil || related != nil {
+			t.Fatalf("expected no %s, got %+v (%v)", name, related, err)
+		}
+	}
+}
+
+func TestRelationshipIdentifiers(t *testing.T) {
+	var run Document[RunAttributes]
+	if err := json.Unmarshal([]byte(runWithIncludedPlan), &run); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	comments, err := run.Data.Relationships["comments"].Identifiers()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(comments) != 2 || comments[1].ID != "wsc-2" || comments[1].Type != CommentType {
+		t.Fatalf("unexpected comment identifiers: %+v", comments)
+	}
+}
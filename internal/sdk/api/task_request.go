@@ -64,9 +64,8 @@ func (r TaskRequest) IsEndpointValidation() bool {
 	return r.AccessToken == verificationToken
 }
 
-// During at Task execution for a specific stage, create the directory structure
-// and save the directory to the TaskRequest struct for easy access later.
-func (r *TaskRequest) CreateRunTaskDirectoryStructure() (string, error) {
+// RunTaskDirectory returns the directory used for the stage of this request, without creating it.
+func (r *TaskRequest) RunTaskDirectory() string {
 	// Prefix the stage folder with a number to make it easier to read
 	var stageFolder string
 	stageString := string(r.Stage)
@@ -82,7 +81,13 @@ func (r *TaskRequest) CreateRunTaskDirectoryStructure() (string, error) {
 	default:
 		stageFolder = stageString
 	}
-	path := filepath.Join(".", r.WorkspaceName, r.RunID, stageFolder)
+	return filepath.Join(".", r.WorkspaceName, r.RunID, stageFolder)
+}
+
+// During at Task execution for a specific stage, create the directory structure
+// and save the directory to the TaskRequest struct for easy access later.
+func (r *TaskRequest) CreateRunTaskDirectoryStructure() (string, error) {
+	path := r.RunTaskDirectory()
 	r.TaskDirectory = path
 	// Create folder tree if not present
 	err := os.MkdirAll(path, os.ModePerm)
@@ -4,6 +4,10 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
 	"strings"
 )
 
@@ -33,25 +37,14 @@ func NewTaskResponse() *TaskResponse {
 // Add an outcome to the TaskResponse
 // Think of this like a step of the Run Task
 // You can have any number of outcomes (including zero)
+// Use NewOutcome and AppendOutcome for outcomes with more than one status tag, or severity and custom tags
 func (r *TaskResponse) AddOutcome(outcomeId string, description string, body string, url string, label string, level ResponseTagLevel) *TaskResponse {
-	outcome := ResponseOutcome{
-		Type: "task-result-outcomes",
-		Attributes: ResponseOutcomeAttributes{
-			OutcomeID:   outcomeId,
-			Description: description,
-			Body:        body,
-			URL:         url,
-			Tags: Tags{
-				Status: []Tag{
-					{
-						Label: label,
-						Level: level,
-					},
-				},
-			},
-		},
-	}
-	r.Data.Relationships.Outcomes.Data = append(r.Data.Relationships.Outcomes.Data, outcome)
+	return r.AppendOutcome(NewOutcome(outcomeId, description).WithBody(body).WithURL(url).AddStatusTag(label, level))
+}
+
+// Append an outcome built with NewOutcome to the TaskResponse
+func (r *TaskResponse) AppendOutcome(outcome *ResponseOutcome) *TaskResponse {
+	r.Data.Relationships.Outcomes.Data = append(r.Data.Relationships.Outcomes.Data, *outcome)
 	return r
 }
 
@@ -73,7 +66,21 @@ func (r *TaskResponse) WithUrl(url string) *TaskResponse {
 	return r
 }
 
-// IsPassed checks if the TaskResponse has any outcomes with error tags
+// Validate checks every outcome of the TaskResponse, see ResponseOutcome.Validate
+func (r *TaskResponse) Validate() error {
+	if r.Data.Relationships == nil {
+		return nil
+	}
+	for _, outcome := range r.Data.Relationships.Outcomes.Data {
+		if err := outcome.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsPassed checks if the TaskResponse has any outcomes with error status tags
+// Severity and custom tags are for triage and don't fail the task
 func (r *TaskResponse) IsPassed() bool {
 	for _, outcome := range r.Data.Relationships.Outcomes.Data {
 		for _, tag := range outcome.Attributes.Tags.Status {
@@ -112,12 +119,76 @@ type ResponseOutcomeAttributes struct {
 	URL         string `json:"url,omitempty"`
 }
 
-// You can add additional tags here if needed
-// KIS here and just add to the Status tags for now
+// NewOutcome creates an outcome without tags
+// Add tags with AddStatusTag, AddSeverityTag and AddCustomTag, then add it with TaskResponse.AppendOutcome
+func NewOutcome(outcomeId string, description string) *ResponseOutcome {
+	return &ResponseOutcome{
+		Type: "task-result-outcomes",
+		Attributes: ResponseOutcomeAttributes{
+			OutcomeID:   outcomeId,
+			Description: description,
+		},
+	}
+}
+
+// Set the markdown body of the outcome
+func (o *ResponseOutcome) WithBody(body string) *ResponseOutcome {
+	o.Attributes.Body = body
+	return o
+}
+
+// Set the URL of the outcome
+func (o *ResponseOutcome) WithURL(url string) *ResponseOutcome {
+	o.Attributes.URL = url
+	return o
+}
+
+// Add a status tag to the outcome, any error status tag fails the task
+func (o *ResponseOutcome) AddStatusTag(label string, level ResponseTagLevel) *ResponseOutcome {
+	o.Attributes.Tags.Status = append(o.Attributes.Tags.Status, Tag{Label: label, Level: level})
+	return o
+}
+
+// Add a severity tag to the outcome, e.g. "High" with TagLevelError
+func (o *ResponseOutcome) AddSeverityTag(label string, level ResponseTagLevel) *ResponseOutcome {
+	o.Attributes.Tags.Severity = append(o.Attributes.Tags.Severity, Tag{Label: label, Level: level})
+	return o
+}
+
+// Add a custom tag to the outcome, shown in its own column of the outcome table
+func (o *ResponseOutcome) AddCustomTag(label string, level ResponseTagLevel) *ResponseOutcome {
+	o.Attributes.Tags.Custom = append(o.Attributes.Tags.Custom, Tag{Label: label, Level: level})
+	return o
+}
+
+// Validate checks the outcome has an ID and that every tag has a label and an allowed level
+func (o ResponseOutcome) Validate() error {
+	if o.Attributes.OutcomeID == "" {
+		return fmt.Errorf("outcome has no outcome-id")
+	}
+	for _, group := range []struct {
+		kind string
+		tags []Tag
+	}{
+		{"status", o.Attributes.Tags.Status},
+		{"severity", o.Attributes.Tags.Severity},
+		{"custom", o.Attributes.Tags.Custom},
+	} {
+		for _, tag := range group.tags {
+			if err := tag.Validate(); err != nil {
+				return fmt.Errorf("outcome %s has an invalid %s tag: %w", o.Attributes.OutcomeID, group.kind, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Tags are shown as columns of the outcome table in HCP Terraform
+// Status tags decide if the outcome failed, severity and custom tags help triage it
 type Tags struct {
-	Status []Tag `json:"status,omitempty"`
-	// Severity []Tag `json:"severity,omitempty"`
-	// Custom   []Tag `json:"custom,omitempty"`
+	Status   []Tag `json:"status,omitempty"`
+	Severity []Tag `json:"severity,omitempty"`
+	Custom   []Tag `json:"custom,omitempty"`
 }
 
 type ResponseTagLevel string
@@ -129,11 +200,55 @@ const (
 	TagLevelError   ResponseTagLevel = "error"
 )
 
+// TagLevels are the levels HCP Terraform accepts for a tag
+var TagLevels = []ResponseTagLevel{TagLevelNone, TagLevelInfo, TagLevelWarning, TagLevelError}
+
+// ErrInvalidTagLevel is returned for a tag level HCP Terraform does not accept
+var ErrInvalidTagLevel = errors.New("invalid tag level, expected none, info, warning or error")
+
+// IsValid reports whether HCP Terraform accepts the level
+func (l ResponseTagLevel) IsValid() bool {
+	return slices.Contains(TagLevels, l)
+}
+
+// ParseTagLevel returns the level named s, or ErrInvalidTagLevel
+func ParseTagLevel(s string) (ResponseTagLevel, error) {
+	if level := ResponseTagLevel(s); level.IsValid() {
+		return level, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidTagLevel, s)
+}
+
+// UnmarshalJSON rejects levels HCP Terraform does not accept
+func (l *ResponseTagLevel) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	level, err := ParseTagLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
 type Tag struct {
 	Label string           `json:"label"`
 	Level ResponseTagLevel `json:"level"` // none, info, warning, error
 }
 
+// Validate checks the tag has a label and an allowed level
+func (t Tag) Validate() error {
+	if t.Label == "" {
+		return fmt.Errorf("tag has no label")
+	}
+	if !t.Level.IsValid() {
+		return fmt.Errorf("tag %s: %w: %q", t.Label, ErrInvalidTagLevel, t.Level)
+	}
+	return nil
+}
+
 type ResponseAttributes struct {
 	Message string     `json:"message,omitempty"`
 	Status  TaskStatus `json:"status"`
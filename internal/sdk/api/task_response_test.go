@@ -1,6 +1,12 @@
 package api
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 // Verify NewTaskResponse sets defaults and empty outcomes
 func TestNewTaskResponseDefaults(t *testing.T) {
@@ -107,6 +113,104 @@ func TestIsPassed(t *testing.T) {
 	}
 }
 
+// Outcomes can carry several status, severity and custom tags
+func TestOutcomeBuilderTags(t *testing.T) {
+	r := NewTaskResponse().AppendOutcome(NewOutcome("cve-1", "Vulnerable package").
+		WithBody("body").
+		WithURL("https://example.com/cve-1").
+		AddStatusTag("Failed", TagLevelError).
+		AddStatusTag("New", TagLevelInfo).
+		AddSeverityTag("High", TagLevelError).
+		AddCustomTag("team-web", TagLevelNone).
+		AddCustomTag("PCI", TagLevelWarning))
+
+	o := r.Data.Relationships.Outcomes.Data[0].Attributes
+	want := Tags{
+		Status:   []Tag{{Label: "Failed", Level: TagLevelError}, {Label: "New", Level: TagLevelInfo}},
+		Severity: []Tag{{Label: "High", Level: TagLevelError}},
+		Custom:   []Tag{{Label: "team-web", Level: TagLevelNone}, {Label: "PCI", Level: TagLevelWarning}},
+	}
+	if o.OutcomeID != "cve-1" || o.Body != "body" || o.URL != "https://example.com/cve-1" || !reflect.DeepEqual(o.Tags, want) {
+		t.Fatalf("unexpected outcome: %+v", o)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.IsPassed() {
+		t.Fatalf("expected IsPassed false for an error status tag")
+	}
+
+	// severity and custom tags don't fail the task
+	triage := NewTaskResponse().AppendOutcome(NewOutcome("a", "").AddStatusTag("ok", TagLevelInfo).AddSeverityTag("Critical", TagLevelError))
+	if !triage.IsPassed() {
+		t.Fatalf("expected IsPassed true when only a severity tag is an error")
+	}
+}
+
+// Tags need a label and a level HCP Terraform accepts
+func TestOutcomeValidation(t *testing.T) {
+	for _, level := range TagLevels {
+		if _, err := ParseTagLevel(string(level)); err != nil {
+			t.Fatalf("unexpected error for %s: %v", level, err)
+		}
+	}
+	if _, err := ParseTagLevel("critical"); !errors.Is(err, ErrInvalidTagLevel) {
+		t.Fatalf("expected ErrInvalidTagLevel, got %v", err)
+	}
+
+	for name, o := range map[string]*ResponseOutcome{
+		"no id":           NewOutcome("", "d").AddStatusTag("ok", TagLevelInfo),
+		"bad status":      NewOutcome("a", "d").AddStatusTag("ok", "fatal"),
+		"bad severity":    NewOutcome("a", "d").AddSeverityTag("High", "high"),
+		"bad custom":      NewOutcome("a", "d").AddCustomTag("team", ""),
+		"empty label":     NewOutcome("a", "d").AddCustomTag("", TagLevelInfo),
+		"uppercase level": NewOutcome("a", "d").AddStatusTag("ok", "Error"),
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := NewTaskResponse().AppendOutcome(NewOutcome("a", "d").AddSeverityTag("High", "high")).Validate(); !errors.Is(err, ErrInvalidTagLevel) {
+		t.Fatalf("expected ErrInvalidTagLevel from the response, got %v", err)
+	}
+}
+
+// Outcomes survive a JSON round trip, and unknown levels are rejected when decoding
+func TestTaskResponseJSONRoundTrip(t *testing.T) {
+	r := NewTaskResponse().
+		AppendOutcome(NewOutcome("cve-1", "Vulnerable package").
+			WithBody("**body**").
+			AddStatusTag("Failed", TagLevelError).
+			AddSeverityTag("High", TagLevelError).
+			AddCustomTag("team-web", TagLevelNone)).
+		AddOutcome("plain", "Plain", "", "", "Passed", TagLevelNone).
+		SetResult(TaskFailed, "1 failure")
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(data), `"tags":{"status":[{"label":"Failed","level":"error"}],"severity":[{"label":"High","level":"error"}],"custom":[{"label":"team-web","level":"none"}]}`) {
+		t.Fatalf("unexpected tags JSON: %s", data)
+	}
+	if !strings.Contains(string(data), `"tags":{"status":[{"label":"Passed","level":"none"}]}`) {
+		t.Fatalf("expected empty severity and custom tags to be left out: %s", data)
+	}
+
+	var decoded TaskResponse
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, r) {
+		t.Fatalf("round trip mismatch:\n got: %+v\nwant: %+v", decoded, r)
+	}
+
+	invalid := strings.Replace(string(data), `"level":"none"`, `"level":"critical"`, 1)
+	if err := json.Unmarshal([]byte(invalid), &decoded); !errors.Is(err, ErrInvalidTagLevel) {
+		t.Fatalf("expected ErrInvalidTagLevel, got %v", err)
+	}
+}
+
 func TestJsonApiMediaTypeHeaderConstant(t *testing.T) {
 	if JsonApiMediaTypeHeader != "application/vnd.api+json" {
 		t.Fatalf("unexpected JsonApiMediaTypeHeader: %q", JsonApiMediaTypeHeader)
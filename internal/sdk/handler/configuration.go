@@ -3,6 +3,34 @@
 
 package handler
 
+import (
+	"crypto/x509"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultDrainTimeout is how long the server waits for in-flight stages on shutdown.
+	DefaultDrainTimeout = 30 * time.Second
+	// DefaultWorkers is the number of stages that run at the same time.
+	DefaultWorkers = 4
+	// DefaultQueueLimit is the number of stages that can wait for a worker before requests are rejected.
+	DefaultQueueLimit = 100
+	// TaskResultDeadline is how long HCP Terraform waits to hear back about a task result, with a progress
+	// update or the final result, before it errors the task. The stage timeout, the progress interval and
+	// how long a callback is retried are all derived from it.
+	TaskResultDeadline = 10 * time.Minute
+	// DefaultStageTimeout is how long a stage may run before it reports partial results.
+	// A fifth of TaskResultDeadline is left for the callback.
+	DefaultStageTimeout = TaskResultDeadline * 4 / 5
+	// DefaultCollectorParallelism is the number of collectors that run at the same time within a stage.
+	DefaultCollectorParallelism = 4
+	// DefaultScriptTimeout is how long a Starlark script may run.
+	DefaultScriptTimeout = 10 * time.Second
+	// DefaultScriptMaxSteps is the number of Starlark execution steps a script may take.
+	DefaultScriptMaxSteps = 10_000_000
+)
+
 type Configuration struct {
 	// Addr specifies the TCP address for the server to listen on.
 	Addr string
@@ -11,4 +39,186 @@ type Configuration struct {
 	Path string
 	// HmacKey defines the HMAC Key used for verifying the TFC request.
 	HmacKey string
+	// HmacKeys defines every HMAC key accepted when verifying the TFC request, including HmacKey.
+	HmacKeys *KeySet
+	// AllowedHosts defines the HCP Terraform/TFE hosts (optionally host:port) the server will call with URLs from the request.
+	// The permissive API token is only ever sent to these hosts.
+	AllowedHosts []string
+	// RedactFields defines extra JSON field names masked in saved files, in addition to access tokens and other default sensitive fields.
+	RedactFields []string
+	// Secrets provides the HMAC key and API token from key files, a mounted secret directory, or the environment.
+	Secrets SecretProvider
+	// DrainTimeout defines how long to wait for in-flight stages and callbacks to finish on shutdown.
+	// Anything still running afterwards is persisted and resumed on the next start.
+	DrainTimeout time.Duration
+	// Workers defines how many stages run concurrently.
+	Workers int
+	// QueueLimit defines how many stages can wait for a worker before new requests are rejected as overloaded.
+	QueueLimit int
+	// StageTimeout defines the deadline for a stage, collectors still running afterwards are reported as timed out.
+	StageTimeout time.Duration
+	// CollectorParallelism defines how many collectors run concurrently within a stage.
+	CollectorParallelism int
+	// ConnectTimeout, TLSHandshakeTimeout and ResponseTimeout bound the outbound calls to HCP Terraform/TFE.
+	// Zero uses the client defaults.
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	ResponseTimeout     time.Duration
+	// RootCAs defines the certificates trusted for outbound calls, nil uses the system roots.
+	RootCAs *x509.CertPool
+	// ProxyURL defines the HTTP proxy for outbound calls, nil uses the proxy environment variables.
+	ProxyURL *url.URL
+	// MaxRetries defines how often an API request is retried after a 429 or 5xx response.
+	MaxRetries int
+	// RateLimit defines the requests per second sent to each HCP Terraform/TFE host, shared by every run.
+	RateLimit float64
+	// PageSize defines the page size requested from list endpoints such as comments and run events.
+	PageSize int
+	// MaxPages defines how many pages of a list endpoint are followed before the result is reported as partial.
+	MaxPages int
+	// Tokens defines per-hostname and per-organization API tokens, tried after the run-scoped token
+	// from the request and before the permissive TERRAFORM_API_TOKEN.
+	Tokens TokenMap
+	// MaxPlanJSONSize defines the largest plan JSON downloaded in bytes, larger plans fail the collector.
+	MaxPlanJSONSize int64
+	// IndentPlanJSON defines if the plan JSON is re-indented while it is saved.
+	IndentPlanJSON bool
+	// ScriptTimeout defines how long a Starlark script may run before it is cancelled, zero for no limit.
+	ScriptTimeout time.Duration
+	// ScriptMaxSteps defines the Starlark execution steps a script may take before it is cancelled, zero for no limit.
+	ScriptMaxSteps uint64
+}
+
+// Option customizes the Configuration beyond the required settings.
+type Option func(*Configuration)
+
+// WithDrainTimeout sets the Configuration DrainTimeout.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(c *Configuration) {
+		c.DrainTimeout = timeout
+	}
+}
+
+// WithWorkers sets the Configuration Workers.
+func WithWorkers(workers int) Option {
+	return func(c *Configuration) {
+		c.Workers = workers
+	}
+}
+
+// WithQueueLimit sets the Configuration QueueLimit.
+func WithQueueLimit(limit int) Option {
+	return func(c *Configuration) {
+		c.QueueLimit = limit
+	}
+}
+
+// WithStageTimeout sets the Configuration StageTimeout.
+func WithStageTimeout(timeout time.Duration) Option {
+	return func(c *Configuration) {
+		c.StageTimeout = timeout
+	}
+}
+
+// WithCollectorParallelism sets the Configuration CollectorParallelism.
+func WithCollectorParallelism(parallelism int) Option {
+	return func(c *Configuration) {
+		c.CollectorParallelism = parallelism
+	}
+}
+
+// WithHTTPTimeouts sets the Configuration ConnectTimeout, TLSHandshakeTimeout and ResponseTimeout.
+func WithHTTPTimeouts(connect, tlsHandshake, response time.Duration) Option {
+	return func(c *Configuration) {
+		c.ConnectTimeout = connect
+		c.TLSHandshakeTimeout = tlsHandshake
+		c.ResponseTimeout = response
+	}
+}
+
+// WithRootCAs sets the Configuration RootCAs.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *Configuration) {
+		c.RootCAs = pool
+	}
+}
+
+// WithProxyURL sets the Configuration ProxyURL.
+func WithProxyURL(proxy *url.URL) Option {
+	return func(c *Configuration) {
+		c.ProxyURL = proxy
+	}
+}
+
+// WithMaxRetries sets the Configuration MaxRetries.
+func WithMaxRetries(retries int) Option {
+	return func(c *Configuration) {
+		c.MaxRetries = retries
+	}
+}
+
+// WithRateLimit sets the Configuration RateLimit.
+func WithRateLimit(requestsPerSecond float64) Option {
+	return func(c *Configuration) {
+		c.RateLimit = requestsPerSecond
+	}
+}
+
+// WithPagination sets the Configuration PageSize and MaxPages.
+func WithPagination(pageSize, maxPages int) Option {
+	return func(c *Configuration) {
+		c.PageSize = pageSize
+		c.MaxPages = maxPages
+	}
+}
+
+// WithTokens sets the Configuration Tokens.
+func WithTokens(tokens TokenMap) Option {
+	return func(c *Configuration) {
+		c.Tokens = tokens
+	}
+}
+
+// WithPlanJSON sets the Configuration MaxPlanJSONSize and IndentPlanJSON.
+func WithPlanJSON(maxSize int64, indent bool) Option {
+	return func(c *Configuration) {
+		c.MaxPlanJSONSize = maxSize
+		c.IndentPlanJSON = indent
+	}
+}
+
+// WithScriptLimits sets the Configuration ScriptTimeout and ScriptMaxSteps.
+func WithScriptLimits(timeout time.Duration, maxSteps uint64) Option {
+	return func(c *Configuration) {
+		c.ScriptTimeout = timeout
+		c.ScriptMaxSteps = maxSteps
+	}
+}
+
+// WithHmacKeys sets the Configuration HmacKeys, replacing the key set built from HmacKey.
+func WithHmacKeys(keys *KeySet) Option {
+	return func(c *Configuration) {
+		c.HmacKeys = keys
+	}
+}
+
+// WithSecrets sets the Configuration Secrets.
+func WithSecrets(secrets SecretProvider) Option {
+	return func(c *Configuration) {
+		c.Secrets = secrets
+	}
+}
+
+// WithRedactFields sets the Configuration RedactFields.
+func WithRedactFields(fields ...string) Option {
+	return func(c *Configuration) {
+		c.RedactFields = fields
+	}
+}
+
+// WithAllowedHosts sets the Configuration AllowedHosts.
+func WithAllowedHosts(hosts ...string) Option {
+	return func(c *Configuration) {
+		c.AllowedHosts = hosts
+	}
 }
@@ -0,0 +1,257 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// HmacKey is one of the keys HCP Terraform may use to sign requests.
+// Label identifies the key in the logs, it is never the key itself.
+type HmacKey struct {
+	Key       string     `json:"key"`
+	Label     string     `json:"label,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// IsActive returns true if the key has not expired at the given time.
+func (k HmacKey) IsActive(now time.Time) bool {
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// keyFile is the format of the HMAC key file.
+//
+//	{
+//	  "keys": [
+//	    {"label": "2024-q4", "key": "...", "expires_at": "2025-01-15T00:00:00Z"},
+//	    {"label": "2025-q1", "key": "..."}
+//	  ]
+//	}
+type keyFile struct {
+	Keys []HmacKey `json:"keys"`
+}
+
+// KeySet holds every HMAC key the server accepts, so the key on the organization run task
+// can be rotated without an outage: add the new key, update the run task, then expire the old key.
+// Keys loaded from a file or a SecretProvider are picked up again when they change, without restarting the server.
+type KeySet struct {
+	mu      sync.RWMutex
+	static  []HmacKey
+	loaded  []HmacKey
+	secrets []secretKey
+	path    string
+	modTime time.Time
+	// enabled is recorded when keys are added or reloaded, and never cleared while the server runs,
+	// so a key that disappears rejects requests instead of turning verification off.
+	enabled bool
+}
+
+// secretKey is a key read from a SecretProvider every time it is used.
+// configured is recorded with enabled, once the provider had the secret.
+type secretKey struct {
+	label      string
+	provider   SecretProvider
+	name       string
+	configured bool
+}
+
+// NewKeySet creates a KeySet with a fixed set of keys. Keys with an empty value are ignored.
+func NewKeySet(keys ...HmacKey) *KeySet {
+	s := &KeySet{}
+	for _, k := range keys {
+		if k.Key != "" {
+			s.static = append(s.static, k)
+		}
+	}
+	s.recordEnabled()
+	return s
+}
+
+// LoadKeySet creates a KeySet from a JSON key file, in addition to any fixed keys.
+// An empty path only uses the fixed keys.
+func LoadKeySet(path string, keys ...HmacKey) (*KeySet, error) {
+	s := NewKeySet(keys...)
+	s.path = path
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AddSecret adds a key that is read from the secret provider each time requests are verified,
+// so a rotated secret is picked up without a restart.
+func (s *KeySet) AddSecret(label string, provider SecretProvider, name string) *KeySet {
+	s.mu.Lock()
+	s.secrets = append(s.secrets, secretKey{label: label, provider: provider, name: name})
+	s.mu.Unlock()
+	s.recordEnabled()
+	return s
+}
+
+// recordEnabled records which keys are configured: the fixed keys, the key file, and the secrets
+// the provider has a value for, even when it failed to read. Keys are only ever added, a secret that
+// is removed later is reported by Verify.
+func (s *KeySet) recordEnabled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.static) > 0 || s.path != "" {
+		s.enabled = true
+	}
+	for i, secret := range s.secrets {
+		if _, err := secret.provider.Secret(secret.name); !errors.Is(err, ErrSecretNotFound) {
+			s.secrets[i].configured = true
+			s.enabled = true
+		}
+	}
+}
+
+// Reload reads the key file again and records the secrets that are configured now, so a
+// secret added after the start is picked up on SIGHUP. The current keys are kept if the file cannot be read.
+func (s *KeySet) Reload() error {
+	defer s.recordEnabled()
+	if s.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read HMAC key file %s: %w", s.path, err)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read HMAC key file %s: %w", s.path, err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse HMAC key file %s: %w", s.path, err)
+	}
+
+	var keys []HmacKey
+	for i, k := range file.Keys {
+		if k.Key == "" {
+			return fmt.Errorf("HMAC key %d in %s has no key", i, s.path)
+		}
+		if k.Label == "" {
+			k.Label = fmt.Sprintf("key-%d", i)
+		}
+		keys = append(keys, k)
+	}
+
+	s.mu.Lock()
+	s.loaded = keys
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the key file when its modification time changed since the last load.
+// It returns an error when the key file cannot be read, so a missing key file never disables verification.
+func (s *KeySet) reloadIfChanged() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read HMAC key file %s: %w", s.path, err)
+	}
+
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+
+	if changed {
+		// Keep the current keys if the new file is invalid, the error is reported on SIGHUP reloads
+		var pathErr *fs.PathError
+		if err := s.Reload(); errors.As(err, &pathErr) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enabled returns true if any key was configured when the keys were added or last reloaded, expired or not,
+// even if it cannot be read right now. When it is true every request must carry a valid signature.
+func (s *KeySet) Enabled() bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled
+}
+
+// Active returns the labels of the keys that currently verify requests.
+// Keys that cannot be read are left out.
+func (s *KeySet) Active(now time.Time) []string {
+	keys, _ := s.keys()
+	var labels []string
+	for _, k := range keys {
+		if k.IsActive(now) {
+			labels = append(labels, k.Label)
+		}
+	}
+	return labels
+}
+
+// Verify checks the request signature against every active key.
+// It returns the label of the key that matched, or an error if a configured key cannot be read.
+func (s *KeySet) Verify(requestBody []byte, requestSignature []byte) (string, bool, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return "", false, err
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		if !k.IsActive(now) {
+			continue
+		}
+		verified, err := VerifyHMAC(requestBody, requestSignature, []byte(k.Key))
+		if err != nil {
+			return "", false, err
+		}
+		if verified {
+			return k.Label, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// keys returns the fixed keys, the keys from the key file, and the keys from secret providers
+// that have a value. Secrets that were never set are skipped; a key file or a configured secret that
+// cannot be read, is empty, or is no longer set, is an error.
+func (s *KeySet) keys() ([]HmacKey, error) {
+	if err := s.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]HmacKey, 0, len(s.static)+len(s.loaded)+len(s.secrets))
+	keys = append(keys, s.static...)
+	keys = append(keys, s.loaded...)
+	for _, secret := range s.secrets {
+		value, err := secret.provider.Secret(secret.name)
+		if errors.Is(err, ErrSecretNotFound) && !secret.configured {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HMAC key %q: %w", secret.label, err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("HMAC key %q is empty", secret.label)
+		}
+		keys = append(keys, HmacKey{Key: value, Label: secret.label})
+	}
+	return keys, nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sign(body []byte, key string) []byte {
+	mac := hmac.New(sha512.New, []byte(key))
+	mac.Write(body)
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Any active key verifies the request and the matching label is returned
+func TestKeySetVerifyMultipleKeys(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	keys := NewKeySet(
+		HmacKey{Key: "old", Label: "old", ExpiresAt: &expired},
+		HmacKey{Key: "current", Label: "current"},
+		HmacKey{Key: "next", Label: "next"},
+	)
+	body := []byte(`{"stage":"post_plan"}`)
+
+	label, ok, err := keys.Verify(body, sign(body, "next"))
+	if err != nil || !ok || label != "next" {
+		t.Fatalf("expected the next key to verify, got %q %t %v", label, ok, err)
+	}
+
+	if _, ok, _ := keys.Verify(body, sign(body, "old")); ok {
+		t.Fatalf("expected an expired key to be rejected")
+	}
+	if _, ok, _ := keys.Verify(body, sign(body, "unknown")); ok {
+		t.Fatalf("expected an unknown key to be rejected")
+	}
+}
+
+// Empty keys are ignored, so a missing -hmacKey flag leaves verification disabled
+func TestKeySetEnabled(t *testing.T) {
+	if NewKeySet(HmacKey{Key: ""}).Enabled() {
+		t.Fatalf("expected an empty key set to be disabled")
+	}
+	if !NewKeySet(HmacKey{Key: "k"}).Enabled() {
+		t.Fatalf("expected a key set with a key to be enabled")
+	}
+}
+
+// Reloading the key file picks up rotated keys without losing the fixed keys
+func TestKeySetReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`{"keys":[{"label":"a","key":"key-a"}]}`), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys, err := LoadKeySet(path, HmacKey{Key: "flag-key", Label: "default"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body := []byte("body")
+	if label, ok, _ := keys.Verify(body, sign(body, "key-a")); !ok || label != "a" {
+		t.Fatalf("expected key a to verify, got %q", label)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"keys":[{"key":"key-b"}]}`), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := keys.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := keys.Verify(body, sign(body, "key-a")); ok {
+		t.Fatalf("expected key a to be removed after reload")
+	}
+	if label, ok, _ := keys.Verify(body, sign(body, "key-b")); !ok || label != "key-0" {
+		t.Fatalf("expected key b to verify with a generated label, got %q", label)
+	}
+	if label, ok, _ := keys.Verify(body, sign(body, "flag-key")); !ok || label != "default" {
+		t.Fatalf("expected the fixed key to survive a reload, got %q", label)
+	}
+
+	if err := os.WriteFile(path, []byte(`not json`), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := keys.Reload(); err == nil {
+		t.Fatalf("expected an error for an invalid key file")
+	}
+	if _, ok, _ := keys.Verify(body, sign(body, "key-b")); !ok {
+		t.Fatalf("expected the current keys to be kept after a failed reload")
+	}
+}
+
+// A key file that disappears keeps verification enabled and fails every request instead of accepting them
+func TestKeySetMissingKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`{"keys":[{"label":"a","key":"key-a"}]}`), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !keys.Enabled() {
+		t.Fatalf("expected verification to stay enabled without the key file")
+	}
+	body := []byte("body")
+	if _, ok, err := keys.Verify(body, sign(body, "key-a")); ok || err == nil {
+		t.Fatalf("expected an error while the key file is missing, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the secrets used by the run task server.
+// They double as the environment variable and the file name in a mounted secret directory.
+const (
+	SecretHmacKey  = "RUNTASK_HMAC_KEY"
+	SecretAPIToken = "TERRAFORM_API_TOKEN"
+)
+
+// ErrSecretNotFound is returned when a provider has no value for the secret.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider returns the current value of a named secret.
+// Implementations re-read their source when it changes, so callers should ask for
+// the secret every time they need it instead of keeping a copy.
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// EnvProvider reads secrets from environment variables named after the secret.
+type EnvProvider struct{}
+
+// NewEnvProvider creates an EnvProvider.
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{}
+}
+
+// Secret returns the environment variable for the secret.
+func (p *EnvProvider) Secret(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// FileProvider reads each secret from an explicitly configured key file.
+type FileProvider struct {
+	files map[string]string
+	cache *fileCache
+}
+
+// NewFileProvider creates a FileProvider from a map of secret name to file path.
+// Entries with an empty path are ignored.
+func NewFileProvider(files map[string]string) *FileProvider {
+	p := &FileProvider{files: map[string]string{}, cache: newFileCache()}
+	for name, path := range files {
+		if path != "" {
+			p.files[name] = path
+		}
+	}
+	return p
+}
+
+// Secret returns the content of the key file for the secret.
+func (p *FileProvider) Secret(name string) (string, error) {
+	path, ok := p.files[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	value, err := p.cache.read(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The file was configured explicitly, a missing file is an error rather than "not set"
+		return "", fmt.Errorf("secret file %s for %s does not exist", path, name)
+	}
+	return value, err
+}
+
+// DirectoryProvider reads secrets from a mounted secret directory (for example a Kubernetes
+// secret volume) where each secret is a file named after the secret.
+type DirectoryProvider struct {
+	dir   string
+	cache *fileCache
+}
+
+// NewDirectoryProvider creates a DirectoryProvider for the directory.
+func NewDirectoryProvider(dir string) *DirectoryProvider {
+	return &DirectoryProvider{dir: dir, cache: newFileCache()}
+}
+
+// Secret returns the content of the file named after the secret.
+func (p *DirectoryProvider) Secret(name string) (string, error) {
+	value, err := p.cache.read(filepath.Join(p.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrSecretNotFound
+	}
+	return value, err
+}
+
+// ChainProvider asks each provider in order and returns the first secret found.
+type ChainProvider struct {
+	providers []SecretProvider
+}
+
+// NewChainProvider creates a ChainProvider, nil providers are skipped.
+func NewChainProvider(providers ...SecretProvider) *ChainProvider {
+	c := &ChainProvider{}
+	for _, p := range providers {
+		if p != nil {
+			c.providers = append(c.providers, p)
+		}
+	}
+	return c
+}
+
+// Secret returns the secret from the first provider that has it.
+func (c *ChainProvider) Secret(name string) (string, error) {
+	for _, p := range c.providers {
+		value, err := p.Secret(name)
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		return value, err
+	}
+	return "", ErrSecretNotFound
+}
+
+// fileCache keeps the content of secret files and only reads a file again when its
+// modification time or size changes, so rotated secrets are picked up without a restart.
+type fileCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedFile
+}
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{entries: map[string]cachedFile{}}
+}
+
+func (c *fileCache) read(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.entries[path]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+	}
+	// Key files are usually written with a trailing newline (e.g. openssl rand -hex 32 > hmac.key)
+	value := strings.TrimSpace(string(data))
+	c.entries[path] = cachedFile{modTime: info.ModTime(), size: info.Size(), value: value}
+	return value, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package handler
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Providers are asked in order and a changed secret file is read again
+func TestChainProviderPrecedenceAndReload(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "hmac.key")
+	if err := os.WriteFile(keyFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mounted := filepath.Join(dir, "mounted")
+	if err := os.MkdirAll(mounted, 0700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mounted, SecretAPIToken), []byte("from-dir"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Setenv(SecretAPIToken, "from-env")
+	t.Setenv(SecretHmacKey, "from-env")
+
+	secrets := NewChainProvider(
+		NewFileProvider(map[string]string{SecretHmacKey: keyFile, SecretAPIToken: ""}),
+		NewDirectoryProvider(mounted),
+		NewEnvProvider(),
+	)
+
+	if got, _ := secrets.Secret(SecretHmacKey); got != "from-file" {
+		t.Fatalf("expected the key file to win and be trimmed, got %q", got)
+	}
+	if got, _ := secrets.Secret(SecretAPIToken); got != "from-dir" {
+		t.Fatalf("expected the mounted directory to win over the environment, got %q", got)
+	}
+	if _, err := secrets.Secret("UNKNOWN_SECRET"); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+
+	// Rotate the key file, a different size and modification time must be picked up
+	if err := os.WriteFile(keyFile, []byte("rotated-key"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(keyFile, future, future); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := secrets.Secret(SecretHmacKey); got != "rotated-key" {
+		t.Fatalf("expected the rotated key, got %q", got)
+	}
+}
+
+// A key set backed by a secret provider verifies with the current secret value
+func TestKeySetAddSecret(t *testing.T) {
+	t.Setenv(SecretHmacKey, "env-key")
+	keys := NewKeySet().AddSecret("secret", NewEnvProvider(), SecretHmacKey)
+
+	body := []byte("body")
+	if label, ok, _ := keys.Verify(body, sign(body, "env-key")); !ok || label != "secret" {
+		t.Fatalf("expected the secret key to verify, got %q", label)
+	}
+
+	t.Setenv(SecretHmacKey, "rotated")
+	if _, ok, _ := keys.Verify(body, sign(body, "env-key")); ok {
+		t.Fatalf("expected the old secret value to be rejected after rotation")
+	}
+	if _, ok, _ := keys.Verify(body, sign(body, "rotated")); !ok {
+		t.Fatalf("expected the rotated secret value to verify")
+	}
+}
+
+// A configured secret that cannot be read, or is empty, fails verification instead of disabling it
+func TestKeySetSecretUnavailable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hmac.key")
+	keys := NewKeySet().AddSecret("secret", NewFileProvider(map[string]string{SecretHmacKey: path}), SecretHmacKey)
+	if !keys.Enabled() {
+		t.Fatalf("expected verification to be enabled for a configured secret file")
+	}
+	body := []byte("body")
+	if _, ok, err := keys.Verify(body, sign(body, "")); ok || err == nil {
+		t.Fatalf("expected an error for a missing secret file, got %t %v", ok, err)
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, err := keys.Verify(body, sign(body, "")); ok || err == nil {
+		t.Fatalf("expected an error for an empty secret, got %t %v", ok, err)
+	}
+
+	if NewKeySet().AddSecret("secret", NewEnvProvider(), "RUNTASK_UNSET_SECRET").Enabled() {
+		t.Fatalf("expected a secret that is not set to leave verification disabled")
+	}
+}
+
+// A secret removed after the start keeps verification enabled and fails every request, until the next reload
+func TestKeySetSecretRemoved(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, SecretHmacKey), []byte("dir-key\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := NewKeySet().AddSecret("secret", NewDirectoryProvider(dir), SecretHmacKey)
+	body := []byte("body")
+	if _, ok, err := keys.Verify(body, sign(body, "dir-key")); !ok || err != nil {
+		t.Fatalf("expected the secret key to verify, got %t %v", ok, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, SecretHmacKey)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !keys.Enabled() {
+		t.Fatalf("expected verification to stay enabled after the secret was removed")
+	}
+	if _, ok, err := keys.Verify(body, sign(body, "dir-key")); ok || err == nil {
+		t.Fatalf("expected an error for a removed secret, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TokenMap maps HCP Terraform/TFE hostnames and organizations to the name of the secret holding
+// the API token to use for them. The secrets are read through the SecretProvider, so the map
+// itself never contains a token.
+type TokenMap struct {
+	// Hosts maps a hostname (e.g. tfe.example.com) to a secret name.
+	Hosts map[string]string `json:"hosts,omitempty"`
+	// Organizations maps an organization name to a secret name.
+	Organizations map[string]string `json:"organizations,omitempty"`
+}
+
+// LoadTokenMap reads a TokenMap from a JSON file. An empty path returns an empty map.
+func LoadTokenMap(path string) (TokenMap, error) {
+	if path == "" {
+		return TokenMap{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TokenMap{}, fmt.Errorf("failed to read token map %s: %w", path, err)
+	}
+	var tokens TokenMap
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return TokenMap{}, fmt.Errorf("failed to parse token map %s: %w", path, err)
+	}
+
+	// Hostnames are matched case-insensitively
+	hosts := map[string]string{}
+	for host, secret := range tokens.Hosts {
+		if secret == "" {
+			return TokenMap{}, fmt.Errorf("token map %s has no secret name for host %s", path, host)
+		}
+		hosts[strings.ToLower(host)] = secret
+	}
+	tokens.Hosts = hosts
+	for org, secret := range tokens.Organizations {
+		if secret == "" {
+			return TokenMap{}, fmt.Errorf("token map %s has no secret name for organization %s", path, org)
+		}
+	}
+	return tokens, nil
+}
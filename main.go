@@ -4,20 +4,142 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
+	"log"
+	"net/url"
+	"strings"
 
+	"github.com/straubt1/terraform-run-task/internal/helper"
 	"github.com/straubt1/terraform-run-task/internal/runtask"
+	"github.com/straubt1/terraform-run-task/internal/sdk/handler"
 )
 
 func main() {
 	// Define command-line parameters
 	var port = flag.String("port", "22180", "the port the run task HTTP server will run on")
 	var path = flag.String("path", "/runtask", "the URL path for the run task to receive HTTP request from TFC or TFE")
-	var hmacKey = flag.String("hmacKey", "", "the customizable secret which TFC or TFE will use to sign requests to the run task")
+	var hmacKey = flag.String("hmacKey", "", "the customizable secret which TFC or TFE will use to sign requests to the run task (local demos only, visible in the process list)")
+	var hmacKeyPath = flag.String("hmacKeyPath", "", "a file containing the HMAC key, re-read when it changes")
+	var apiTokenPath = flag.String("apiTokenPath", "", "a file containing the HCP Terraform API token, re-read when it changes")
+	var secretsDir = flag.String("secretsDir", "", "a mounted secret directory with files named "+handler.SecretHmacKey+" and "+handler.SecretAPIToken)
+	var hmacKeyFile = flag.String("hmacKeyFile", "", "a JSON file with the HMAC keys to accept, reloaded on SIGHUP (used for key rotation)")
+	var drainTimeout = flag.Duration("drainTimeout", handler.DefaultDrainTimeout, "how long to wait for in-flight stages and callbacks to finish on shutdown")
+	var workers = flag.Int("workers", handler.DefaultWorkers, "the number of stages that run at the same time")
+	var queueLimit = flag.Int("queueLimit", handler.DefaultQueueLimit, "the number of stages that can wait for a worker before requests are rejected")
+	var allowedHosts = flag.String("allowedHosts", strings.Join(helper.DefaultAllowedHosts, ","), "comma separated HCP Terraform/TFE hosts (host or host:port) the run task may call with URLs from the request")
+	var redactFields = flag.String("redactFields", "", "comma separated JSON field names to mask in saved files, in addition to access tokens and other default sensitive fields")
+	var stageTimeout = flag.Duration("stageTimeout", handler.DefaultStageTimeout, "the deadline for a stage, collectors still running afterwards are reported as timed out")
+	var collectorParallelism = flag.Int("collectorParallelism", handler.DefaultCollectorParallelism, "the number of collectors that run at the same time within a stage")
+	var connectTimeout = flag.Duration("connectTimeout", helper.DefaultConnectTimeout, "how long to wait for a connection to HCP Terraform/TFE")
+	var tlsHandshakeTimeout = flag.Duration("tlsHandshakeTimeout", helper.DefaultTLSHandshakeTimeout, "how long to wait for the TLS handshake with HCP Terraform/TFE")
+	var responseTimeout = flag.Duration("responseTimeout", helper.DefaultResponseTimeout, "how long to wait for HCP Terraform/TFE to start responding to a request")
+	var caBundle = flag.String("caBundle", "", "a PEM file with extra CA certificates to trust, for TFE installs with a private CA")
+	var proxyURL = flag.String("proxyURL", "", "the HTTP proxy for calls to HCP Terraform/TFE (default: HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment)")
+	var maxRetries = flag.Int("maxRetries", helper.DefaultMaxRetries, "how often an HCP Terraform API request is retried after a 429 or 5xx response")
+	var rateLimit = flag.Float64("rateLimit", helper.DefaultRateLimit, "the requests per second sent to each HCP Terraform/TFE host, shared by every run (0 disables pacing)")
+	var pageSize = flag.Int("pageSize", helper.DefaultPageSize, "the page size requested from HCP Terraform list endpoints (comments, run events, ...)")
+	var maxPages = flag.Int("maxPages", helper.DefaultMaxPages, "how many pages of a list endpoint are followed before the result is reported as partial")
+	var maxPlanJSONSize = flag.Int64("maxPlanJSONSize", helper.DefaultMaxPlanJSONSize, "the largest plan JSON downloaded in bytes, larger plans are reported as failed")
+	var indentPlanJSON = flag.Bool("indentPlanJSON", true, "re-indent the plan JSON while it is saved, disable to save it exactly as downloaded")
+	var tokensFile = flag.String("tokensFile", "", "a JSON file mapping hostnames and organizations to the secret names of their API tokens")
+	var guardFile = flag.String("guardFile", "", "a JSON file with the protected resources and destructive change limits checked in post-plan, per workspace")
+	var rulesFile = flag.String("rulesFile", "", "a YAML file with the policy rules evaluated against the plan in post-plan")
+	var scriptsDir = flag.String("scriptsDir", "", "a directory with Starlark scripts run in each stage, in subdirectories named after the stage (pre_plan, post_plan, ...)")
+	var scriptTimeout = flag.Duration("scriptTimeout", handler.DefaultScriptTimeout, "how long a Starlark script may run before it is cancelled")
+	var scriptMaxSteps = flag.Uint64("scriptMaxSteps", handler.DefaultScriptMaxSteps, "the Starlark execution steps a script may take before it is cancelled")
+	var checksFile = flag.String("checksFile", "", "a JSON file with the external check executables run in each stage")
+	var collectorsFile = flag.String("collectorsFile", "", "a JSON file to enable, disable or add the artifacts collected in each stage")
 	flag.Parse()
 
-	task := runtask.NewRunTask()
-	task.Configure(*port, *path, *hmacKey)
+	// Secrets are looked up in the explicit key files first, then the mounted secret directory, then the environment
+	var secretsDirProvider handler.SecretProvider
+	if *secretsDir != "" {
+		secretsDirProvider = handler.NewDirectoryProvider(*secretsDir)
+	}
+	secrets := handler.NewChainProvider(
+		handler.NewFileProvider(map[string]string{
+			handler.SecretHmacKey:  *hmacKeyPath,
+			handler.SecretAPIToken: *apiTokenPath,
+		}),
+		secretsDirProvider,
+		handler.NewEnvProvider(),
+	)
+
+	// The -hmacKey flag is still accepted so a single key works for local demos
+	if *hmacKey != "" {
+		log.Println("Warning: -hmacKey exposes the secret in the process list and shell history, use -hmacKeyPath, -secretsDir or " + handler.SecretHmacKey + " outside of local demos")
+	}
+	hmacKeys, err := handler.LoadKeySet(*hmacKeyFile, handler.HmacKey{Key: *hmacKey, Label: "default"})
+	if err != nil {
+		log.Fatalln("Unable to load HMAC keys:", err)
+	}
+	hmacKeys.AddSecret("secret", secrets, handler.SecretHmacKey)
+
+	tokens, err := handler.LoadTokenMap(*tokensFile)
+	if err != nil {
+		log.Fatalln("Unable to load token map:", err)
+	}
+
+	collectors, err := runtask.LoadCollectors(*collectorsFile)
+	if err != nil {
+		log.Fatalln("Unable to load collectors:", err)
+	}
+
+	guard, err := runtask.LoadGuardConfig(*guardFile)
+	if err != nil {
+		log.Fatalln("Unable to load guard rules:", err)
+	}
+
+	rules, err := runtask.LoadRules(*rulesFile)
+	if err != nil {
+		log.Fatalln("Unable to load policy rules:", err)
+	}
+
+	scripts, err := runtask.LoadScripts(*scriptsDir)
+	if err != nil {
+		log.Fatalln("Unable to load scripts:", err)
+	}
+
+	checks, err := runtask.LoadChecks(*checksFile)
+	if err != nil {
+		log.Fatalln("Unable to load external checks:", err)
+	}
+
+	var rootCAs *x509.CertPool
+	if *caBundle != "" {
+		if rootCAs, err = helper.LoadCABundle(*caBundle); err != nil {
+			log.Fatalln("Unable to load CA bundle:", err)
+		}
+	}
+	var proxy *url.URL
+	if *proxyURL != "" {
+		if proxy, err = url.Parse(*proxyURL); err != nil {
+			log.Fatalln("Invalid proxy URL:", err)
+		}
+	}
+
+	task := runtask.NewRunTask().WithCollectors(collectors).WithGuard(guard).WithRules(rules).WithScripts(scripts).WithChecks(checks)
+	task.Configure(*port, *path, *hmacKey,
+		handler.WithHmacKeys(hmacKeys),
+		handler.WithSecrets(secrets),
+		handler.WithAllowedHosts(strings.Split(*allowedHosts, ",")...),
+		handler.WithRedactFields(strings.Split(*redactFields, ",")...),
+		handler.WithDrainTimeout(*drainTimeout),
+		handler.WithWorkers(*workers),
+		handler.WithQueueLimit(*queueLimit),
+		handler.WithStageTimeout(*stageTimeout),
+		handler.WithCollectorParallelism(*collectorParallelism),
+		handler.WithHTTPTimeouts(*connectTimeout, *tlsHandshakeTimeout, *responseTimeout),
+		handler.WithRootCAs(rootCAs),
+		handler.WithProxyURL(proxy),
+		handler.WithMaxRetries(*maxRetries),
+		handler.WithRateLimit(*rateLimit),
+		handler.WithPagination(*pageSize, *maxPages),
+		handler.WithTokens(tokens),
+		handler.WithPlanJSON(*maxPlanJSONSize, *indentPlanJSON),
+		handler.WithScriptLimits(*scriptTimeout, *scriptMaxSteps),
+	)
 	runtask.HandleRequests(task)
 
 }